@@ -0,0 +1,221 @@
+package vega
+
+import (
+	"context"
+	"strings"
+
+	"github.com/vektra/errors"
+)
+
+var EUnknownAlias = errors.New("no such alias")
+var EInvalidAlias = errors.New("invalid alias")
+var EAliasLoop = errors.New("alias forwards to itself")
+
+// A name in a Router that forwards whatever is pushed to it on to
+// other mailboxes. The targets may be mailboxes, exchanges or other
+// aliases, local or remote.
+type Alias struct {
+	Name    string   `codec:"name" json:"name"`
+	Targets []string `codec:"targets" json:"targets"`
+}
+
+// Implemented by a Storage that manages aliases
+type AliasManager interface {
+	SetAlias(*Alias) error
+	RemoveAlias(name string) error
+	Aliases() []*Alias
+}
+
+// Forwards pushes to an alias of a Router
+type aliasPusher struct {
+	router *Router
+	name   string
+}
+
+// Push a copy of msg to each of the alias's targets, with the alias
+// added to its AliasPath. If the alias is already in the path, the
+// message has come around a loop and is refused. The targets get the
+// message atomically only when they're all mailboxes of one Storage,
+// see Router.pushAll.
+func (ap *aliasPusher) Push(name string, msg *Message) error {
+	r := ap.router
+
+	r.lock.Lock()
+
+	alias, ok := r.aliases[ap.name]
+	if !ok {
+		r.lock.Unlock()
+		return errors.Subject(EUnknownAlias, ap.name)
+	}
+
+	targets := alias.Targets
+
+	r.lock.Unlock()
+
+	path := msg.AliasPath()
+
+	for _, seen := range path {
+		if seen == ap.name {
+			return errors.Subject(EAliasLoop, ap.name)
+		}
+	}
+
+	fwd := msg.withHeader(AliasPathHeader, strings.Join(append(path, ap.name), ","))
+
+	return r.pushAll(targets, fwd)
+}
+
+// Returns true if following the targets through the router's aliases
+// and exchanges leads back to name. Must be called with r.lock held.
+func (r *Router) loops(name string, targets []string) bool {
+	seen := make(map[string]bool)
+
+	for len(targets) > 0 {
+		target := targets[0]
+		targets = targets[1:]
+
+		if target == name {
+			return true
+		}
+
+		if seen[target] {
+			continue
+		}
+
+		seen[target] = true
+
+		if alias, ok := r.aliases[target]; ok {
+			targets = append(targets, alias.Targets...)
+		}
+
+		if ex, ok := r.exchanges[target]; ok {
+			for _, b := range ex.Bindings {
+				targets = append(targets, b.Mailbox)
+			}
+		}
+	}
+
+	return false
+}
+
+// Add alias to the router, or change the targets of the alias of the
+// same name. An alias can't share its name with a mailbox or exchange,
+// and can't forward to itself, directly or through other aliases or
+// exchanges.
+func (r *Router) SetAlias(alias *Alias) error {
+	if alias == nil || alias.Name == "" || alias.Name[0] == ':' ||
+		strings.Contains(alias.Name, ",") {
+		return errors.Subject(EMalformedFrame, "alias requires a name")
+	}
+
+	if len(alias.Targets) == 0 {
+		return errors.Subject(EMalformedFrame, "alias requires targets")
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	_, ok := r.aliases[alias.Name]
+	if !ok {
+		if _, taken := r.routes.Get(alias.Name); taken {
+			return errors.Subject(EInvalidAlias, alias.Name)
+		}
+	}
+
+	if r.loops(alias.Name, alias.Targets) {
+		return errors.Subject(EAliasLoop, alias.Name)
+	}
+
+	if !ok {
+		err := r.routes.Set(alias.Name, &aliasPusher{r, alias.Name})
+		if err != nil {
+			return err
+		}
+	}
+
+	r.aliases[alias.Name] = &Alias{
+		Name:    alias.Name,
+		Targets: append([]string(nil), alias.Targets...),
+	}
+
+	return nil
+}
+
+// Remove the named alias
+func (r *Router) RemoveAlias(name string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.aliases[name]; !ok {
+		return errors.Subject(EUnknownAlias, name)
+	}
+
+	delete(r.aliases, name)
+
+	return r.routes.Remove(name)
+}
+
+// Return the named alias
+func (r *Router) Alias(name string) (*Alias, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	alias, ok := r.aliases[name]
+	if !ok {
+		return nil, false
+	}
+
+	cp := *alias
+	return &cp, true
+}
+
+// Return the aliases that have been set
+func (r *Router) Aliases() []*Alias {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var aliases []*Alias
+
+	for _, alias := range r.aliases {
+		cp := *alias
+		aliases = append(aliases, &cp)
+	}
+
+	return aliases
+}
+
+type RemoveAlias struct {
+	Name string
+}
+
+type AliasesResult struct {
+	Aliases []*Alias
+}
+
+// Have the server forward pushes to alias.Name on to alias.Targets
+func (c *Client) SetAlias(alias *Alias) error {
+	return c.SetAliasContext(context.Background(), alias)
+}
+
+func (c *Client) SetAliasContext(ctx context.Context, alias *Alias) error {
+	return c.simpleRequest(ctx, SetAliasType, alias)
+}
+
+func (c *Client) RemoveAlias(name string) error {
+	return c.simpleRequest(context.Background(), RemoveAliasType, &RemoveAlias{Name: name})
+}
+
+// Return the aliases set on the server
+func (c *Client) Aliases() ([]*Alias, error) {
+	resp, err := c.request(context.Background(), AliasesType, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.Type {
+	case AliasesResultType:
+		return resp.Aliases.Aliases, nil
+	default:
+		return nil, c.checkError(resp.error())
+	}
+}
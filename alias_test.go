@@ -0,0 +1,125 @@
+package vega
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/errors"
+)
+
+func TestAliasForwards(t *testing.T) {
+	r, reg := exchangeRouter("new", "audit")
+
+	err := r.SetAlias(&Alias{Name: "old", Targets: []string{"new", "audit"}})
+	require.NoError(t, err)
+
+	// An alias can forward to another alias
+	err = r.SetAlias(&Alias{Name: "older", Targets: []string{"old"}})
+	require.NoError(t, err)
+
+	msg := Msg("hello")
+
+	require.NoError(t, r.Push("older", msg))
+
+	del, err := reg.Poll("new")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	assert.Equal(t, []byte("hello"), del.Message.Body)
+	assert.Equal(t, []string{"older", "old"}, del.Message.AliasPath())
+
+	assert.Equal(t, 1, pending(reg, "audit"))
+
+	// The message pushed isn't changed
+	assert.Nil(t, msg.AliasPath())
+
+	require.NoError(t, r.SetAlias(&Alias{Name: "old", Targets: []string{"audit"}}))
+	require.NoError(t, r.Push("old", Msg("again")))
+
+	assert.Equal(t, 0, pending(reg, "new"))
+	assert.Equal(t, 1, pending(reg, "audit"))
+
+	require.NoError(t, r.RemoveAlias("older"))
+
+	assert.Equal(t, ENoMailbox, r.Push("older", Msg("gone")))
+	assert.Equal(t, 1, len(r.Aliases()))
+
+	err = r.RemoveAlias("older")
+	assert.True(t, errors.Equal(EUnknownAlias, err))
+
+	err = r.SetAlias(&Alias{Name: "new", Targets: []string{"audit"}})
+	assert.True(t, errors.Equal(EInvalidAlias, err), "took a mailbox's name")
+}
+
+func TestAliasLoops(t *testing.T) {
+	r, _ := exchangeRouter()
+
+	require.NoError(t, r.SetAlias(&Alias{Name: "a", Targets: []string{"b"}}))
+	require.NoError(t, r.SetAlias(&Alias{Name: "b", Targets: []string{"c"}}))
+
+	err := r.SetAlias(&Alias{Name: "c", Targets: []string{"x", "a"}})
+	assert.True(t, errors.Equal(EAliasLoop, err))
+
+	err = r.SetAlias(&Alias{Name: "d", Targets: []string{"d"}})
+	assert.True(t, errors.Equal(EAliasLoop, err))
+
+	// A loop through another router can only be caught as it happens
+	r1, _ := exchangeRouter()
+	r2, _ := exchangeRouter()
+
+	r1.Add("y", r2)
+	r2.Add("x", r1)
+
+	require.NoError(t, r1.SetAlias(&Alias{Name: "x", Targets: []string{"y"}}))
+	require.NoError(t, r2.SetAlias(&Alias{Name: "y", Targets: []string{"x"}}))
+
+	err = r1.Push("x", Msg("hello"))
+	assert.True(t, errors.Equal(EAliasLoop, err))
+}
+
+func TestAliasForwardsAtomically(t *testing.T) {
+	r, reg := exchangeRouter("a")
+
+	// Routed to reg but never declared there
+	r.Add("missing", reg)
+
+	require.NoError(t, r.SetAlias(&Alias{Name: "both", Targets: []string{"a", "missing"}}))
+
+	err := r.Push("both", Msg("hello"))
+	assert.True(t, errors.Equal(err, ENoMailbox))
+
+	assert.Equal(t, 0, pending(reg, "a"), "pushed to some of the targets")
+
+	// Targets in different storage are pushed to one at a time, with
+	// an id so that retries can be dropped.
+	other := NewMemRegistry()
+	other.Declare("b")
+	r.Add("b", other)
+
+	require.NoError(t, r.SetAlias(&Alias{Name: "split", Targets: []string{"a", "b"}}))
+	require.NoError(t, r.Push("split", Msg("hello")))
+
+	da, err := reg.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, da)
+
+	db, err := other.Poll("b")
+	require.NoError(t, err)
+	require.NotNil(t, db)
+
+	assert.NotEqual(t, "", da.Message.DedupId())
+	assert.Equal(t, da.Message.DedupId(), db.Message.DedupId())
+
+	// but one the producer gave it is kept
+	msg := Msg("again")
+	msg.SetDedupId("producer")
+
+	require.NoError(t, r.Push("split", msg))
+
+	db, err = other.Poll("b")
+	require.NoError(t, err)
+	require.NotNil(t, db)
+
+	assert.Equal(t, "producer", db.Message.DedupId())
+}
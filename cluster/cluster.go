@@ -1,6 +1,8 @@
 package cluster
 
 import (
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -10,6 +12,18 @@ import (
 )
 
 type clusterNode struct {
+	// Messages pushed to the same mailbox with the same DedupId within
+	// this long of each other are dropped after the first. Zero means
+	// messages are never dropped.
+	DedupWindow time.Duration
+
+	// Messages forwarded between nodes more than this many times are
+	// refused. Zero or less means there's no limit.
+	MaxHops int
+
+	// The id of this node. Messages forwarded back to it are refused.
+	id string
+
 	lock   sync.Mutex
 	router *vega.Router
 	local  *vega.Registry
@@ -17,6 +31,35 @@ type clusterNode struct {
 
 	setupSubscriber bool
 	subscriptions   []*vega.Subscription
+	index           *vega.TopicTrie
+
+	// the number of publishes each shared group has been sent, so
+	// that its members take turns
+	shared map[string]uint64
+
+	// Told the patterns subscribed to whenever they change, if set
+	interest interestAdvertiser
+
+	// Where retained messages are kept, the disk unless every node
+	// can share them
+	retained retainStore
+
+	// The dedup keys being pushed, each closed when its push is done
+	pushLock sync.Mutex
+	pushing  map[string]chan struct{}
+}
+
+// Lets other nodes know which topics this node is subscribed to, and
+// picks the node that hands out each shared group's publishes
+type interestAdvertiser interface {
+	AdvertiseInterest(patterns []string) error
+	OwnsGroup(pattern string) bool
+}
+
+// Keeps the last retained message of each topic
+type retainStore interface {
+	Retain(topic string, msg *vega.Message) error
+	Retained(sub *vega.Subscription) ([]*vega.Message, error)
 }
 
 func NewClusterNode(path string, router *vega.Router) (*clusterNode, error) {
@@ -25,10 +68,17 @@ func NewClusterNode(path string, router *vega.Router) (*clusterNode, error) {
 		return nil, err
 	}
 
+	local := vega.NewRegistry(d.Mailbox)
+	local.Transactor = d
+
 	return &clusterNode{
-		disk:   d,
-		local:  vega.NewRegistry(d.Mailbox),
-		router: router,
+		disk:     d,
+		retained: d,
+		local:    local,
+		router:   router,
+		index:    vega.NewTopicTrie(),
+		shared:   make(map[string]uint64),
+		pushing:  make(map[string]chan struct{}),
 	}, nil
 }
 
@@ -48,7 +98,17 @@ func (cn *clusterNode) Close() error {
 	return cn.disk.Close()
 }
 
+var ENameInUse = errors.New("name is in use by an exchange or alias")
+
 func (cn *clusterNode) Declare(name string) error {
+	if _, ok := cn.router.Exchange(name); ok {
+		return errors.Subject(ENameInUse, name)
+	}
+
+	if _, ok := cn.router.Alias(name); ok {
+		return errors.Subject(ENameInUse, name)
+	}
+
 	cn.local.Declare(name)
 	cn.router.Add(name, cn.local)
 	return nil
@@ -56,6 +116,16 @@ func (cn *clusterNode) Declare(name string) error {
 
 func (cn *clusterNode) Abandon(name string) error {
 	cn.local.Abandon(name)
+
+	// Nothing is left to deliver to
+	err := cn.removeSubscriptions(func(sub *vega.Subscription) bool {
+		return sub.Mailbox == name
+	})
+
+	if err != nil {
+		return err
+	}
+
 	return cn.router.Remove(name)
 }
 
@@ -74,57 +144,648 @@ func (cn *clusterNode) subscribe(msg *vega.Message) error {
 
 	// debugf("doing subscribe...\n")
 
+	sub, err := vega.ParseSubscribeMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	cn.setupPublish()
+
+	err = cn.disk.AddSubscription(sub)
+	if err != nil {
+		return err
+	}
+
+	// Subscribing again, such as after a restart, doesn't double up
+	// but does replace the filter.
+	if existing := cn.findSubscription(sub); existing != nil {
+		existing.Filter = sub.Filter
+	} else {
+		cn.subscriptions = append(cn.subscriptions, sub)
+		cn.index.Add(sub)
+
+		err = cn.advertiseInterest()
+		if err != nil {
+			return err
+		}
+	}
+
+	retained, err := cn.retained.Retained(sub)
+	if err != nil {
+		return err
+	}
+
+	// A group shares new publishes, old ones aren't handed out
+	if sub.Group != "" {
+		return nil
+	}
+
+	for _, msg := range retained {
+		if sub.Filter.Match(msg) {
+			cn.router.Push(sub.Mailbox, msg)
+		}
+	}
+
+	return nil
+}
+
+// Start receiving publishes. Must be called with cn.lock held.
+func (cn *clusterNode) setupPublish() {
 	if !cn.setupSubscriber {
 		cn.router.Add(":publish", &publishedPusher{cn})
 		cn.setupSubscriber = true
 	}
+}
 
-	sub := vega.ParseSubscription(msg.CorrelationId)
-	sub.Mailbox = msg.ReplyTo
-
-	cn.subscriptions = append(cn.subscriptions, sub)
+// Return the subscription of the same mailbox to the same pattern as
+// sub. Must be called with cn.lock held.
+func (cn *clusterNode) findSubscription(sub *vega.Subscription) *vega.Subscription {
+	for _, s := range cn.subscriptions {
+		if s.Pattern == sub.Pattern && s.Mailbox == sub.Mailbox {
+			return s
+		}
+	}
 
 	return nil
 }
 
-func (cn *clusterNode) publishLocally(msg *vega.Message) error {
+// Bring back the subscriptions recorded on disk, such as after a
+// restart.
+func (cn *clusterNode) restoreSubscriptions() error {
+	subs, err := cn.disk.Subscriptions()
+	if err != nil {
+		return err
+	}
+
 	cn.lock.Lock()
 	defer cn.lock.Unlock()
 
+	for _, sub := range subs {
+		if cn.findSubscription(sub) == nil {
+			cn.subscriptions = append(cn.subscriptions, sub)
+			cn.index.Add(sub)
+		}
+	}
+
+	if len(cn.subscriptions) > 0 {
+		cn.setupPublish()
+	}
+
+	return cn.advertiseInterest()
+}
+
+// Advertise the patterns subscribed to. Must be called with cn.lock
+// held.
+func (cn *clusterNode) advertiseInterest() error {
+	if cn.interest == nil {
+		return nil
+	}
+
+	var patterns []string
+
+	seen := make(map[string]bool)
+
 	for _, sub := range cn.subscriptions {
-		if sub.Match(msg.CorrelationId) {
+		if !seen[sub.Pattern] {
+			seen[sub.Pattern] = true
+			patterns = append(patterns, sub.Pattern)
+		}
+	}
+
+	return cn.interest.AdvertiseInterest(patterns)
+}
+
+// Remove the subscriptions of the mailbox in ReplyTo to the pattern in
+// CorrelationId, or all of the mailbox's subscriptions if there's no
+// pattern.
+func (cn *clusterNode) unsubscribe(msg *vega.Message) error {
+	return cn.removeSubscriptions(func(sub *vega.Subscription) bool {
+		if sub.Mailbox != msg.ReplyTo {
+			return false
+		}
+
+		return msg.CorrelationId == "" || sub.Pattern == msg.CorrelationId
+	})
+}
+
+func (cn *clusterNode) removeSubscriptions(match func(*vega.Subscription) bool) error {
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+
+	var keep []*vega.Subscription
+
+	for i, sub := range cn.subscriptions {
+		if !match(sub) {
+			keep = append(keep, sub)
+			continue
+		}
+
+		err := cn.disk.RemoveSubscription(sub.Pattern, sub.Mailbox)
+		if err != nil {
+			// Keep what's left so memory matches what's on disk
+			cn.subscriptions = append(keep, cn.subscriptions[i:]...)
+			return err
+		}
+
+		cn.index.Remove(sub)
+	}
+
+	if len(keep) == len(cn.subscriptions) {
+		return nil
+	}
+
+	cn.subscriptions = keep
+
+	// Forget the turns of groups that no longer have members
+	left := make(map[string]bool)
+
+	for _, sub := range keep {
+		left[sub.Pattern] = true
+	}
+
+	for group := range cn.shared {
+		if !left[group] {
+			delete(cn.shared, group)
+		}
+	}
+
+	return cn.advertiseInterest()
+}
+
+// Return the active subscriptions
+func (cn *clusterNode) Subscriptions() []*vega.Subscription {
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+
+	subs := make([]*vega.Subscription, len(cn.subscriptions))
+
+	for i, sub := range cn.subscriptions {
+		cp := *sub
+		subs[i] = &cp
+	}
+
+	return subs
+}
+
+func (cn *clusterNode) publishLocally(msg *vega.Message) error {
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+
+	var (
+		groups  []string
+		members = make(map[string][]*vega.Subscription)
+	)
+
+	for _, sub := range cn.index.Match(msg.CorrelationId) {
+		if !sub.Filter.Match(msg) {
+			continue
+		}
+
+		if sub.Group == "" {
 			cn.router.Push(sub.Mailbox, msg)
+			continue
+		}
+
+		// Members of a group all subscribe with the same pattern
+		if _, ok := members[sub.Pattern]; !ok {
+			groups = append(groups, sub.Pattern)
 		}
+
+		members[sub.Pattern] = append(members[sub.Pattern], sub)
+	}
+
+	for _, group := range groups {
+		// A group with members on several nodes gets each publish
+		// from just one of them
+		if cn.interest != nil && !cn.interest.OwnsGroup(group) {
+			continue
+		}
+
+		cn.pushShared(group, members[group], msg)
 	}
 
 	return nil
 }
 
+// Push msg to one of the members of a shared group that subscribed
+// through this node, taking turns. If the push to a member fails, the
+// next one is tried. Must be called with cn.lock held.
+func (cn *clusterNode) pushShared(group string, members []*vega.Subscription, msg *vega.Message) {
+	start := cn.shared[group]
+	cn.shared[group]++
+
+	for i := range members {
+		sub := members[(start+uint64(i))%uint64(len(members))]
+
+		if cn.router.Push(sub.Mailbox, msg) == nil {
+			return
+		}
+	}
+}
+
 func (cn *clusterNode) publish(msg *vega.Message) error {
 	// debugf("performing publish\n")
-	err := cn.publishLocally(msg)
-	if err != nil {
-		return errors.Context(err, "publishLocally")
+
+	// The node the publish came from sent it to every node that wants
+	// it, so passing it on would only send it around again.
+	if msg.Hops() > 0 {
+		return cn.publishLocally(msg)
+	}
+
+	// Only the node a publish is made on retains it, where every node
+	// can find it.
+	if msg.Retained() {
+		err := cn.retained.Retain(msg.CorrelationId, msg)
+		if err != nil {
+			return errors.Context(err, "retain")
+		}
+	}
+
+	err := cn.router.Push(":publish", msg)
+
+	// A retained message is kept for later subscribers even if there
+	// are none yet.
+	if err == vega.ENoMailbox && msg.Retained() {
+		return nil
+	}
+
+	return err
+}
+
+var ETooManyHops = errors.New("message was forwarded too many times")
+var ENodeLoop = errors.New("message was forwarded back to a node it passed through")
+
+// Refuse msg if it has been forwarded too many times or has come back
+// around to this node.
+func (cn *clusterNode) checkTrace(msg *vega.Message) error {
+	path := msg.NodePath()
+
+	for _, id := range path {
+		if cn.id != "" && id == cn.id {
+			return errors.Subject(ENodeLoop, strings.Join(path, ","))
+		}
+	}
+
+	if cn.MaxHops > 0 && msg.Hops() > cn.MaxHops {
+		return errors.Subject(ETooManyHops, strings.Join(path, ","))
 	}
 
-	return cn.router.Push(":publish", msg)
+	return nil
 }
 
 func (cn *clusterNode) Push(name string, msg *vega.Message) error {
+	err := cn.checkTrace(msg)
+	if err != nil {
+		return err
+	}
+
 	switch name {
 	case ":subscribe":
 		return cn.subscribe(msg)
+	case ":unsubscribe":
+		return cn.unsubscribe(msg)
 	case ":publish":
-		return cn.publish(msg)
+		return cn.dedup(name, msg, cn.publish)
 	default:
-		return cn.router.Push(name, msg)
+		return cn.dedup(name, msg, func(msg *vega.Message) error {
+			return cn.router.Push(name, msg)
+		})
+	}
+}
+
+// Push msg with push unless it's a duplicate of one pushed to name
+// within DedupWindow, in which case it's dropped. The ids are kept on
+// disk so that duplicates are caught across restarts, and only once
+// the push has succeeded. A push to a local mailbox records its id in
+// the same bolt transaction as the message. Pushes of the same id are
+// done one at a time, so that a second one waits to see if the first
+// succeeds.
+func (cn *clusterNode) dedup(name string, msg *vega.Message, push func(*vega.Message) error) error {
+	id := msg.DedupId()
+
+	if cn.DedupWindow <= 0 || id == "" {
+		return push(msg)
+	}
+
+	key := name + "\x00" + id
+
+	done := cn.startPush(key)
+	defer done()
+
+	seen, err := cn.disk.Seen(key, cn.DedupWindow)
+	if err != nil {
+		return err
+	}
+
+	if seen {
+		return nil
+	}
+
+	if name != ":publish" {
+		target, pusher, ok := cn.router.Route(name, msg)
+
+		if ok && pusher == vega.Pusher(cn.local) {
+			if m, ok := cn.local.Mailbox(target); ok {
+				return cn.disk.PushSeen(m, msg, key, cn.DedupWindow)
+			}
+		}
+	}
+
+	err = push(msg)
+	if err != nil {
+		return err
+	}
+
+	return cn.disk.MarkSeen(key, cn.DedupWindow)
+}
+
+// Wait for any other push of key to finish and then mark it as being
+// pushed. The returned func must be called when the push is done.
+func (cn *clusterNode) startPush(key string) func() {
+	cn.pushLock.Lock()
+
+	for {
+		wait, ok := cn.pushing[key]
+		if !ok {
+			break
+		}
+
+		cn.pushLock.Unlock()
+		<-wait
+		cn.pushLock.Lock()
+	}
+
+	ch := make(chan struct{})
+	cn.pushing[key] = ch
+
+	cn.pushLock.Unlock()
+
+	return func() {
+		cn.pushLock.Lock()
+		delete(cn.pushing, key)
+		cn.pushLock.Unlock()
+
+		close(ch)
+	}
+}
+
+// Apply a change to the router and, if it took, record it on disk
+// with save.
+func (cn *clusterNode) change(apply, save func() error) error {
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+
+	err := apply()
+	if err != nil {
+		return err
+	}
+
+	return save()
+}
+
+// Add an exchange, or bindings to one that exists, and record it
+// on disk.
+func (cn *clusterNode) DeclareExchange(ex *vega.Exchange) error {
+	return cn.change(func() error {
+		return cn.router.DeclareExchange(ex)
+	}, cn.saveExchange(ex.Name))
+}
+
+func (cn *clusterNode) DeleteExchange(name string) error {
+	return cn.change(func() error {
+		return cn.router.DeleteExchange(name)
+	}, cn.saveExchange(name))
+}
+
+func (cn *clusterNode) Bind(name string, b *vega.Binding) error {
+	return cn.change(func() error {
+		return cn.router.Bind(name, b)
+	}, cn.saveExchange(name))
+}
+
+func (cn *clusterNode) Unbind(name string, b *vega.Binding) error {
+	return cn.change(func() error {
+		return cn.router.Unbind(name, b)
+	}, cn.saveExchange(name))
+}
+
+func (cn *clusterNode) Exchanges() []*vega.Exchange {
+	return cn.router.Exchanges()
+}
+
+// Return a save for change that writes the named exchange as the
+// router has it to disk, removing it if it's gone.
+func (cn *clusterNode) saveExchange(name string) func() error {
+	return func() error {
+		ex, ok := cn.router.Exchange(name)
+		if !ok {
+			return cn.disk.RemoveExchange(name)
+		}
+
+		return cn.disk.SaveExchange(ex)
+	}
+}
+
+// Add an alias, or change the targets of one, and record it on disk.
+func (cn *clusterNode) SetAlias(alias *vega.Alias) error {
+	return cn.change(func() error {
+		return cn.router.SetAlias(alias)
+	}, func() error {
+		return cn.disk.SaveAlias(alias)
+	})
+}
+
+func (cn *clusterNode) RemoveAlias(name string) error {
+	return cn.change(func() error {
+		return cn.router.RemoveAlias(name)
+	}, func() error {
+		return cn.disk.RemoveAlias(name)
+	})
+}
+
+func (cn *clusterNode) Aliases() []*vega.Alias {
+	return cn.router.Aliases()
+}
+
+// Bring back the exchanges, aliases and type routes recorded on disk,
+// such as after a restart. Exchanges come first so that aliases can
+// point at them.
+func (cn *clusterNode) restoreRouting() error {
+	exs, err := cn.disk.Exchanges()
+	if err != nil {
+		return err
+	}
+
+	aliases, err := cn.disk.Aliases()
+	if err != nil {
+		return err
+	}
+
+	routes, err := cn.disk.TypeRoutes()
+	if err != nil {
+		return err
+	}
+
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+
+	for _, ex := range exs {
+		err = cn.router.DeclareExchange(ex)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, alias := range aliases {
+		err = cn.router.SetAlias(alias)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, route := range routes {
+		err = cn.router.SetTypeRoute(route)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Route the messages pushed to a mailbox by type and record the route
+// on disk.
+func (cn *clusterNode) SetTypeRoute(route *vega.TypeRoute) error {
+	return cn.change(func() error {
+		return cn.router.SetTypeRoute(route)
+	}, func() error {
+		return cn.disk.SaveTypeRoute(route)
+	})
+}
+
+func (cn *clusterNode) RemoveTypeRoute(mailbox string) error {
+	return cn.change(func() error {
+		return cn.router.RemoveTypeRoute(mailbox)
+	}, func() error {
+		return cn.disk.RemoveTypeRoute(mailbox)
+	})
+}
+
+func (cn *clusterNode) TypeRoutes() []*vega.TypeRoute {
+	return cn.router.TypeRoutes()
+}
+
+var ENotLocal = errors.New("mailbox is not local to this node")
+
+// Ack and push the messages in tx atomically. All the mailboxes
+// involved must be declared on this node. Pushes are routed by type
+// and deduplicated like any other, with the ids recorded in the same
+// bolt transaction as the messages. Aliases and exchanges aren't local
+// mailboxes, so they can't be part of a transaction.
+func (cn *clusterNode) Transact(tx *vega.Transaction) error {
+	for _, ack := range tx.Acks {
+		if !cn.local.Has(ack.Name) {
+			return errors.Subject(ENotLocal, ack.Name)
+		}
+	}
+
+	type txPush struct {
+		target string
+		msg    *vega.Message
+		key    string
+	}
+
+	var (
+		pushes []txPush
+		keys   []string
+		dups   = make(map[string]bool)
+	)
+
+	for _, push := range tx.Pushes {
+		if push.Message == nil {
+			return errors.Subject(vega.EMalformedFrame, "push requires a message")
+		}
+
+		target, pusher, ok := cn.router.Route(push.Name, push.Message)
+		if !ok || pusher != vega.Pusher(cn.local) || !cn.local.Has(target) {
+			return errors.Subject(ENotLocal, push.Name)
+		}
+
+		var key string
+
+		if id := push.Message.DedupId(); cn.DedupWindow > 0 && id != "" {
+			key = push.Name + "\x00" + id
+
+			// Only the first of a duplicate in the same transaction
+			if dups[key] {
+				continue
+			}
+
+			dups[key] = true
+			keys = append(keys, key)
+		}
+
+		pushes = append(pushes, txPush{target, push.Message, key})
+	}
+
+	// In order, so that two transactions can't wait on each other
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		done := cn.startPush(key)
+		defer done()
+	}
+
+	routed := &vega.Transaction{Acks: tx.Acks}
+
+	var record []string
+
+	for _, p := range pushes {
+		if p.key != "" {
+			seen, err := cn.disk.Seen(p.key, cn.DedupWindow)
+			if err != nil {
+				return err
+			}
+
+			if seen {
+				continue
+			}
+
+			record = append(record, p.key)
+		}
+
+		routed.Push(p.target, p.msg)
 	}
+
+	return cn.local.TransactWith(routed, func(parts []*vega.MailboxTx) error {
+		return cn.disk.TransactSeen(parts, record, cn.DedupWindow)
+	})
 }
 
+// Polling a name of this form returns the retained message this node
+// keeps for the topic after it, without removing it, so that other
+// nodes can fetch it.
+const retainedMailbox = ":retained/"
+
 func (cn *clusterNode) Poll(name string) (*vega.Delivery, error) {
+	if strings.HasPrefix(name, retainedMailbox) {
+		return cn.pollRetained(name[len(retainedMailbox):])
+	}
+
 	return cn.local.Poll(name)
 }
 
+func (cn *clusterNode) pollRetained(topic string) (*vega.Delivery, error) {
+	msg, err := cn.disk.RetainedMessage(topic)
+	if err != nil || msg == nil {
+		return nil, err
+	}
+
+	nothing := func() error { return nil }
+
+	return &vega.Delivery{Message: msg, Ack: nothing, Nack: nothing}, nil
+}
+
 func (cn *clusterNode) LongPoll(name string, til time.Duration) (*vega.Delivery, error) {
 	return cn.local.LongPoll(name, til)
 }
@@ -1,6 +1,7 @@
 package cluster
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"sync"
@@ -9,6 +10,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/vektra/errors"
 	"github.com/vektra/vega"
 )
 
@@ -363,3 +365,1005 @@ func TestClusterPubSubBetweenNodes(t *testing.T) {
 
 	assert.True(t, msg.Equal(ret.Message), "message did not route properly")
 }
+
+func TestClusterDedup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	cn, err := NewMemClusterNode(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	defer cn.Close()
+
+	cn.DedupWindow = time.Minute
+
+	// A failed push isn't remembered
+	payload := vega.Msg([]byte("hello"))
+	payload.SetDedupId("1")
+
+	err = cn.Push("a", payload)
+	assert.Error(t, err)
+
+	err = cn.Declare("a")
+	if err != nil {
+		panic(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		payload := vega.Msg([]byte("hello"))
+		payload.SetDedupId("1")
+
+		err = cn.Push("a", payload)
+		require.NoError(t, err)
+	}
+
+	// Messages without an id are never dropped
+	cn.Push("a", vega.Msg([]byte("again")))
+	cn.Push("a", vega.Msg([]byte("again")))
+
+	stats := cn.disk.Mailbox("a").Stats()
+	assert.Equal(t, 3, stats.Size)
+}
+
+type blockingPusher struct {
+	entered chan struct{}
+	release chan error
+}
+
+func (bp *blockingPusher) Push(name string, msg *vega.Message) error {
+	bp.entered <- struct{}{}
+	return <-bp.release
+}
+
+func TestClusterDedupWaitsForConcurrentPush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	cn, err := NewMemClusterNode(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	defer cn.Close()
+
+	cn.DedupWindow = time.Minute
+
+	bp := &blockingPusher{make(chan struct{}), make(chan error)}
+	cn.router.Add("a", bp)
+
+	push := func() <-chan error {
+		errs := make(chan error, 1)
+
+		go func() {
+			payload := vega.Msg([]byte("hello"))
+			payload.SetDedupId("1")
+			errs <- cn.Push("a", payload)
+		}()
+
+		return errs
+	}
+
+	first := push()
+	<-bp.entered
+
+	second := push()
+
+	select {
+	case <-bp.entered:
+		t.Fatal("second push wasn't held back")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The first push fails, so the second one goes through
+	bp.release <- errors.New("down")
+	assert.Error(t, <-first)
+
+	<-bp.entered
+	bp.release <- nil
+	require.NoError(t, <-second)
+
+	// and later ones are duplicates
+	payload := vega.Msg([]byte("hello"))
+	payload.SetDedupId("1")
+
+	require.NoError(t, cn.Push("a", payload))
+}
+
+func TestClusterTransactRequiresLocalMailboxes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	cn, err := NewMemClusterNode(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	defer cn.Close()
+
+	cn.Declare("a")
+	cn.AddRoute("b", vega.NewMemRegistry())
+
+	var tx vega.Transaction
+	tx.Push("a", vega.Msg([]byte("hello")))
+	tx.Push("b", vega.Msg([]byte("hello")))
+
+	err = cn.Transact(&tx)
+	assert.True(t, errors.Equal(err, ENotLocal))
+
+	assert.Equal(t, 0, cn.disk.Mailbox("a").Stats().Size)
+
+	tx = vega.Transaction{}
+	tx.Push("a", vega.Msg([]byte("hello")))
+
+	err = cn.Transact(&tx)
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, cn.disk.Mailbox("a").Stats().Size)
+}
+
+func TestClusterTransactRoutesLikePush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	cn, err := NewMemClusterNode(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	defer cn.Close()
+
+	cn.DedupWindow = time.Minute
+
+	cn.Declare("a")
+	cn.Declare(vega.TypeMailbox("a", "created"))
+
+	require.NoError(t, cn.SetTypeRoute(&vega.TypeRoute{Mailbox: "a"}))
+	require.NoError(t, cn.SetAlias(&vega.Alias{Name: "x", Targets: []string{"a"}}))
+
+	for i := 0; i < 2; i++ {
+		msg := vega.Msg([]byte("hello"))
+		msg.Type = "created"
+		msg.SetDedupId("1")
+
+		var tx vega.Transaction
+		tx.Push("a", msg)
+
+		require.NoError(t, cn.Transact(&tx))
+	}
+
+	assert.Equal(t, 0, cn.disk.Mailbox("a").Stats().Size)
+	assert.Equal(t, 1, cn.disk.Mailbox(vega.TypeMailbox("a", "created")).Stats().Size)
+
+	// A plain push of the same id is a duplicate too
+	msg := vega.Msg([]byte("hello"))
+	msg.Type = "created"
+	msg.SetDedupId("1")
+
+	require.NoError(t, cn.Push("a", msg))
+	assert.Equal(t, 1, cn.disk.Mailbox(vega.TypeMailbox("a", "created")).Stats().Size)
+
+	var tx vega.Transaction
+	tx.Push("x", vega.Msg([]byte("hello")))
+
+	err = cn.Transact(&tx)
+	assert.True(t, errors.Equal(err, ENotLocal))
+}
+
+func TestClusterRetainedMessages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	cn, err := NewMemClusterNode(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	retained := &vega.Message{CorrelationId: "config/a/current", Body: []byte("v1")}
+	retained.SetRetained()
+
+	err = cn.Push(":publish", retained)
+	require.NoError(t, err)
+
+	// Not retained, so with no subscribers it goes nowhere
+	err = cn.Push(":publish", &vega.Message{CorrelationId: "config/b/current", Body: []byte("v1")})
+	assert.Equal(t, vega.ENoMailbox, err)
+
+	cn.Close()
+
+	// Retained messages survive a restart
+	cn, err = NewMemClusterNode(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	defer cn.Close()
+
+	cn.Declare("a")
+
+	err = cn.Push(":subscribe", &vega.Message{ReplyTo: "a", CorrelationId: "config/+/current"})
+	require.NoError(t, err)
+
+	msg, err := cn.disk.Mailbox("a").Poll()
+	require.NoError(t, err)
+	require.NotNil(t, msg)
+
+	assert.Equal(t, []byte("v1"), msg.Body)
+	assert.Equal(t, "config/a/current", msg.CorrelationId)
+
+	msg, err = cn.disk.Mailbox("a").Poll()
+	require.NoError(t, err)
+	assert.Nil(t, msg)
+
+	// Clear it
+	clear := &vega.Message{CorrelationId: "config/a/current"}
+	clear.SetRetained()
+
+	err = cn.Push(":publish", clear)
+	require.NoError(t, err)
+
+	cn.Declare("b")
+
+	err = cn.Push(":subscribe", &vega.Message{ReplyTo: "b", CorrelationId: "config/#"})
+	require.NoError(t, err)
+
+	msg, err = cn.disk.Mailbox("b").Poll()
+	require.NoError(t, err)
+	assert.Nil(t, msg)
+}
+
+func TestClusterUnsubscribe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	cn, err := NewMemClusterNode(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	defer cn.Close()
+
+	cn.Declare("a")
+	cn.Declare("b")
+
+	cn.Push(":subscribe", &vega.Message{ReplyTo: "a", CorrelationId: "foo"})
+	cn.Push(":subscribe", &vega.Message{ReplyTo: "a", CorrelationId: "bar"})
+	cn.Push(":subscribe", &vega.Message{ReplyTo: "b", CorrelationId: "foo"})
+
+	subs := cn.Subscriptions()
+	require.Equal(t, 3, len(subs))
+
+	assert.Equal(t, "foo", subs[0].Pattern)
+	assert.Equal(t, "a", subs[0].Mailbox)
+
+	err = cn.Push(":unsubscribe", &vega.Message{ReplyTo: "a", CorrelationId: "foo"})
+	require.NoError(t, err)
+
+	err = cn.Push(":publish", &vega.Message{CorrelationId: "foo", Body: []byte("hello")})
+	require.NoError(t, err)
+
+	msg, err := cn.disk.Mailbox("a").Poll()
+	require.NoError(t, err)
+	assert.Nil(t, msg)
+
+	msg, err = cn.disk.Mailbox("b").Poll()
+	require.NoError(t, err)
+	require.NotNil(t, msg)
+
+	// Abandoning a mailbox removes its subscriptions
+	err = cn.Abandon("b")
+	require.NoError(t, err)
+
+	subs = cn.Subscriptions()
+	require.Equal(t, 1, len(subs))
+
+	assert.Equal(t, "bar", subs[0].Pattern)
+	assert.Equal(t, "a", subs[0].Mailbox)
+
+	// No pattern removes all of the mailbox's subscriptions
+	err = cn.Push(":unsubscribe", &vega.Message{ReplyTo: "a"})
+	require.NoError(t, err)
+
+	assert.Equal(t, 0, len(cn.Subscriptions()))
+}
+
+func TestClusterSubscriptionsSurviveRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	cn, err := NewMemClusterNode(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	cn.Declare("a")
+
+	cn.Push(":subscribe", &vega.Message{ReplyTo: "a", CorrelationId: "foo"})
+	cn.Push(":subscribe", &vega.Message{ReplyTo: "a", CorrelationId: "bar"})
+	cn.Push(":unsubscribe", &vega.Message{ReplyTo: "a", CorrelationId: "bar"})
+
+	cn.Close()
+
+	cn, err = NewMemClusterNode(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	defer cn.Close()
+
+	cn.Declare("a")
+
+	err = cn.restoreSubscriptions()
+	require.NoError(t, err)
+
+	subs := cn.Subscriptions()
+	require.Equal(t, 1, len(subs))
+
+	assert.Equal(t, "foo", subs[0].Pattern)
+	assert.Equal(t, "a", subs[0].Mailbox)
+
+	// Subscribing again doesn't double up
+	err = cn.Push(":subscribe", &vega.Message{ReplyTo: "a", CorrelationId: "foo"})
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, len(cn.Subscriptions()))
+
+	err = cn.publishLocally(&vega.Message{CorrelationId: "foo", Body: []byte("hello")})
+	require.NoError(t, err)
+
+	msg, err := cn.disk.Mailbox("a").Poll()
+	require.NoError(t, err)
+	require.NotNil(t, msg)
+
+	assert.Equal(t, []byte("hello"), msg.Body)
+}
+
+// Publish to a node with n subscriptions, of which a few match. The
+// matching mailboxes are in memory so that the matching dominates.
+func benchmarkClusterPublishFanout(b *testing.B, n int) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	cn, err := NewMemClusterNode(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	defer cn.Close()
+
+	reg := vega.NewMemRegistry()
+
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("m%d", i)
+
+		reg.Declare(name)
+		cn.AddRoute(name, reg)
+
+		err = cn.Push(":subscribe", &vega.Message{
+			ReplyTo:       name,
+			CorrelationId: fmt.Sprintf("sensor/%d/+", i%(n/4+1)),
+		})
+
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	msg := &vega.Message{CorrelationId: "sensor/7/temp", Body: []byte("21")}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		cn.publishLocally(msg)
+	}
+}
+
+func BenchmarkClusterPublishFanout1000(b *testing.B)  { benchmarkClusterPublishFanout(b, 1000) }
+func BenchmarkClusterPublishFanout10000(b *testing.B) { benchmarkClusterPublishFanout(b, 10000) }
+
+func TestClusterFilteredSubscriptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	cn, err := NewMemClusterNode(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	defer cn.Close()
+
+	cn.Declare("a")
+
+	filter := &vega.SubscriptionFilter{Type: "refund"}
+
+	err = cn.Push(":subscribe", vega.SubscribeMessage("a", "order/#", filter))
+	require.NoError(t, err)
+
+	err = cn.Push(":subscribe", vega.SubscribeMessage("a", "order/#/x", nil))
+	assert.Error(t, err)
+
+	for _, typ := range []string{"purchase", "refund"} {
+		err = cn.publishLocally(&vega.Message{CorrelationId: "order/1", Type: typ, Body: []byte(typ)})
+		require.NoError(t, err)
+	}
+
+	// # matches the parent level too
+	err = cn.publishLocally(&vega.Message{CorrelationId: "order", Type: "refund", Body: []byte("parent")})
+	require.NoError(t, err)
+
+	for _, body := range []string{"refund", "parent"} {
+		msg, err := cn.disk.Mailbox("a").Poll()
+		require.NoError(t, err)
+		require.NotNil(t, msg)
+
+		assert.Equal(t, []byte(body), msg.Body)
+	}
+
+	msg, err := cn.disk.Mailbox("a").Poll()
+	require.NoError(t, err)
+	assert.Nil(t, msg)
+
+	// Subscribing again replaces the filter, and it survives a restart
+	err = cn.Push(":subscribe", vega.SubscribeMessage("a", "order/#", &vega.SubscriptionFilter{Type: "purchase"}))
+	require.NoError(t, err)
+
+	subs := cn.Subscriptions()
+	require.Equal(t, 1, len(subs))
+
+	assert.Equal(t, "purchase", subs[0].Filter.Type)
+
+	cn.Close()
+
+	cn, err = NewMemClusterNode(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	defer cn.Close()
+
+	err = cn.restoreSubscriptions()
+	require.NoError(t, err)
+
+	subs = cn.Subscriptions()
+	require.Equal(t, 1, len(subs))
+
+	assert.Equal(t, "purchase", subs[0].Filter.Type)
+}
+
+func TestClusterSharedSubscriptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	cn, err := NewMemClusterNode(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	defer cn.Close()
+
+	cn.Declare("a")
+	cn.Declare("b")
+	cn.Declare("all")
+
+	// A member whose mailbox is elsewhere, reached through the router
+	remote := vega.NewMemRegistry()
+	remote.Declare("c")
+	cn.AddRoute("c", remote)
+
+	pattern := vega.SharedPattern("workers", "order/#")
+
+	for _, name := range []string{"a", "b", "c"} {
+		err = cn.Push(":subscribe", vega.SubscribeMessage(name, pattern, nil))
+		require.NoError(t, err)
+	}
+
+	err = cn.Push(":subscribe", vega.SubscribeMessage("all", "order/#", nil))
+	require.NoError(t, err)
+
+	for i := 0; i < 6; i++ {
+		err = cn.publishLocally(&vega.Message{CorrelationId: "order/1", Body: []byte("x")})
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, 2, cn.disk.Mailbox("a").Stats().Size)
+	assert.Equal(t, 2, cn.disk.Mailbox("b").Stats().Size)
+	assert.Equal(t, 6, cn.disk.Mailbox("all").Stats().Size)
+
+	stats, err := remote.Poll("c")
+	require.NoError(t, err)
+	require.NotNil(t, stats)
+
+	// A member that's gone is skipped over
+	cn.local.Abandon("b")
+	cn.router.Remove("b")
+
+	for i := 0; i < 3; i++ {
+		err = cn.publishLocally(&vega.Message{CorrelationId: "order/1", Body: []byte("x")})
+		require.NoError(t, err)
+	}
+
+	a := cn.disk.Mailbox("a").Stats().Size
+
+	var c int
+	for {
+		del, _ := remote.Poll("c")
+		if del == nil {
+			break
+		}
+		c++
+	}
+
+	assert.Equal(t, 2+1+3, a+c)
+
+	// Leaving the group
+	err = cn.Push(":unsubscribe", &vega.Message{ReplyTo: "a", CorrelationId: pattern})
+	require.NoError(t, err)
+
+	err = cn.Push(":unsubscribe", &vega.Message{ReplyTo: "b"})
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		err = cn.publishLocally(&vega.Message{CorrelationId: "order/1", Body: []byte("x")})
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, a, cn.disk.Mailbox("a").Stats().Size)
+
+	for i := 0; i < 2; i++ {
+		del, err := remote.Poll("c")
+		require.NoError(t, err)
+		require.NotNil(t, del)
+	}
+}
+
+func TestClusterFeatureClientSubscribe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	cn, err := NewMemClusterNode(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	defer cn.Close()
+
+	serv, err := vega.NewService(cPort, cn)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := vega.Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	sub, err := fc.Subscribe("order/+")
+	require.NoError(t, err)
+
+	err = fc.Publish("order/1", vega.Msg("hello"))
+	require.NoError(t, err)
+
+	select {
+	case del := <-sub.Channel:
+		assert.Equal(t, []byte("hello"), del.Message.Body)
+		assert.Equal(t, "order/1", del.Message.CorrelationId)
+		del.Ack()
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscriber didn't get the message")
+	}
+
+	err = sub.Close()
+	require.NoError(t, err)
+
+	assert.Empty(t, cn.Subscriptions())
+
+	err = fc.Push(sub.Mailbox, vega.Msg("test"))
+	assert.Error(t, err, "mailbox was not abandoned")
+
+	_, err = fc.Subscribe("order/#/x")
+	assert.True(t, errors.Equal(vega.ESubscriptionPattern, err))
+}
+
+func TestClusterExchanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	cn, err := NewMemClusterNode(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	serv, err := vega.NewService(cPort, cn)
+	if err != nil {
+		panic(err)
+	}
+
+	go serv.Accept()
+
+	client, err := vega.NewClient(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	require.NoError(t, client.Declare("a"))
+	require.NoError(t, client.Declare("b"))
+
+	err = client.DeclareExchange(&vega.Exchange{Name: "orders", Type: vega.ExchangeDirect})
+	require.NoError(t, err)
+
+	require.NoError(t, client.Bind("orders", &vega.Binding{Mailbox: "a", Key: "new"}))
+	require.NoError(t, client.Bind("orders", &vega.Binding{Mailbox: "b", Key: "paid"}))
+
+	err = client.Bind("missing", &vega.Binding{Mailbox: "a"})
+	assert.True(t, errors.Equal(vega.EUnknownExchange, err))
+
+	err = client.Declare("orders")
+	assert.Error(t, err, "mailbox took the exchange's name")
+
+	exs, err := client.Exchanges()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(exs))
+
+	assert.Equal(t, "orders", exs[0].Name)
+	assert.Equal(t, 2, len(exs[0].Bindings))
+
+	err = client.Push("orders", &vega.Message{CorrelationId: "new", Body: []byte("hello")})
+	require.NoError(t, err)
+
+	del, err := client.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	assert.Equal(t, []byte("hello"), del.Message.Body)
+	del.Ack()
+
+	require.NoError(t, client.Unbind("orders", &vega.Binding{Mailbox: "b", Key: "paid"}))
+
+	client.Close()
+	serv.Close()
+	cn.Close()
+
+	cn, err = NewMemClusterNode(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	defer cn.Close()
+
+	cn.Declare("a")
+	cn.Declare("b")
+
+	err = cn.restoreRouting()
+	require.NoError(t, err)
+
+	exs = cn.Exchanges()
+	require.Equal(t, 1, len(exs))
+
+	assert.Equal(t, []*vega.Binding{{Mailbox: "a", Key: "new"}}, exs[0].Bindings)
+
+	err = cn.Push("orders", &vega.Message{CorrelationId: "new", Body: []byte("again")})
+	require.NoError(t, err)
+
+	msg, err := cn.disk.Mailbox("a").Poll()
+	require.NoError(t, err)
+	require.NotNil(t, msg)
+
+	assert.Equal(t, []byte("again"), msg.Body)
+
+	require.NoError(t, cn.DeleteExchange("orders"))
+
+	remaining, err := cn.disk.Exchanges()
+	require.NoError(t, err)
+	assert.Empty(t, remaining)
+}
+
+func TestClusterAliases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	cn, err := NewMemClusterNode(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	serv, err := vega.NewService(cPort, cn)
+	if err != nil {
+		panic(err)
+	}
+
+	go serv.Accept()
+
+	client, err := vega.NewClient(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	require.NoError(t, client.Declare("users"))
+
+	err = client.SetAlias(&vega.Alias{Name: "accounts", Targets: []string{"users"}})
+	require.NoError(t, err)
+
+	err = client.SetAlias(&vega.Alias{Name: "users", Targets: []string{"accounts"}})
+	assert.True(t, errors.Equal(vega.EInvalidAlias, err))
+
+	err = client.SetAlias(&vega.Alias{Name: "people", Targets: []string{"accounts"}})
+	require.NoError(t, err)
+
+	err = client.SetAlias(&vega.Alias{Name: "accounts", Targets: []string{"people"}})
+	assert.True(t, errors.Equal(vega.EAliasLoop, err))
+
+	err = client.Declare("accounts")
+	assert.Error(t, err, "mailbox took the alias's name")
+
+	aliases, err := client.Aliases()
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(aliases))
+
+	require.NoError(t, client.Push("people", vega.Msg("hello")))
+
+	del, err := client.Poll("users")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	assert.Equal(t, []byte("hello"), del.Message.Body)
+	del.Ack()
+
+	require.NoError(t, client.RemoveAlias("people"))
+
+	err = client.RemoveAlias("people")
+	assert.True(t, errors.Equal(vega.EUnknownAlias, err))
+
+	client.Close()
+	serv.Close()
+	cn.Close()
+
+	cn, err = NewMemClusterNode(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	defer cn.Close()
+
+	cn.Declare("users")
+
+	err = cn.restoreRouting()
+	require.NoError(t, err)
+
+	aliases = cn.Aliases()
+	require.Equal(t, 1, len(aliases))
+
+	assert.Equal(t, "accounts", aliases[0].Name)
+
+	err = cn.Push("accounts", vega.Msg("again"))
+	require.NoError(t, err)
+
+	msg, err := cn.disk.Mailbox("users").Poll()
+	require.NoError(t, err)
+	require.NotNil(t, msg)
+
+	assert.Equal(t, []byte("again"), msg.Body)
+}
+
+func TestClusterPublishDeliversOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	cn, err := NewMemClusterNode(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	defer cn.Close()
+
+	cn.Declare("a")
+
+	err = cn.Push(":subscribe", &vega.Message{ReplyTo: "a", CorrelationId: "foo"})
+	require.NoError(t, err)
+
+	err = cn.Push(":publish", &vega.Message{CorrelationId: "foo", Body: []byte("hello")})
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, cn.disk.Mailbox("a").Stats().Size)
+}
+
+func TestClusterRefusesLoops(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	cn, err := NewMemClusterNode(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	defer cn.Close()
+
+	cn.id = "a:8476"
+	cn.MaxHops = 2
+
+	cn.Declare("a")
+
+	msg := vega.Msg("hello").Forwarded("b:8476")
+
+	require.NoError(t, cn.Push("a", msg))
+
+	// It's been through here before
+	err = cn.Push("a", msg.Forwarded("a:8476").Forwarded("c:8476"))
+	assert.True(t, errors.Equal(ENodeLoop, err))
+
+	err = cn.Push("a", msg.Forwarded("c:8476").Forwarded("d:8476"))
+	assert.True(t, errors.Equal(ETooManyHops, err))
+
+	assert.Equal(t, 1, cn.disk.Mailbox("a").Stats().Size)
+
+	// A publish from another node isn't passed on again
+	remote := vega.NewMemRegistry()
+	remote.Declare(":publish")
+	cn.AddRoute(":publish", remote)
+
+	err = cn.Push(":publish", vega.Msg("from b").Forwarded("b:8476"))
+	require.NoError(t, err)
+
+	del, err := remote.Poll(":publish")
+	require.NoError(t, err)
+	assert.Nil(t, del)
+
+	err = cn.Push(":publish", vega.Msg("from here"))
+	require.NoError(t, err)
+
+	del, err = remote.Poll(":publish")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	assert.Equal(t, []byte("from here"), del.Message.Body)
+}
+
+func TestClusterTypeRoutes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	cn, err := NewMemClusterNode(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	serv, err := vega.NewService(cPort, cn)
+	if err != nil {
+		panic(err)
+	}
+
+	go serv.Accept()
+
+	client, err := vega.NewClient(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	require.NoError(t, client.Declare("billing"))
+	require.NoError(t, client.Declare("billing.invoice.created"))
+	require.NoError(t, client.Declare("billing.other"))
+
+	err = client.SetTypeRoute(&vega.TypeRoute{Mailbox: "billing", Fallback: "billing.other"})
+	require.NoError(t, err)
+
+	routes, err := client.TypeRoutes()
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(routes))
+
+	msg := vega.Msg("hello")
+	msg.Type = "invoice.created"
+
+	require.NoError(t, client.Push("billing", msg))
+
+	del, err := client.Poll("billing.invoice.created")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	assert.Equal(t, []byte("hello"), del.Message.Body)
+	del.Ack()
+
+	err = client.RemoveTypeRoute("accounts")
+	assert.True(t, errors.Equal(vega.EUnknownTypeRoute, err))
+
+	client.Close()
+	serv.Close()
+	cn.Close()
+
+	cn, err = NewMemClusterNode(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	defer cn.Close()
+
+	cn.Declare("billing")
+	cn.Declare("billing.invoice.created")
+	cn.Declare("billing.other")
+
+	err = cn.restoreRouting()
+	require.NoError(t, err)
+
+	msg = vega.Msg("again")
+	msg.Type = "invoice.paid"
+
+	err = cn.Push("billing", msg)
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, cn.disk.Mailbox("billing.other").Stats().Size)
+	assert.Equal(t, 0, cn.disk.Mailbox("billing").Stats().Size)
+
+	require.NoError(t, cn.RemoveTypeRoute("billing"))
+
+	remaining, err := cn.disk.TypeRoutes()
+	require.NoError(t, err)
+	assert.Empty(t, remaining)
+}
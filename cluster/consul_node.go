@@ -2,8 +2,12 @@ package cluster
 
 import (
 	"fmt"
+	"sort"
+	"time"
 
+	"github.com/vektra/errors"
 	"github.com/vektra/vega"
+	"github.com/vektra/vega/disk"
 )
 
 type ConsulClusterNode struct {
@@ -25,8 +29,31 @@ type ConsulNodeConfig struct {
 	DataPath      string
 	ConsulToken   string
 	RoutingPrefix string
+
+	// See clusterNode.DedupWindow
+	DedupWindow time.Duration
+
+	// See clusterNode.MaxHops. Defaults to DefaultMaxHops, a negative
+	// value turns the limit off.
+	MaxHops int
+
+	// Shared by the nodes of the cluster so that they trust the hops
+	// and node path of the messages they forward to each other. See
+	// vega.Service.NodeSecret. Required, as nodes that don't trust each
+	// other would send publishes back and forth.
+	NodeSecret string
+
+	// The exclusive consumer locks the node's service checks. Share
+	// these with the other services serving the node so that a lock
+	// taken through any of them is honored by all. Nil means the
+	// service keeps its own.
+	Locks *vega.ConsumerLocks
 }
 
+const DefaultMaxHops = 16
+
+var ENoNodeSecret = errors.New("cluster nodes require a node secret")
+
 func (cn *ConsulNodeConfig) Normalize() error {
 	if cn.ListenPort == 0 {
 		cn.ListenPort = vega.DefaultPort
@@ -49,6 +76,10 @@ func (cn *ConsulNodeConfig) Normalize() error {
 		cn.RoutingPrefix = DefaultRoutingPrefix
 	}
 
+	if cn.MaxHops == 0 {
+		cn.MaxHops = DefaultMaxHops
+	}
+
 	return nil
 }
 
@@ -70,6 +101,10 @@ func NewConsulClusterNode(config *ConsulNodeConfig) (*ConsulClusterNode, error)
 		return nil, err
 	}
 
+	if config.NodeSecret == "" {
+		return nil, ENoNodeSecret
+	}
+
 	consul := NewConsulClient(config.ConsulToken)
 
 	ct, err := NewConsulRoutingTable(config.RoutingPrefix, config.AdvertiseID(), consul)
@@ -77,17 +112,32 @@ func NewConsulClusterNode(config *ConsulNodeConfig) (*ConsulClusterNode, error)
 		return nil, err
 	}
 
+	ct.nodeSecret = config.NodeSecret
+
 	cn, err := NewClusterNode(config.DataPath, vega.NewRouter(ct))
 	if err != nil {
 		return nil, err
 	}
 
+	cn.DedupWindow = config.DedupWindow
+	cn.MaxHops = config.MaxHops
+	cn.id = config.AdvertiseID()
+	cn.interest = ct
+	cn.retained = &consulRetained{cn.disk, ct}
+
 	serv, err := vega.NewService(config.ListenAddr(), cn)
 	if err != nil {
 		cn.Close()
 		return nil, err
 	}
 
+	serv.NodeId = config.AdvertiseID()
+	serv.NodeSecret = config.NodeSecret
+
+	if config.Locks != nil {
+		serv.Locks = config.Locks
+	}
+
 	ccn := &ConsulClusterNode{
 		clusterNode: cn,
 		Config:      config,
@@ -99,9 +149,81 @@ func NewConsulClusterNode(config *ConsulNodeConfig) (*ConsulClusterNode, error)
 		ccn.Declare(name)
 	}
 
+	err = cn.restoreSubscriptions()
+	if err == nil {
+		err = cn.restoreRouting()
+	}
+
+	if err != nil {
+		serv.Close()
+		cn.Close()
+		return nil, err
+	}
+
 	return ccn, nil
 }
 
+// Keeps retained messages on the disk of the node they're published
+// on. Only which node has each is kept in consul, so that the other
+// nodes can fetch them from it.
+type consulRetained struct {
+	disk  *disk.Storage
+	table *consulRoutingTable
+}
+
+func (cr *consulRetained) Retain(topic string, msg *vega.Message) error {
+	err := cr.disk.Retain(topic, msg)
+	if err != nil {
+		return err
+	}
+
+	return cr.table.PointRetained(topic, len(msg.Body) > 0)
+}
+
+// Return the retained messages for the topics sub matches, from
+// whichever node keeps them. Those on nodes that can't be reached
+// are left out rather than failing the subscribe.
+func (cr *consulRetained) Retained(sub *vega.Subscription) ([]*vega.Message, error) {
+	owners := cr.table.RetainedOwners(sub)
+
+	var topics []string
+
+	for topic := range owners {
+		topics = append(topics, topic)
+	}
+
+	sort.Strings(topics)
+
+	var msgs []*vega.Message
+
+	for _, topic := range topics {
+		owner := owners[topic]
+
+		var (
+			msg *vega.Message
+			err error
+		)
+
+		if owner == string(cr.table.selfId) {
+			msg, err = cr.disk.RetainedMessage(topic)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			msg, err = cr.table.FetchRetained(owner, topic)
+			if err != nil {
+				continue
+			}
+		}
+
+		if msg != nil {
+			msgs = append(msgs, msg)
+		}
+	}
+
+	return msgs, nil
+}
+
 func (cn *ConsulClusterNode) Cleanup() error {
 	return cn.routes.Cleanup()
 }
@@ -110,6 +232,12 @@ func (cn *ConsulClusterNode) Accept() error {
 	return cn.service.Accept()
 }
 
+// Drain the node's service, giving clients up to grace to finish
+// with the messages they hold. See vega.Service.Drain.
+func (cn *ConsulClusterNode) Drain(grace time.Duration) error {
+	return cn.service.Drain(grace)
+}
+
 func (cn *ConsulClusterNode) Close() error {
 	cn.clusterNode.Close()
 	return cn.service.Close()
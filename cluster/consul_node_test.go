@@ -8,6 +8,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/vektra/errors"
 	"github.com/vektra/vega"
 )
 
@@ -27,6 +28,7 @@ func TestConsulNodeConfigDefaults(t *testing.T) {
 
 	assert.Equal(t, cfg.AdvertiseAddr, ip.String())
 	assert.Equal(t, cfg.DataPath, DefaultPath)
+	assert.Equal(t, cfg.MaxHops, DefaultMaxHops)
 }
 
 func TestConsulNode(t *testing.T) {
@@ -41,7 +43,8 @@ func TestConsulNode(t *testing.T) {
 		&ConsulNodeConfig{
 			AdvertiseAddr: "127.0.0.1",
 			ListenPort:    8899,
-			DataPath:      dir})
+			DataPath:      dir,
+			NodeSecret:    "sekret"})
 
 	if err != nil {
 		panic(err)
@@ -61,7 +64,8 @@ func TestConsulNode(t *testing.T) {
 		&ConsulNodeConfig{
 			AdvertiseAddr: "127.0.0.1",
 			ListenPort:    9900,
-			DataPath:      dir2})
+			DataPath:      dir2,
+			NodeSecret:    "sekret"})
 
 	if err != nil {
 		panic(err)
@@ -102,7 +106,8 @@ func TestConsulNodeRedeclaresOnStart(t *testing.T) {
 		&ConsulNodeConfig{
 			AdvertiseAddr: "127.0.0.1",
 			ListenPort:    8899,
-			DataPath:      dir})
+			DataPath:      dir,
+			NodeSecret:    "sekret"})
 
 	if err != nil {
 		panic(err)
@@ -134,7 +139,8 @@ func TestConsulNodeRedeclaresOnStart(t *testing.T) {
 		&ConsulNodeConfig{
 			AdvertiseAddr: "127.0.0.1",
 			ListenPort:    8899,
-			DataPath:      dir})
+			DataPath:      dir,
+			NodeSecret:    "sekret"})
 
 	if err != nil {
 		panic(err)
@@ -161,7 +167,8 @@ func TestConsulNodePubSubBetweenNodes(t *testing.T) {
 		&ConsulNodeConfig{
 			AdvertiseAddr: "127.0.0.1",
 			ListenPort:    8899,
-			DataPath:      dir})
+			DataPath:      dir,
+			NodeSecret:    "sekret"})
 
 	if err != nil {
 		panic(err)
@@ -183,7 +190,8 @@ func TestConsulNodePubSubBetweenNodes(t *testing.T) {
 		&ConsulNodeConfig{
 			AdvertiseAddr: "127.0.0.1",
 			ListenPort:    9900,
-			DataPath:      dir2})
+			DataPath:      dir2,
+			NodeSecret:    "sekret"})
 
 	if err != nil {
 		panic(err)
@@ -218,3 +226,314 @@ func TestConsulNodePubSubBetweenNodes(t *testing.T) {
 
 	assert.True(t, msg.Equal(ret.Message), "message did not route properly")
 }
+
+func TestConsulNodeRetainedBetweenNodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	cn1, err := NewConsulClusterNode(
+		&ConsulNodeConfig{
+			AdvertiseAddr: "127.0.0.1",
+			ListenPort:    8899,
+			DataPath:      dir,
+			NodeSecret:    "sekret"})
+
+	if err != nil {
+		panic(err)
+	}
+
+	defer cn1.Cleanup()
+
+	defer cn1.Close()
+	go cn1.Accept()
+
+	dir2, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir2)
+
+	cn2, err := NewConsulClusterNode(
+		&ConsulNodeConfig{
+			AdvertiseAddr: "127.0.0.1",
+			ListenPort:    9900,
+			DataPath:      dir2,
+			NodeSecret:    "sekret"})
+
+	if err != nil {
+		panic(err)
+	}
+
+	defer cn2.Cleanup()
+
+	defer cn2.Close()
+	go cn2.Accept()
+
+	// Published before anyone subscribes
+	msg := &vega.Message{CorrelationId: "retained-between", Body: []byte("kept")}
+	msg.SetRetained()
+
+	err = cn2.Push(":publish", msg)
+	require.NoError(t, err)
+
+	defer cn2.Push(":publish", &vega.Message{
+		CorrelationId: "retained-between",
+		Headers:       map[string]interface{}{vega.RetainHeader: true},
+	})
+
+	// propagation delay
+	time.Sleep(1000 * time.Millisecond)
+
+	cn1.Declare("a")
+
+	err = cn1.Push(":subscribe", &vega.Message{ReplyTo: "a", CorrelationId: "retained-between"})
+	require.NoError(t, err)
+
+	ret, err := cn1.Poll("a")
+	if err != nil {
+		panic(err)
+	}
+
+	require.NotNil(t, ret)
+
+	assert.Equal(t, msg.Body, ret.Message.Body)
+}
+
+func TestConsulNodeLargeRetainedBetweenNodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	cn1, err := NewConsulClusterNode(
+		&ConsulNodeConfig{
+			AdvertiseAddr: "127.0.0.1",
+			ListenPort:    8899,
+			DataPath:      dir,
+			NodeSecret:    "sekret"})
+
+	if err != nil {
+		panic(err)
+	}
+
+	defer cn1.Cleanup()
+
+	defer cn1.Close()
+	go cn1.Accept()
+
+	dir2, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir2)
+
+	cn2, err := NewConsulClusterNode(
+		&ConsulNodeConfig{
+			AdvertiseAddr: "127.0.0.1",
+			ListenPort:    9900,
+			DataPath:      dir2,
+			NodeSecret:    "sekret"})
+
+	if err != nil {
+		panic(err)
+	}
+
+	defer cn2.Cleanup()
+
+	defer cn2.Close()
+	go cn2.Accept()
+
+	// Larger than consul takes as a value
+	msg := &vega.Message{CorrelationId: "retained-large", Body: make([]byte, 600*1024)}
+	msg.SetRetained()
+
+	err = cn2.Push(":publish", msg)
+	require.NoError(t, err)
+
+	defer cn2.Push(":publish", &vega.Message{
+		CorrelationId: "retained-large",
+		Headers:       map[string]interface{}{vega.RetainHeader: true},
+	})
+
+	// propagation delay
+	time.Sleep(1000 * time.Millisecond)
+
+	cn1.Declare("a")
+
+	err = cn1.Push(":subscribe", &vega.Message{ReplyTo: "a", CorrelationId: "retained-large"})
+	require.NoError(t, err)
+
+	ret, err := cn1.Poll("a")
+	if err != nil {
+		panic(err)
+	}
+
+	require.NotNil(t, ret)
+
+	assert.Equal(t, msg.Body, ret.Message.Body)
+
+	// consul only knows which node has it
+	pair, _, err := cn2.routes.kv.Get(retainedName+"/retained-large", nil)
+	require.NoError(t, err)
+	require.NotNil(t, pair)
+
+	assert.Equal(t, cn2.Config.AdvertiseID(), string(pair.Value))
+}
+
+func TestConsulNodeSharedGroupBetweenNodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	cn1, err := NewConsulClusterNode(
+		&ConsulNodeConfig{
+			AdvertiseAddr: "127.0.0.1",
+			ListenPort:    8899,
+			DataPath:      dir,
+			NodeSecret:    "sekret"})
+
+	if err != nil {
+		panic(err)
+	}
+
+	defer cn1.Cleanup()
+
+	defer cn1.Close()
+	go cn1.Accept()
+
+	dir2, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir2)
+
+	cn2, err := NewConsulClusterNode(
+		&ConsulNodeConfig{
+			AdvertiseAddr: "127.0.0.1",
+			ListenPort:    9900,
+			DataPath:      dir2,
+			NodeSecret:    "sekret"})
+
+	if err != nil {
+		panic(err)
+	}
+
+	defer cn2.Cleanup()
+
+	defer cn2.Close()
+	go cn2.Accept()
+
+	pattern := vega.SharedPattern("workers", "jobs")
+
+	cn1.Declare("a")
+	cn2.Declare("b")
+
+	err = cn1.Push(":subscribe", &vega.Message{ReplyTo: "a", CorrelationId: pattern})
+	require.NoError(t, err)
+
+	err = cn2.Push(":subscribe", &vega.Message{ReplyTo: "b", CorrelationId: pattern})
+	require.NoError(t, err)
+
+	// propagation delay
+	time.Sleep(1000 * time.Millisecond)
+
+	count := func(cn *ConsulClusterNode, name string) int {
+		n := 0
+
+		for {
+			del, err := cn.Poll(name)
+			require.NoError(t, err)
+
+			if del == nil {
+				return n
+			}
+
+			n++
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		from := cn1
+		if i%2 == 1 {
+			from = cn2
+		}
+
+		err = from.Push(":publish", &vega.Message{CorrelationId: "jobs", Body: []byte("work")})
+		require.NoError(t, err)
+
+		// publishes to the other node are pushed before Push returns
+		assert.Equal(t, 1, count(cn1, "a")+count(cn2, "b"), "publish %d", i)
+	}
+}
+
+func TestConsulNodeRequiresNodeSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	_, err = NewConsulClusterNode(
+		&ConsulNodeConfig{
+			AdvertiseAddr: "127.0.0.1",
+			ListenPort:    8899,
+			DataPath:      dir})
+
+	assert.Equal(t, ENoNodeSecret, err)
+}
+
+func TestConsulNodeSharesLocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	locks := vega.NewConsumerLocks()
+
+	cn1, err := NewConsulClusterNode(
+		&ConsulNodeConfig{
+			AdvertiseAddr: "127.0.0.1",
+			ListenPort:    8899,
+			DataPath:      dir,
+			NodeSecret:    "sekret",
+			Locks:         locks})
+
+	if err != nil {
+		panic(err)
+	}
+
+	defer cn1.Cleanup()
+
+	defer cn1.Close()
+	go cn1.Accept()
+
+	cn1.Declare("a")
+
+	// Taken through another service sharing the locks
+	require.NoError(t, locks.Acquire("a", "someone", 0))
+
+	c, err := vega.NewClient("127.0.0.1:8899")
+	if err != nil {
+		panic(err)
+	}
+
+	defer c.Close()
+
+	_, err = c.Poll("a")
+	assert.True(t, errors.Equal(err, vega.EMailboxLocked), "poll got past the lock: %v", err)
+}
@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"sort"
 	"time"
 
 	"strings"
@@ -31,13 +34,29 @@ type consulRoutingTable struct {
 
 	connections map[string]*consulPusher
 
+	// Presented to the other nodes when connecting to them
+	nodeSecret string
+
 	tableLock sync.RWMutex
 	table     map[string]*hybridPusher
+
+	// The other nodes with members in each shared group, by the
+	// pattern the group subscribes with. Guarded by tableLock.
+	groups map[string][]string
+
+	// The node keeping each retained message, by topic. Guarded by
+	// tableLock.
+	retained map[string]string
 }
 
 type hybridPusher struct {
 	local  vega.Pusher
 	remote []*consulPusher
+
+	// For :publish, the patterns each remote that advertises its
+	// interest is subscribed to. Remotes that don't advertise get
+	// every publish.
+	interests map[*consulPusher][]*vega.Subscription
 }
 
 func (h *hybridPusher) Push(who string, msg *vega.Message) error {
@@ -48,6 +67,10 @@ func (h *hybridPusher) Push(who string, msg *vega.Message) error {
 	}
 
 	for _, r := range h.remote {
+		if subs, ok := h.interests[r]; ok && !interested(subs, msg.CorrelationId) {
+			continue
+		}
+
 		if err := r.Push(who, msg); err != nil {
 			return err
 		}
@@ -56,6 +79,16 @@ func (h *hybridPusher) Push(who string, msg *vega.Message) error {
 	return nil
 }
 
+func interested(subs []*vega.Subscription, topic string) bool {
+	for _, sub := range subs {
+		if sub.Match(topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (h *hybridPusher) Count() int {
 	if h.local != nil {
 		return len(h.remote) + 1
@@ -66,6 +99,15 @@ func (h *hybridPusher) Count() int {
 
 var DefaultRoutingPrefix = "mailbox-routing"
 
+// Each node's subscription patterns are kept under this name, as a
+// JSON list, so that publishes are only sent to nodes that want them.
+const interestName = ":interest"
+
+// The node that keeps the retained message of each topic is kept
+// under this name, by topic, so that every node can fetch them for its
+// new subscribers.
+const retainedName = ":retained"
+
 func NewConsulRoutingTable(prefix, id string, client *consulapi.Client) (*consulRoutingTable, error) {
 	h := sha1.New()
 	h.Write([]byte(id))
@@ -81,7 +123,9 @@ func NewConsulRoutingTable(prefix, id string, client *consulapi.Client) (*consul
 		consul: client,
 		kv:     client.KV(),
 
-		table: make(map[string]*hybridPusher),
+		table:    make(map[string]*hybridPusher),
+		groups:   make(map[string][]string),
+		retained: make(map[string]string),
 	}
 
 	go ct.updateBackground()
@@ -126,11 +170,35 @@ func (ct *consulRoutingTable) updateBackground() {
 		// them now.
 		for _, ent := range ct.table {
 			ent.remote = nil
+			ent.interests = nil
 		}
 
+		interests := make(map[string][]*vega.Subscription)
+		groups := make(map[string][]string)
+		retained := make(map[string]string)
+
 		for _, val := range values {
 			name, id := ct.extractName(val)
 
+			if name == interestName {
+				if id != ct.key {
+					interests[id] = parseInterest(val.Value)
+
+					for _, sub := range interests[id] {
+						if sub.Group != "" {
+							groups[sub.Pattern] = append(groups[sub.Pattern], id)
+						}
+					}
+				}
+
+				continue
+			}
+
+			if name == retainedName {
+				retained[id] = string(val.Value)
+				continue
+			}
+
 			if bytes.Equal(val.Value, ct.selfId) {
 				continue
 			}
@@ -146,6 +214,19 @@ func (ct *consulRoutingTable) updateBackground() {
 			ent.remote = append(ent.remote, ct.connectionTo(id, string(val.Value)))
 		}
 
+		if ent, ok := ct.table[":publish"]; ok {
+			ent.interests = make(map[*consulPusher][]*vega.Subscription)
+
+			for id, subs := range interests {
+				if cp, ok := ct.connections[id]; ok {
+					ent.interests[cp] = subs
+				}
+			}
+		}
+
+		ct.groups = groups
+		ct.retained = retained
+
 		var toRemove []string
 
 		for key, ent := range ct.table {
@@ -162,6 +243,127 @@ func (ct *consulRoutingTable) updateBackground() {
 	}
 }
 
+// Read a node's advertised patterns. A value that can't be read is
+// treated as no interest being advertised, so the node gets everything.
+func parseInterest(value []byte) []*vega.Subscription {
+	var patterns []string
+
+	if err := json.Unmarshal(value, &patterns); err != nil {
+		return nil
+	}
+
+	subs := make([]*vega.Subscription, len(patterns))
+
+	for i, pattern := range patterns {
+		subs[i] = vega.ParseSubscription(pattern)
+	}
+
+	return subs
+}
+
+// Tell the other nodes which topic patterns this node is subscribed to
+func (ct *consulRoutingTable) AdvertiseInterest(patterns []string) error {
+	if patterns == nil {
+		patterns = []string{}
+	}
+
+	data, err := json.Marshal(patterns)
+	if err != nil {
+		return err
+	}
+
+	pair := &consulapi.KVPair{
+		Key:   ct.prefix + interestName + "/" + ct.key,
+		Value: data,
+	}
+
+	_, err = ct.kv.Put(pair, &consulapi.WriteOptions{})
+	return err
+}
+
+// Indicates if this node, which has members in the shared group that
+// subscribes with pattern, is the one that hands out the group's
+// publishes. Every node picks the same owner by hashing the pattern
+// over the nodes with members, so each publish reaches one member.
+func (ct *consulRoutingTable) OwnsGroup(pattern string) bool {
+	ct.tableLock.RLock()
+	nodes := append([]string{ct.key}, ct.groups[pattern]...)
+	ct.tableLock.RUnlock()
+
+	sort.Strings(nodes)
+
+	h := fnv.New32a()
+	h.Write([]byte(pattern))
+
+	return nodes[h.Sum32()%uint32(len(nodes))] == ct.key
+}
+
+// Record that this node keeps the retained message for topic, or that
+// there's no longer one if here is false.
+func (ct *consulRoutingTable) PointRetained(topic string, here bool) error {
+	ct.tableLock.Lock()
+
+	if here {
+		ct.retained[topic] = string(ct.selfId)
+	} else {
+		delete(ct.retained, topic)
+	}
+
+	ct.tableLock.Unlock()
+
+	key := ct.prefix + retainedName + "/" + topic
+
+	if !here {
+		_, err := ct.kv.Delete(key, nil)
+		return err
+	}
+
+	pair := &consulapi.KVPair{
+		Key:   key,
+		Value: ct.selfId,
+	}
+
+	_, err := ct.kv.Put(pair, &consulapi.WriteOptions{})
+	return err
+}
+
+// Return the node that keeps the retained message of each topic sub
+// matches, by topic
+func (ct *consulRoutingTable) RetainedOwners(sub *vega.Subscription) map[string]string {
+	ct.tableLock.RLock()
+	defer ct.tableLock.RUnlock()
+
+	owners := make(map[string]string)
+
+	for topic, owner := range ct.retained {
+		if sub.Match(topic) {
+			owners[topic] = owner
+		}
+	}
+
+	return owners
+}
+
+// Fetch the retained message for topic from the node owner, which
+// keeps it. Returns nil if it no longer has one.
+func (ct *consulRoutingTable) FetchRetained(owner, topic string) (*vega.Message, error) {
+	h := sha1.New()
+	h.Write([]byte(owner))
+
+	ct.tableLock.Lock()
+	cp := ct.connectionTo(hex.EncodeToString(h.Sum(nil)), owner)
+	ct.tableLock.Unlock()
+
+	del, err := cp.Poll(retainedMailbox + topic)
+	if err != nil || del == nil {
+		return nil, err
+	}
+
+	del.Ack()
+
+	return del.Message, nil
+}
+
 func (ct *consulRoutingTable) Close() {
 	ct.done = true
 }
@@ -218,7 +420,7 @@ func (ct *consulRoutingTable) connectionTo(id, target string) *consulPusher {
 		return cp
 	}
 
-	cp := &consulPusher{nil, target}
+	cp := &consulPusher{nil, target, string(ct.selfId), ct.nodeSecret}
 
 	ct.connections[id] = cp
 
@@ -230,6 +432,12 @@ func (ct *consulRoutingTable) connectionTo(id, target string) *consulPusher {
 type consulPusher struct {
 	client vega.Storage
 	target string
+
+	// The id of this node, added to the path of the messages pushed
+	self string
+
+	// See vega.Service.NodeSecret
+	secret string
 }
 
 func (ct *consulRoutingTable) Get(name string) (vega.Pusher, bool) {
@@ -248,11 +456,13 @@ func (ct *consulRoutingTable) Cleanup() error {
 		ct.kv.Delete(key, nil)
 	}
 
+	ct.kv.Delete(ct.prefix+interestName+"/"+ct.key, nil)
+
 	return nil
 }
 
 func (cp *consulPusher) Connect() error {
-	c, err := vega.NewClient(cp.target)
+	c, err := vega.NewNodeClient(cp.target, cp.secret)
 	if err != nil {
 		return err
 	}
@@ -281,7 +491,7 @@ func (cp *consulPusher) Push(name string, msg *vega.Message) error {
 		}
 	}
 
-	return cp.client.Push(name, msg)
+	return cp.client.Push(name, msg.Forwarded(cp.self))
 }
 
 func (cp *consulPusher) Poll(name string) (*vega.Delivery, error) {
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/armon/consul-api"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/vektra/vega"
 )
@@ -87,10 +88,12 @@ func TestConsulPusher(t *testing.T) {
 		panic(err)
 	}
 
+	serv.NodeSecret = "sekret"
+
 	defer serv.Close()
 	go serv.Accept()
 
-	cp := &consulPusher{nil, cPort}
+	cp := &consulPusher{nil, cPort, "self", "sekret"}
 
 	cp.Connect()
 
@@ -105,6 +108,11 @@ func TestConsulPusher(t *testing.T) {
 	if msg == nil || !msg.Message.Equal(payload) {
 		t.Fatal("couldn't talk to the service")
 	}
+
+	assert.Equal(t, 1, msg.Message.Hops())
+	assert.Equal(t, []string{"self"}, msg.Message.NodePath())
+
+	assert.Equal(t, 0, payload.Hops(), "pushed message was changed")
 }
 
 func TestConsulRoutingTableWithMultipleDeclares(t *testing.T) {
@@ -346,3 +354,76 @@ func TestConsulRoutingTableRemove(t *testing.T) {
 		t.Fatalf("remove failed: %#v", hp.remote[0])
 	}
 }
+
+func TestConsulRoutingTablePublishesByInterest(t *testing.T) {
+	s1, err := vega.NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer s1.Close()
+	go s1.Accept()
+
+	s2, err := vega.NewMemService(cPort2)
+	if err != nil {
+		panic(err)
+	}
+
+	defer s2.Close()
+	go s2.Accept()
+
+	r1 := s1.Registry.(*vega.Registry)
+	r1.Declare(":publish")
+
+	r2 := s2.Registry.(*vega.Registry)
+	r2.Declare(":publish")
+
+	client, err := consulapi.NewClient(consulapi.DefaultConfig())
+	require.NoError(t, err)
+
+	ct1, err := NewConsulRoutingTable(testRoutingPrefix, cPort, client)
+	require.NoError(t, err)
+
+	defer ct1.Cleanup()
+
+	ct2, err := NewConsulRoutingTable(testRoutingPrefix, cPort2, client)
+	require.NoError(t, err)
+
+	defer ct2.Cleanup()
+
+	ct3, err := NewConsulRoutingTable(testRoutingPrefix, "127.0.0.1:34004", client)
+	require.NoError(t, err)
+
+	ct1.Set(":publish", vega.NewMemRegistry())
+	ct2.Set(":publish", vega.NewMemRegistry())
+
+	// ct2 doesn't advertise, so gets every publish
+	err = ct1.AdvertiseInterest([]string{"foo/#"})
+	require.NoError(t, err)
+
+	// propogation delay.
+	time.Sleep(100 * time.Millisecond)
+
+	pusher, ok := ct3.Get(":publish")
+	require.True(t, ok)
+
+	err = pusher.Push(":publish", &vega.Message{CorrelationId: "bar", Body: []byte("bar")})
+	require.NoError(t, err)
+
+	err = pusher.Push(":publish", &vega.Message{CorrelationId: "foo/x", Body: []byte("foo")})
+	require.NoError(t, err)
+
+	del, err := r1.Poll(":publish")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	assert.Equal(t, []byte("foo"), del.Message.Body)
+
+	for _, body := range []string{"bar", "foo"} {
+		del, err := r2.Poll(":publish")
+		require.NoError(t, err)
+		require.NotNil(t, del)
+
+		assert.Equal(t, []byte(body), del.Message.Body)
+	}
+}
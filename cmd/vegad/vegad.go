@@ -6,6 +6,10 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/vektra/vega"
 	"github.com/vektra/vega/cluster"
@@ -18,16 +22,46 @@ var fData = flag.String("data-dir", cluster.DefaultPath, "path to store data in"
 var fAdvertise = flag.String("advertise", "", "address to advertise vega on")
 var fRoutingPrefix = flag.String("routing-prefix", cluster.DefaultRoutingPrefix, "prefix to store the routing table under")
 var fToken = flag.String("consul-token", "", "consul acl token to use")
+var fSocket = flag.String("socket", "", "unix socket to listen on as well as the local port")
+var fHttpSocket = flag.String("http-socket", "", "unix socket to serve http on as well as the http port")
+var fSocketMode = flag.String("socket-mode", "0660", "file permissions to give the unix sockets")
+var fKeepAlive = flag.Duration("keepalive", 0, "how often to ping clients (default is yamux's)")
+var fHeartbeatTimeout = flag.Duration("heartbeat-timeout", vega.DefaultHeartbeatTimeout, "how long a client may go without a heartbeat")
+var fDedupWindow = flag.Duration("dedup-window", 0, "drop messages pushed again with the same dedup-id header within this long")
+var fNodeSecret = flag.String("node-secret", "", "secret shared by the nodes, so they trust each other's forwarded messages (required)")
+var fMaxHops = flag.Int("max-hops", cluster.DefaultMaxHops, "refuse messages forwarded between nodes more than this many times")
+var fDrainTimeout = flag.Duration("drain-timeout", 30*time.Second, "how long to wait on SIGTERM for clients to finish with their messages")
 
 func main() {
 	flag.Parse()
 
+	mode, err := strconv.ParseUint(*fSocketMode, 8, 32)
+	if err != nil {
+		log.Fatalf("invalid socket mode: %s", err)
+		os.Exit(1)
+	}
+
+	socketMode := os.FileMode(mode)
+
+	if *fNodeSecret == "" {
+		log.Fatalf("-node-secret is required so the nodes of the cluster trust each other")
+		os.Exit(1)
+	}
+
+	// So a consumer's exclusive lock holds over http, the local port
+	// and the cluster port
+	locks := vega.NewConsumerLocks()
+
 	cfg := &cluster.ConsulNodeConfig{
 		ListenPort:    *fClusterPort,
 		DataPath:      *fData,
 		AdvertiseAddr: *fAdvertise,
 		RoutingPrefix: *fRoutingPrefix,
 		ConsulToken:   *fToken,
+		DedupWindow:   *fDedupWindow,
+		MaxHops:       *fMaxHops,
+		NodeSecret:    *fNodeSecret,
+		Locks:         locks,
 	}
 
 	node, err := cluster.NewConsulClusterNode(cfg)
@@ -46,12 +80,24 @@ func main() {
 			fmt.Sprintf("127.0.0.1:%d", *fHttpPort),
 			node)
 
+		h.Locks = locks
+
 		err = h.Listen()
 		if err != nil {
 			log.Fatalf("unable to create http server: %s", err)
 			os.Exit(1)
 		}
 
+		if *fHttpSocket != "" {
+			err = h.ListenUnix(*fHttpSocket, socketMode)
+			if err != nil {
+				log.Fatalf("unable to create http socket: %s", err)
+				os.Exit(1)
+			}
+
+			go h.AcceptUnix()
+		}
+
 		h.BackgroundTimeouts()
 		go h.Accept()
 	}
@@ -63,11 +109,33 @@ func main() {
 			os.Exit(1)
 		}
 
+		// NodeSecret is left empty, so no client of the local port is
+		// ever trusted as a node.
+		local.NodeId = cfg.AdvertiseID()
+		local.Locks = locks
+		local.KeepAliveInterval = *fKeepAlive
+		local.HeartbeatTimeout = *fHeartbeatTimeout
+
+		if *fSocket != "" {
+			err = local.ListenUnix(*fSocket, socketMode)
+			if err != nil {
+				log.Fatalf("Unable to create local socket: %s", err)
+				os.Exit(1)
+			}
+
+			go local.AcceptUnix()
+		}
+
 		go local.AcceptInsecure()
 	}
 
 	fmt.Printf("! Booted vegad:\n")
 	fmt.Printf("* LocalPort: %d\n", *fPort)
+
+	if *fSocket != "" {
+		fmt.Printf("* LocalSocket: %s\n", *fSocket)
+	}
+
 	fmt.Printf("* ClusterPort: %d\n", cfg.ListenPort)
 	fmt.Printf("* DataPath: %s\n", cfg.DataPath)
 	fmt.Printf("* AdvertiseId: %s\n", cfg.AdvertiseID())
@@ -80,9 +148,12 @@ func main() {
 
 	sig := make(chan os.Signal)
 
-	signal.Notify(sig, os.Interrupt)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
 
-	<-sig
+	if <-sig == syscall.SIGTERM {
+		fmt.Printf("\nDraining for up to %s...\n", *fDrainTimeout)
+		drain(h, local, node)
+	}
 
 	fmt.Printf("\nGracefully shutting down...\n")
 
@@ -97,3 +168,33 @@ func main() {
 	node.Cleanup()
 	node.Close()
 }
+
+// Drain all the services at once so that the grace period applies
+// to the whole shutdown, not to each service in turn.
+func drain(h *vega.HTTPService, local *vega.Service, node *cluster.ConsulClusterNode) {
+	var wg sync.WaitGroup
+
+	if h != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.Drain(*fDrainTimeout)
+		}()
+	}
+
+	if local != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			local.Drain(*fDrainTimeout)
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		node.Drain(*fDrainTimeout)
+	}()
+
+	wg.Wait()
+}
@@ -0,0 +1,152 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/vektra/vega"
+)
+
+// Both kept in the :system: bucket
+var (
+	// id => the time it was seen
+	cDedup = []byte(":dedup:")
+
+	// time + id, so that the oldest entries can be found quickly
+	cDedupTime = []byte(":dedup-time:")
+)
+
+func dedupTime(t time.Time) []byte {
+	ts := make([]byte, 8)
+	binary.BigEndian.PutUint64(ts, uint64(t.UnixNano()))
+	return ts
+}
+
+// Report if id was recorded as seen within window
+func (d *Storage) Seen(id string, window time.Duration) (bool, error) {
+	var seen bool
+
+	cutoff := dedupTime(time.Now().Add(-window))
+
+	err := d.db.View(func(tx *bolt.Tx) error {
+		sys := tx.Bucket(cSystem)
+		if sys == nil {
+			return nil
+		}
+
+		ids := sys.Bucket(cDedup)
+		if ids == nil {
+			return nil
+		}
+
+		ts := ids.Get([]byte(id))
+		seen = ts != nil && bytes.Compare(ts, cutoff) >= 0
+
+		return nil
+	})
+
+	return seen, err
+}
+
+// Record that id has been seen. Entries older than window are
+// forgotten along the way.
+func (d *Storage) MarkSeen(id string, window time.Duration) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return markSeen(tx, id, window)
+	})
+}
+
+// Push msg to m and record that id has been seen in the same bolt
+// transaction, so that the id is only kept if the message is. m must
+// be a mailbox of d.
+func (d *Storage) PushSeen(m vega.Mailbox, msg *vega.Message, id string, window time.Duration) error {
+	parts := []*vega.MailboxTx{{Mailbox: m, Pushes: []*vega.Message{msg}}}
+
+	return d.TransactSeen(parts, []string{id}, window)
+}
+
+// Apply parts like Transact and record that ids have been seen, all in
+// one bolt transaction.
+func (d *Storage) TransactSeen(parts []*vega.MailboxTx, ids []string, window time.Duration) error {
+	return d.transact(parts, func(tx *bolt.Tx) error {
+		for _, id := range ids {
+			err := markSeen(tx, id, window)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func markSeen(tx *bolt.Tx, id string, window time.Duration) error {
+	now := time.Now()
+
+	sys, err := tx.CreateBucketIfNotExists(cSystem)
+	if err != nil {
+		return err
+	}
+
+	ids, err := sys.CreateBucketIfNotExists(cDedup)
+	if err != nil {
+		return err
+	}
+
+	times, err := sys.CreateBucketIfNotExists(cDedupTime)
+	if err != nil {
+		return err
+	}
+
+	err = pruneSeen(ids, times, dedupTime(now.Add(-window)))
+	if err != nil {
+		return err
+	}
+
+	// Replace any older entry so the window starts again
+	if old := ids.Get([]byte(id)); old != nil {
+		err = times.Delete(append(append([]byte{}, old...), id...))
+		if err != nil {
+			return err
+		}
+	}
+
+	ts := dedupTime(now)
+
+	err = ids.Put([]byte(id), ts)
+	if err != nil {
+		return err
+	}
+
+	return times.Put(append(ts, id...), []byte{})
+}
+
+// Delete the entries seen before cutoff
+func pruneSeen(ids, times *bolt.Bucket, cutoff []byte) error {
+	var expired [][]byte
+
+	c := times.Cursor()
+
+	for k, _ := c.First(); k != nil && bytes.Compare(k[:8], cutoff) < 0; k, _ = c.Next() {
+		expired = append(expired, append([]byte{}, k...))
+	}
+
+	for _, k := range expired {
+		id := k[8:]
+
+		// Only if the id hasn't been seen again since
+		if bytes.Equal(ids.Get(id), k[:8]) {
+			if err := ids.Delete(id); err != nil {
+				return err
+			}
+		}
+
+		if err := times.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package disk
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/vega"
+)
+
+func TestDiskSeen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	r, err := NewDiskStorage(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	seen, err := r.Seen("a", time.Minute)
+	require.NoError(t, err)
+	assert.False(t, seen)
+
+	require.NoError(t, r.MarkSeen("a", time.Minute))
+
+	seen, err = r.Seen("a", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, seen)
+
+	// The ids seen survive a restart
+	r.Close()
+
+	r, err = NewDiskStorage(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	defer r.Close()
+
+	seen, err = r.Seen("a", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, seen)
+}
+
+func TestDiskSeenWindowExpires(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	r, err := NewDiskStorage(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	defer r.Close()
+
+	require.NoError(t, r.MarkSeen("a", 50*time.Millisecond))
+
+	seen, err := r.Seen("a", 50*time.Millisecond)
+	require.NoError(t, err)
+	assert.True(t, seen)
+
+	time.Sleep(60 * time.Millisecond)
+
+	seen, err = r.Seen("a", 50*time.Millisecond)
+	require.NoError(t, err)
+	assert.False(t, seen)
+}
+
+func TestDiskPushSeen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	r, err := NewDiskStorage(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	defer r.Close()
+
+	m := r.Mailbox("a")
+
+	msg := vega.Msg("hello")
+
+	require.NoError(t, r.PushSeen(m, msg, "x", time.Minute))
+
+	seen, err := r.Seen("x", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, seen)
+
+	got, err := m.Poll()
+	require.NoError(t, err)
+	require.NotNil(t, got)
+	assert.Equal(t, msg.Body, got.Body)
+
+	// A push that fails doesn't record the id
+	other := vega.NewMemMailbox("b")
+
+	err = r.PushSeen(other, vega.Msg("hello"), "y", time.Minute)
+	assert.Equal(t, vega.ETransactUnsupported, err)
+
+	seen, err = r.Seen("y", time.Minute)
+	require.NoError(t, err)
+	assert.False(t, seen)
+}
@@ -1,6 +1,8 @@
 package disk
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"path/filepath"
 	"strconv"
@@ -68,6 +70,13 @@ var (
 	cSystem        = []byte(":system:")
 	cMInfo         = []byte(":info:")
 	cMessagePrefix = []byte("m-")
+
+	// index => the group of a message in one
+	cGroupPrefix = []byte("g-")
+
+	// group + 0 + index => nothing, the messages waiting for their
+	// group in the order they were pushed
+	cDeferredPrefix = []byte("d-")
 )
 
 func (d *Storage) Mailbox(name string) vega.Mailbox {
@@ -163,6 +172,16 @@ type mailboxHeader struct {
 	InFlight                              int
 
 	DCMessages []int
+
+	// How many messages are waiting for another message in their group
+	// to be done with. They're queued by group under cDeferredPrefix.
+	Deferred int
+
+	// Messages their group has moved on to, to be delivered next
+	Ready []int
+
+	// The index of the message each group is on, in flight or in Ready
+	Groups map[string]int
 }
 
 func (m *diskMailbox) Abandon() error {
@@ -238,29 +257,237 @@ func (m *diskMailbox) Poll() (*vega.Message, error) {
 			return err
 		}
 
-		var idx int
+		data, err = m.next(buk, &header)
+		if err != nil || data == nil {
+			return err
+		}
 
-		if len(header.DCMessages) > 0 {
-			idx = header.DCMessages[0]
-			header.DCMessages = header.DCMessages[1:]
-		} else {
+		// Only valid until the transaction ends, and large values
+		// can be moved when the file is remapped.
+		data = append([]byte(nil), data...)
+
+		headerData, err := diskDataMarshal(&header)
+		if err != nil {
+			return err
+		}
+
+		return buk.Put(cMInfo, headerData)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	return vega.DecodeMessage(data), nil
+}
+
+func messageKey(idx int) []byte {
+	idxStr := strconv.Itoa(idx)
+
+	key := make([]byte, 0, len(cMessagePrefix)+len(idxStr))
+	key = append(key, cMessagePrefix...)
+
+	return append(key, idxStr...)
+}
+
+// Find the next message that can be delivered and put it in flight,
+// updating header. Messages are taken from those nack'd, then those
+// their group has moved on to and then the unread ones. An unread
+// message whose group is busy is queued behind it instead. Returns nil
+// if there's no message to deliver.
+func (m *diskMailbox) next(buk *bolt.Bucket, header *mailboxHeader) ([]byte, error) {
+	var idx int
+
+	switch {
+	case len(header.DCMessages) > 0:
+		idx = header.DCMessages[0]
+		header.DCMessages = header.DCMessages[1:]
+	case len(header.Ready) > 0:
+		idx = header.Ready[0]
+		header.Ready = header.Ready[1:]
+	default:
+		for {
 			if header.Size == 0 {
-				return nil
+				return nil, nil
 			}
 
 			idx = header.ReadIndex
 			header.ReadIndex++
 			header.Size--
+
+			group := groupOf(buk, idx)
+			if group == "" {
+				break
+			}
+
+			if _, busy := header.Groups[group]; !busy {
+				if header.Groups == nil {
+					header.Groups = make(map[string]int)
+				}
+
+				header.Groups[group] = idx
+				break
+			}
+
+			err := header.deferMessage(buk, group, idx)
+			if err != nil {
+				return nil, err
+			}
 		}
+	}
+
+	data := buk.Get(messageKey(idx))
+	if data == nil {
+		return nil, ECorruptMailbox
+	}
+
+	header.InFlight++
+
+	return data, nil
+}
+
+func groupKey(idx int) []byte {
+	return append(append([]byte{}, cGroupPrefix...), strconv.Itoa(idx)...)
+}
+
+// Return the group of the message at idx, empty if it's not in one
+func groupOf(buk *bolt.Bucket, idx int) string {
+	return string(buk.Get(groupKey(idx)))
+}
+
+func deferredPrefix(group string) []byte {
+	key := make([]byte, 0, len(cDeferredPrefix)+len(group)+1)
+	key = append(key, cDeferredPrefix...)
+	key = append(key, group...)
+
+	return append(key, 0)
+}
+
+// Keyed so that a group's messages are in the order they were pushed
+func deferredKey(group string, idx int) []byte {
+	var ib [8]byte
+	binary.BigEndian.PutUint64(ib[:], uint64(idx))
+
+	return append(deferredPrefix(group), ib[:]...)
+}
 
-		key := append(cMessagePrefix, []byte(strconv.Itoa(idx))...)
+// Queue the message at idx behind the one its group is on
+func (header *mailboxHeader) deferMessage(buk *bolt.Bucket, group string, idx int) error {
+	header.Deferred++
+	return buk.Put(deferredKey(group, idx), []byte{})
+}
+
+// Move the group of the message at idx on to its next waiting message,
+// which is made ready to deliver, or free the group if there's none.
+// Returns true if the group was on the message at idx.
+func (header *mailboxHeader) release(buk *bolt.Bucket, idx int) (bool, error) {
+	group := groupOf(buk, idx)
+	if group == "" {
+		return false, nil
+	}
+
+	if gidx, ok := header.Groups[group]; !ok || gidx != idx {
+		return false, nil
+	}
+
+	prefix := deferredPrefix(group)
+
+	k, _ := buk.Cursor().Seek(prefix)
+	if k == nil || !bytes.HasPrefix(k, prefix) {
+		delete(header.Groups, group)
+		return true, nil
+	}
+
+	next := int(binary.BigEndian.Uint64(k[len(prefix):]))
+
+	err := buk.Delete(k)
+	if err != nil {
+		return false, err
+	}
+
+	header.Deferred--
+	header.Groups[group] = next
+	header.Ready = append(header.Ready, next)
+
+	return true, nil
+}
+
+// Hand messages to waiting watchers while there are any that can be
+// delivered. The values are sent once the transaction has committed.
+// Must be called with m locked.
+func (m *diskMailbox) feedWatchers(buk *bolt.Bucket, header *mailboxHeader) ([]func(), error) {
+	var sends []func()
+
+	for len(m.watchers) > 0 {
+		watch := m.watchers[0]
+
+		if watch.done != nil {
+			select {
+			case <-watch.done:
+				m.watchers = m.watchers[1:]
+				close(watch.indicator)
+				continue
+			default:
+			}
+		}
+
+		data, err := m.next(buk, header)
+		if err != nil {
+			return nil, err
+		}
 
-		data = buk.Get(key)
 		if data == nil {
+			break
+		}
+
+		m.watchers = m.watchers[1:]
+
+		msg := vega.DecodeMessage(data)
+
+		sends = append(sends, func() {
+			watch.indicator <- msg
+			close(watch.indicator)
+		})
+	}
+
+	return sends, nil
+}
+
+// Load the mailbox's header, let fn update it and store it again, all
+// in one transaction. The sends fn returns are performed once the
+// transaction has committed. If it fails, the watchers fn handed
+// messages to are restored. Must be called with m locked.
+func (m *diskMailbox) update(fn func(*bolt.Bucket, *mailboxHeader) ([]func(), error)) error {
+	watchers := append([]*watchChannel(nil), m.watchers...)
+
+	var sends []func()
+
+	err := m.disk.db.Update(func(tx *bolt.Tx) error {
+		buk := tx.Bucket(m.prefix)
+		if buk == nil {
+			return vega.EUnknownMessage
+		}
+
+		data := buk.Get(cMInfo)
+		if len(data) == 0 {
+			return vega.EUnknownMessage
+		}
+
+		var header mailboxHeader
+
+		err := diskDataUnmarshal(data, &header)
+		if err != nil {
 			return ECorruptMailbox
 		}
 
-		header.InFlight++
+		sends, err = fn(buk, &header)
+		if err != nil {
+			return err
+		}
 
 		headerData, err := diskDataMarshal(&header)
 		if err != nil {
@@ -271,132 +498,302 @@ func (m *diskMailbox) Poll() (*vega.Message, error) {
 	})
 
 	if err != nil {
-		return nil, err
+		m.watchers = watchers
+		return err
 	}
 
-	if len(data) == 0 {
-		return nil, nil
+	for _, send := range sends {
+		send()
 	}
 
-	return vega.DecodeMessage(data), nil
+	return nil
 }
 
 func (m *diskMailbox) Ack(id vega.MessageId) error {
 	m.Lock()
 	defer m.Unlock()
 
-	db := m.disk.db
+	return m.update(func(buk *bolt.Bucket, header *mailboxHeader) ([]func(), error) {
+		return m.ack(buk, header, id)
+	})
+}
 
-	return db.Update(func(tx *bolt.Tx) error {
+func (m *diskMailbox) AckMany(ids []vega.MessageId) error {
+	m.Lock()
+	defer m.Unlock()
 
-		buk := tx.Bucket(m.prefix)
+	return m.update(func(buk *bolt.Bucket, header *mailboxHeader) ([]func(), error) {
+		var sends []func()
 
-		data := buk.Get(cMInfo)
+		for _, id := range ids {
+			s, err := m.ack(buk, header, id)
+			if err != nil {
+				return nil, err
+			}
 
-		if len(data) == 0 {
-			return vega.EUnknownMessage
+			sends = append(sends, s...)
 		}
 
-		var header mailboxHeader
+		return sends, nil
+	})
+}
 
-		err := diskDataUnmarshal(data, &header)
+func (m *diskMailbox) AckThrough(id vega.MessageId) ([]vega.MessageId, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	var acked []vega.MessageId
+
+	err := m.update(func(buk *bolt.Bucket, header *mailboxHeader) ([]func(), error) {
+		last, err := messageIndex(id)
 		if err != nil {
-			return ECorruptMailbox
+			return nil, err
 		}
 
-		idxStr := id.LocalIndex()
-		if idxStr == "" {
-			return vega.EUnknownMessage
+		if !header.inFlight(buk, last) {
+			return nil, vega.EUnknownMessage
 		}
 
-		idx, err := strconv.Atoi(idxStr)
-		if err != nil {
-			return err
-		}
+		acked = nil
 
-		// debugf("acking message %d (AckIndex: %d)\n", idx, header.AckIndex)
+		// Read but not in flight
+		waiting := make(map[int]bool)
 
-		if header.ReadIndex-header.AckIndex == 0 {
-			return vega.EUnknownMessage
+		for _, list := range [][]int{header.DCMessages, header.Ready} {
+			for _, idx := range list {
+				waiting[idx] = true
+			}
 		}
 
-		if idx < header.AckIndex || idx >= header.ReadIndex {
-			return vega.EUnknownMessage
-		}
+		var done []int
 
-		// Messages may be ack'd incontigiously. That's fine, we'll
-		// just track AckIndex as the oldest un-acked message.
-		if header.AckIndex == idx {
-			header.AckIndex++
+		for idx := header.AckIndex; idx <= last; idx++ {
+			if waiting[idx] {
+				continue
+			}
+
+			data := buk.Get(messageKey(idx))
+			if data == nil {
+				continue
+			}
+
+			if group := groupOf(buk, idx); group != "" {
+				if gidx, ok := header.Groups[group]; !ok || gidx != idx {
+					continue
+				}
+			}
+
+			var msg vega.Message
+
+			err := diskDataUnmarshal(data, &msg)
+			if err != nil {
+				return nil, ECorruptMailbox
+			}
+
+			err = buk.Delete(messageKey(idx))
+			if err != nil {
+				return nil, err
+			}
+
+			header.InFlight--
+
+			done = append(done, idx)
+			acked = append(acked, msg.MessageId)
 		}
 
-		key := append(cMessagePrefix, []byte(idxStr)...)
+		// Only once they're all acked, so that a message a group moves
+		// on to isn't taken as in flight above.
+		var released bool
 
-		err = buk.Delete(key)
-		if err != nil {
-			return err
+		for _, idx := range done {
+			r, err := header.release(buk, idx)
+			if err != nil {
+				return nil, err
+			}
+
+			released = released || r
+
+			err = buk.Delete(groupKey(idx))
+			if err != nil {
+				return nil, err
+			}
 		}
 
-		header.InFlight--
+		for header.AckIndex < header.ReadIndex && buk.Get(messageKey(header.AckIndex)) == nil {
+			header.AckIndex++
+		}
 
-		headerData, err := diskDataMarshal(&header)
-		if err != nil {
-			return err
+		if released {
+			return m.feedWatchers(buk, header)
 		}
 
-		return buk.Put(cMInfo, headerData)
+		return nil, nil
 	})
-}
 
-func (m *diskMailbox) Nack(id vega.MessageId) error {
-	m.Lock()
-	defer m.Unlock()
+	if err != nil {
+		return nil, err
+	}
 
+	return acked, nil
+}
+
+// The index of the message with id in its mailbox
+func messageIndex(id vega.MessageId) (int, error) {
 	idxStr := id.LocalIndex()
 	if idxStr == "" {
-		return vega.EUnknownMessage
+		return 0, vega.EUnknownMessage
+	}
+
+	return strconv.Atoi(idxStr)
+}
+
+// Returns true if the message at idx has been read and not yet ack'd
+// or nack'd.
+func (header *mailboxHeader) inFlight(buk *bolt.Bucket, idx int) bool {
+	if idx < header.AckIndex || idx >= header.ReadIndex {
+		return false
+	}
+
+	if buk.Get(messageKey(idx)) == nil {
+		return false
+	}
+
+	for _, list := range [][]int{header.DCMessages, header.Ready} {
+		for _, i := range list {
+			if i == idx {
+				return false
+			}
+		}
 	}
 
-	idx, err := strconv.Atoi(idxStr)
+	// A message in a group is only in flight if its group is on it,
+	// otherwise it's waiting its turn.
+	if group := groupOf(buk, idx); group != "" {
+		gidx, ok := header.Groups[group]
+		return ok && gidx == idx
+	}
+
+	return true
+}
+
+// Ack the message with id, updating header. Returns the sends to
+// perform once the transaction has committed.
+func (m *diskMailbox) ack(buk *bolt.Bucket, header *mailboxHeader, id vega.MessageId) ([]func(), error) {
+	idx, err := messageIndex(id)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	db := m.disk.db
+	return m.ackIndex(buk, header, idx)
+}
 
-	return db.Update(func(tx *bolt.Tx) error {
-		var header mailboxHeader
+func (m *diskMailbox) ackIndex(buk *bolt.Bucket, header *mailboxHeader, idx int) ([]func(), error) {
+	// debugf("acking message %d (AckIndex: %d)\n", idx, header.AckIndex)
 
-		buk := tx.Bucket(m.prefix)
+	if !header.inFlight(buk, idx) {
+		return nil, vega.EUnknownMessage
+	}
 
-		data := buk.Get(cMInfo)
-		if data == nil {
-			return vega.EUnknownMessage
-		}
+	err := buk.Delete(messageKey(idx))
+	if err != nil {
+		return nil, err
+	}
 
-		diskDataUnmarshal(data, &header)
+	released, err := header.release(buk, idx)
+	if err != nil {
+		return nil, err
+	}
 
-		if idx < header.AckIndex || idx >= header.ReadIndex {
-			return vega.EUnknownMessage
-		}
+	err = buk.Delete(groupKey(idx))
+	if err != nil {
+		return nil, err
+	}
 
-		header.InFlight--
+	// Messages may be ack'd incontigiously. That's fine, we'll
+	// just track AckIndex as the oldest un-acked message.
+	for header.AckIndex < header.ReadIndex && buk.Get(messageKey(header.AckIndex)) == nil {
+		header.AckIndex++
+	}
 
-		// optimization, nack'ing the last read message
-		if idx == header.ReadIndex-1 {
-			header.ReadIndex--
-			header.Size++
-		} else {
-			header.DCMessages = append(header.DCMessages, idx)
+	header.InFlight--
+
+	if released {
+		return m.feedWatchers(buk, header)
+	}
+
+	return nil, nil
+}
+
+func (m *diskMailbox) Nack(id vega.MessageId) error {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.update(func(buk *bolt.Bucket, header *mailboxHeader) ([]func(), error) {
+		return m.nack(buk, header, id)
+	})
+}
+
+func (m *diskMailbox) NackMany(ids []vega.MessageId) error {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.update(func(buk *bolt.Bucket, header *mailboxHeader) ([]func(), error) {
+		var sends []func()
+
+		for _, id := range ids {
+			s, err := m.nack(buk, header, id)
+			if err != nil {
+				return nil, err
+			}
+
+			sends = append(sends, s...)
 		}
 
-		headerData, err := diskDataMarshal(&header)
+		return sends, nil
+	})
+}
+
+// Put the message with id back to be read again, updating header.
+// Returns the sends to perform once the transaction has committed.
+func (m *diskMailbox) nack(buk *bolt.Bucket, header *mailboxHeader, id vega.MessageId) ([]func(), error) {
+	idx, err := messageIndex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !header.inFlight(buk, idx) {
+		return nil, vega.EUnknownMessage
+	}
+
+	header.InFlight--
+
+	group := groupOf(buk, idx)
+
+	// optimization, nack'ing the last read message
+	if idx == header.ReadIndex-1 {
+		header.ReadIndex--
+		header.Size++
+	} else if group != "" {
+		// Back to the front of its group, which the release below
+		// then moves on to.
+		err = header.deferMessage(buk, group, idx)
 		if err != nil {
-			return err
+			return nil, err
 		}
+	} else {
+		header.DCMessages = append(header.DCMessages, idx)
+	}
 
-		return buk.Put(cMInfo, headerData)
-	})
+	released, err := header.release(buk, idx)
+	if err != nil {
+		return nil, err
+	}
+
+	if released {
+		return m.feedWatchers(buk, header)
+	}
+
+	return nil, nil
 }
 
 func (m *diskMailbox) Push(value *vega.Message) error {
@@ -405,8 +802,9 @@ func (m *diskMailbox) Push(value *vega.Message) error {
 
 	db := m.disk.db
 
-	return db.Update(func(tx *bolt.Tx) error {
+	var sends []func()
 
+	err := db.Update(func(tx *bolt.Tx) error {
 		var header mailboxHeader
 
 		buk, err := tx.CreateBucketIfNotExists(m.prefix)
@@ -422,60 +820,68 @@ func (m *diskMailbox) Push(value *vega.Message) error {
 			}
 		}
 
-		idxStr := strconv.Itoa(header.WriteIndex)
+		sends, err = m.push(buk, &header, value)
+		if err != nil {
+			return err
+		}
 
-		if value.MessageId == "" {
-			value.MessageId = vega.NextMessageID()
+		headerData, err := diskDataMarshal(&header)
+		if err != nil {
+			return err
 		}
 
-		value.MessageId = value.MessageId.AppendLocalIndex(idxStr)
+		return buk.Put(cMInfo, headerData)
+	})
 
-		key := append(cMessagePrefix, []byte(idxStr)...)
+	if err != nil {
+		return err
+	}
 
-		buk.Put(key, value.AsBytes())
+	for _, send := range sends {
+		send()
+	}
 
-		var watch *watchChannel
+	return nil
+}
 
-		header.WriteIndex++
+// Store value as the newest message, updating header. Returns the
+// sends to perform once the transaction has committed.
+func (m *diskMailbox) push(buk *bolt.Bucket, header *mailboxHeader, value *vega.Message) ([]func(), error) {
+	idxStr := strconv.Itoa(header.WriteIndex)
 
-	RETRY:
-		if len(m.watchers) > 0 {
-			watch = m.watchers[0]
-			m.watchers = m.watchers[1:]
+	// value only gets its id once the transaction has committed, so
+	// that it's left as it was if it's rolled back.
+	msg := *value
 
-			if watch.done != nil {
-				select {
-				case <-watch.done:
-					close(watch.indicator)
-					watch = nil
-					goto RETRY
-				default:
-				}
-			}
+	if msg.MessageId == "" {
+		msg.MessageId = vega.NextMessageID()
+	}
 
-			header.ReadIndex++
-			header.InFlight++
-		} else {
-			header.Size++
-		}
+	msg.MessageId = msg.MessageId.AppendLocalIndex(idxStr)
 
-		headerData, err := diskDataMarshal(&header)
-		if err != nil {
-			return err
-		}
+	err := buk.Put(messageKey(header.WriteIndex), msg.AsBytes())
+	if err != nil {
+		return nil, err
+	}
 
-		err = buk.Put(cMInfo, headerData)
+	if group := msg.Group(); group != "" {
+		err = buk.Put(groupKey(header.WriteIndex), []byte(group))
 		if err != nil {
-			return err
+			return nil, err
 		}
+	}
 
-		if watch != nil {
-			watch.indicator <- value
-			close(watch.indicator)
-		}
+	header.WriteIndex++
+	header.Size++
 
-		return nil
-	})
+	sends, err := m.feedWatchers(buk, header)
+	if err != nil {
+		return nil, err
+	}
+
+	id := msg.MessageId
+
+	return append(sends, func() { value.MessageId = id }), nil
 }
 
 func (mm *diskMailbox) AddWatcher() <-chan *vega.Message {
@@ -520,7 +926,7 @@ func (m *diskMailbox) Stats() *vega.MailboxStats {
 	})
 
 	return &vega.MailboxStats{
-		Size:     header.Size + len(header.DCMessages),
+		Size:     header.Size + len(header.DCMessages) + len(header.Ready) + header.Deferred,
 		InFlight: header.InFlight,
 	}
 }
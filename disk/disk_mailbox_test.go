@@ -1,6 +1,7 @@
 package disk
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -560,3 +561,338 @@ func TestDiskMailboxWatcherIsCancelable(t *testing.T) {
 
 	assert.True(t, msg.Equal(out), "didn't get right message")
 }
+
+func groupMsg(group, body string) *vega.Message {
+	msg := vega.Msg(body)
+	msg.SetGroup(group)
+	return msg
+}
+
+func TestDiskMailboxGroupsDeliverInOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	r, err := NewDiskStorage(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	defer r.Close()
+
+	m := r.Mailbox("a")
+
+	m.Push(groupMsg("a", "a1"))
+	m.Push(groupMsg("a", "a2"))
+	m.Push(groupMsg("b", "b1"))
+	m.Push(groupMsg("a", "a3"))
+	m.Push(vega.Msg("plain"))
+
+	// a2 and a3 are held back while a1 is in flight
+	a1, err := m.Poll()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("a1"), a1.Body)
+
+	b1, err := m.Poll()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("b1"), b1.Body)
+
+	plain, err := m.Poll()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("plain"), plain.Body)
+
+	out, err := m.Poll()
+	require.NoError(t, err)
+	assert.Nil(t, out)
+
+	assert.Equal(t, 2, m.Stats().Size)
+
+	// A nack'd message is redelivered before the rest of its group
+	require.NoError(t, m.Nack(a1.MessageId))
+
+	out, err = m.Poll()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("a1"), out.Body)
+
+	require.NoError(t, m.Ack(out.MessageId))
+
+	out, err = m.Poll()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("a2"), out.Body)
+
+	// Survives a restart
+	r.Close()
+
+	r, err = NewDiskStorage(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	m = r.Mailbox("a")
+
+	out2, err := m.Poll()
+	require.NoError(t, err)
+	assert.Nil(t, out2)
+
+	require.NoError(t, m.Ack(out.MessageId))
+
+	out, err = m.Poll()
+	require.NoError(t, err)
+	if assert.NotNil(t, out) {
+		assert.Equal(t, []byte("a3"), out.Body)
+	}
+}
+
+func TestDiskMailboxGroupReleaseWakesWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	r, err := NewDiskStorage(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	defer r.Close()
+
+	m := r.Mailbox("a")
+
+	m.Push(groupMsg("a", "a1"))
+	m.Push(groupMsg("a", "a2"))
+
+	a1, err := m.Poll()
+	require.NoError(t, err)
+
+	watch := m.AddWatcher()
+
+	require.NoError(t, m.Ack(a1.MessageId))
+
+	select {
+	case out := <-watch:
+		assert.Equal(t, []byte("a2"), out.Body)
+	default:
+		t.Fatal("watcher wasn't given the next message in the group")
+	}
+}
+
+func TestDiskMailboxGroupQueues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	r, err := NewDiskStorage(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	defer r.Close()
+
+	m := r.Mailbox("a")
+
+	for i := 1; i <= 50; i++ {
+		m.Push(groupMsg("a", fmt.Sprintf("a%d", i)))
+	}
+
+	m.Push(groupMsg("b", "b1"))
+
+	a1, err := m.Poll()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("a1"), a1.Body)
+
+	b1, err := m.Poll()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("b1"), b1.Body)
+
+	assert.Equal(t, 49, m.Stats().Size)
+
+	// Only a count of the waiting messages is kept in the header
+	var header mailboxHeader
+
+	err = r.db.View(func(tx *bolt.Tx) error {
+		return diskDataUnmarshal(tx.Bucket([]byte("a")).Get(cMInfo), &header)
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, 49, header.Deferred)
+
+	for i := 2; i <= 50; i++ {
+		require.NoError(t, m.Ack(a1.MessageId))
+
+		out, err := m.Poll()
+		require.NoError(t, err)
+		require.NotNil(t, out)
+		assert.Equal(t, []byte(fmt.Sprintf("a%d", i)), out.Body)
+
+		// A nack'd message comes back before the rest of its group
+		require.NoError(t, m.Nack(out.MessageId))
+
+		a1, err = m.Poll()
+		require.NoError(t, err)
+		assert.Equal(t, out.Body, a1.Body)
+	}
+
+	require.NoError(t, m.Ack(a1.MessageId))
+
+	out, err := m.Poll()
+	require.NoError(t, err)
+	assert.Nil(t, out)
+
+	assert.Equal(t, 0, m.Stats().Size)
+}
+
+func TestDiskMailboxAckMany(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	r, err := NewDiskStorage(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	defer r.Close()
+
+	m := r.Mailbox("a").(*diskMailbox)
+
+	m.Push(vega.Msg([]byte("1")))
+	m.Push(vega.Msg([]byte("2")))
+
+	a, err := m.Poll()
+	require.NoError(t, err)
+
+	b, err := m.Poll()
+	require.NoError(t, err)
+
+	// All or nothing
+	err = m.AckMany([]vega.MessageId{a.MessageId, "bogus:9"})
+	assert.Equal(t, vega.EUnknownMessage, err)
+
+	err = m.AckMany([]vega.MessageId{a.MessageId, a.MessageId})
+	assert.Equal(t, vega.EUnknownMessage, err)
+
+	assert.Equal(t, 2, m.Stats().InFlight)
+
+	err = m.AckMany([]vega.MessageId{a.MessageId, b.MessageId})
+	require.NoError(t, err)
+
+	assert.Equal(t, 0, m.Stats().InFlight)
+}
+
+func TestDiskMailboxNackMany(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	r, err := NewDiskStorage(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	defer r.Close()
+
+	m := r.Mailbox("a").(*diskMailbox)
+
+	m.Push(vega.Msg([]byte("1")))
+	m.Push(vega.Msg([]byte("2")))
+	m.Push(vega.Msg([]byte("3")))
+
+	a, err := m.Poll()
+	require.NoError(t, err)
+
+	b, err := m.Poll()
+	require.NoError(t, err)
+
+	err = m.NackMany([]vega.MessageId{a.MessageId, b.MessageId})
+	require.NoError(t, err)
+
+	// A nack'd message can't be nack'd again
+	err = m.Nack(a.MessageId)
+	assert.Equal(t, vega.EUnknownMessage, err)
+
+	stats := m.Stats()
+
+	assert.Equal(t, 3, stats.Size)
+	assert.Equal(t, 0, stats.InFlight)
+
+	var bodies []string
+
+	for i := 0; i < 3; i++ {
+		out, err := m.Poll()
+		require.NoError(t, err)
+
+		bodies = append(bodies, string(out.Body))
+	}
+
+	assert.Equal(t, []string{"1", "2", "3"}, bodies)
+}
+
+func TestDiskMailboxAckThrough(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	r, err := NewDiskStorage(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	defer r.Close()
+
+	m := r.Mailbox("a").(*diskMailbox)
+
+	var msgs []*vega.Message
+
+	for _, body := range []string{"1", "2", "3", "4"} {
+		m.Push(vega.Msg([]byte(body)))
+	}
+
+	for i := 0; i < 4; i++ {
+		out, err := m.Poll()
+		require.NoError(t, err)
+
+		msgs = append(msgs, out)
+	}
+
+	// 2 isn't in flight so it's left alone
+	err = m.Nack(msgs[1].MessageId)
+	require.NoError(t, err)
+
+	acked, err := m.AckThrough(msgs[2].MessageId)
+	require.NoError(t, err)
+
+	assert.Equal(t, []vega.MessageId{msgs[0].MessageId, msgs[2].MessageId}, acked)
+
+	stats := m.Stats()
+
+	assert.Equal(t, 1, stats.Size)
+	assert.Equal(t, 1, stats.InFlight)
+
+	err = m.Ack(msgs[3].MessageId)
+	assert.NoError(t, err)
+
+	_, err = m.AckThrough(msgs[0].MessageId)
+	assert.Equal(t, vega.EUnknownMessage, err)
+
+	out, err := m.Poll()
+	require.NoError(t, err)
+
+	assert.Equal(t, []byte("2"), out.Body)
+}
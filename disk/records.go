@@ -0,0 +1,153 @@
+package disk
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/vektra/vega"
+)
+
+// Sub-buckets of the :system: bucket that each keep one record per
+// name, encoded like the rest of the data on disk.
+var (
+	// name => the exchange and its bindings
+	cExchanges = []byte(":exchanges:")
+
+	// name => the alias and its targets
+	cAliases = []byte(":aliases:")
+
+	// mailbox => the type route for it
+	cTypeRoutes = []byte(":type-routes:")
+)
+
+// Store v as the record for name in the system sub-bucket buk,
+// replacing any record of the same name.
+func (d *Storage) putRecord(buk []byte, name string, v interface{}) error {
+	value, err := diskDataMarshal(v)
+	if err != nil {
+		return err
+	}
+
+	return d.db.Update(func(tx *bolt.Tx) error {
+		sys, err := tx.CreateBucketIfNotExists(cSystem)
+		if err != nil {
+			return err
+		}
+
+		records, err := sys.CreateBucketIfNotExists(buk)
+		if err != nil {
+			return err
+		}
+
+		return records.Put([]byte(name), value)
+	})
+}
+
+// Remove the record for name from the system sub-bucket buk
+func (d *Storage) deleteRecord(buk []byte, name string) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		sys := tx.Bucket(cSystem)
+		if sys == nil {
+			return nil
+		}
+
+		records := sys.Bucket(buk)
+		if records == nil {
+			return nil
+		}
+
+		return records.Delete([]byte(name))
+	})
+}
+
+// Decode each record in the system sub-bucket buk, in name order, into
+// a value returned by next.
+func (d *Storage) listRecords(buk []byte, next func() interface{}) error {
+	return d.db.View(func(tx *bolt.Tx) error {
+		sys := tx.Bucket(cSystem)
+		if sys == nil {
+			return nil
+		}
+
+		records := sys.Bucket(buk)
+		if records == nil {
+			return nil
+		}
+
+		return records.ForEach(func(k, v []byte) error {
+			err := diskDataUnmarshal(v, next())
+			if err != nil {
+				return ECorruptMailbox
+			}
+
+			return nil
+		})
+	})
+}
+
+// Record ex, replacing any exchange of the same name
+func (d *Storage) SaveExchange(ex *vega.Exchange) error {
+	return d.putRecord(cExchanges, ex.Name, ex)
+}
+
+// Forget the named exchange
+func (d *Storage) RemoveExchange(name string) error {
+	return d.deleteRecord(cExchanges, name)
+}
+
+// Return the exchanges that have been recorded
+func (d *Storage) Exchanges() ([]*vega.Exchange, error) {
+	var exs []*vega.Exchange
+
+	err := d.listRecords(cExchanges, func() interface{} {
+		ex := &vega.Exchange{}
+		exs = append(exs, ex)
+		return ex
+	})
+
+	return exs, err
+}
+
+// Record alias, replacing any alias of the same name
+func (d *Storage) SaveAlias(alias *vega.Alias) error {
+	return d.putRecord(cAliases, alias.Name, alias)
+}
+
+// Forget the named alias
+func (d *Storage) RemoveAlias(name string) error {
+	return d.deleteRecord(cAliases, name)
+}
+
+// Return the aliases that have been recorded
+func (d *Storage) Aliases() ([]*vega.Alias, error) {
+	var aliases []*vega.Alias
+
+	err := d.listRecords(cAliases, func() interface{} {
+		alias := &vega.Alias{}
+		aliases = append(aliases, alias)
+		return alias
+	})
+
+	return aliases, err
+}
+
+// Record route, replacing any type route of the same mailbox
+func (d *Storage) SaveTypeRoute(route *vega.TypeRoute) error {
+	return d.putRecord(cTypeRoutes, route.Mailbox, route)
+}
+
+// Forget the type route of mailbox
+func (d *Storage) RemoveTypeRoute(mailbox string) error {
+	return d.deleteRecord(cTypeRoutes, mailbox)
+}
+
+// Return the type routes that have been recorded
+func (d *Storage) TypeRoutes() ([]*vega.TypeRoute, error) {
+	var routes []*vega.TypeRoute
+
+	err := d.listRecords(cTypeRoutes, func() interface{} {
+		route := &vega.TypeRoute{}
+		routes = append(routes, route)
+		return route
+	})
+
+	return routes, err
+}
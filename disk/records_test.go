@@ -0,0 +1,122 @@
+package disk
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/vega"
+)
+
+type recordPut struct {
+	name  string
+	value interface{}
+}
+
+func TestDiskRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	d, err := NewDiskStorage(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	defer d.Close()
+
+	logs := &vega.Exchange{
+		Name: "logs",
+		Type: vega.ExchangeHeaders,
+		Bindings: []*vega.Binding{
+			{Mailbox: "a", Headers: map[string]string{"level": "error"}, MatchAny: true},
+		},
+	}
+
+	billing := &vega.Alias{Name: "billing", Targets: []string{"invoices", "audit"}}
+
+	invoices := &vega.TypeRoute{Mailbox: "invoices", Fallback: "invoices.other"}
+
+	cases := []struct {
+		buk    []byte
+		puts   []recordPut
+		remove string
+		next   func() interface{}
+		want   []interface{}
+	}{
+		{
+			cExchanges,
+			[]recordPut{
+				{"logs", &vega.Exchange{Name: "logs", Type: vega.ExchangeDirect}},
+				{"events", &vega.Exchange{Name: "events", Type: vega.ExchangeFanout}},
+				{"logs", logs},
+			},
+			"events",
+			func() interface{} { return &vega.Exchange{} },
+			[]interface{}{logs},
+		},
+		{
+			cAliases,
+			[]recordPut{
+				{"accounts", &vega.Alias{Name: "accounts", Targets: []string{"users"}}},
+				{"billing", &vega.Alias{Name: "billing", Targets: []string{"invoices"}}},
+				{"billing", billing},
+			},
+			"accounts",
+			func() interface{} { return &vega.Alias{} },
+			[]interface{}{billing},
+		},
+		{
+			cTypeRoutes,
+			[]recordPut{
+				{"accounts", &vega.TypeRoute{Mailbox: "accounts"}},
+				{"invoices", &vega.TypeRoute{Mailbox: "invoices"}},
+				{"invoices", invoices},
+			},
+			"accounts",
+			func() interface{} { return &vega.TypeRoute{} },
+			[]interface{}{invoices},
+		},
+		{
+			[]byte(":nothing:"),
+			nil,
+			"missing",
+			func() interface{} { return &vega.Alias{} },
+			nil,
+		},
+	}
+
+	for _, c := range cases {
+		for _, put := range c.puts {
+			require.NoError(t, d.putRecord(c.buk, put.name, put.value))
+		}
+
+		require.NoError(t, d.deleteRecord(c.buk, c.remove), "%s", c.buk)
+
+		var got []interface{}
+
+		err := d.listRecords(c.buk, func() interface{} {
+			v := c.next()
+			got = append(got, v)
+			return v
+		})
+
+		require.NoError(t, err, "%s", c.buk)
+		assert.Equal(t, c.want, got, "%s", c.buk)
+	}
+
+	// The typed wrappers list in name order
+	require.NoError(t, d.SaveAlias(&vega.Alias{Name: "accounts", Targets: []string{"users"}}))
+
+	aliases, err := d.Aliases()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(aliases))
+
+	assert.Equal(t, "accounts", aliases[0].Name)
+	assert.Equal(t, billing, aliases[1])
+}
@@ -0,0 +1,99 @@
+package disk
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/vektra/vega"
+)
+
+// Kept in the :system: bucket, topic => the last retained message
+var cRetained = []byte(":retained:")
+
+// Store msg as the retained message for topic, replacing any before
+// it. A message with an empty body clears the topic's retained message.
+func (d *Storage) Retain(topic string, msg *vega.Message) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		sys, err := tx.CreateBucketIfNotExists(cSystem)
+		if err != nil {
+			return err
+		}
+
+		buk, err := sys.CreateBucketIfNotExists(cRetained)
+		if err != nil {
+			return err
+		}
+
+		if len(msg.Body) == 0 {
+			return buk.Delete([]byte(topic))
+		}
+
+		return buk.Put([]byte(topic), msg.AsBytes())
+	})
+}
+
+// Return the retained messages for the topics sub matches
+func (d *Storage) Retained(sub *vega.Subscription) ([]*vega.Message, error) {
+	var msgs []*vega.Message
+
+	err := d.db.View(func(tx *bolt.Tx) error {
+		sys := tx.Bucket(cSystem)
+		if sys == nil {
+			return nil
+		}
+
+		buk := sys.Bucket(cRetained)
+		if buk == nil {
+			return nil
+		}
+
+		return buk.ForEach(func(k, v []byte) error {
+			if !sub.Match(string(k)) {
+				return nil
+			}
+
+			var msg vega.Message
+
+			err := msg.FromBytes(v)
+			if err != nil {
+				return ECorruptMailbox
+			}
+
+			msgs = append(msgs, &msg)
+			return nil
+		})
+	})
+
+	return msgs, err
+}
+
+// Return the retained message for topic, or nil if there isn't one
+func (d *Storage) RetainedMessage(topic string) (*vega.Message, error) {
+	var msg *vega.Message
+
+	err := d.db.View(func(tx *bolt.Tx) error {
+		sys := tx.Bucket(cSystem)
+		if sys == nil {
+			return nil
+		}
+
+		buk := sys.Bucket(cRetained)
+		if buk == nil {
+			return nil
+		}
+
+		v := buk.Get([]byte(topic))
+		if v == nil {
+			return nil
+		}
+
+		msg = &vega.Message{}
+
+		err := msg.FromBytes(v)
+		if err != nil {
+			return ECorruptMailbox
+		}
+
+		return nil
+	})
+
+	return msg, err
+}
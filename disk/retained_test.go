@@ -0,0 +1,60 @@
+package disk
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/vega"
+)
+
+func TestDiskRetain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	d, err := NewDiskStorage(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	defer d.Close()
+
+	sub := vega.ParseSubscription("config/+/current")
+
+	msgs, err := d.Retained(sub)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(msgs))
+
+	require.NoError(t, d.Retain("config/a/current", vega.Msg("1")))
+	require.NoError(t, d.Retain("config/a/current", vega.Msg("2")))
+	require.NoError(t, d.Retain("config/b/other", vega.Msg("3")))
+
+	msgs, err = d.Retained(sub)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(msgs))
+
+	assert.Equal(t, []byte("2"), msgs[0].Body)
+
+	msg, err := d.RetainedMessage("config/a/current")
+	require.NoError(t, err)
+	require.NotNil(t, msg)
+
+	assert.Equal(t, []byte("2"), msg.Body)
+
+	// An empty message clears it
+	require.NoError(t, d.Retain("config/a/current", &vega.Message{}))
+
+	msgs, err = d.Retained(sub)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(msgs))
+
+	msg, err = d.RetainedMessage("config/a/current")
+	require.NoError(t, err)
+	assert.Nil(t, msg)
+}
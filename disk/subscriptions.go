@@ -0,0 +1,105 @@
+package disk
+
+import (
+	"bytes"
+
+	"github.com/boltdb/bolt"
+	"github.com/vektra/vega"
+)
+
+// Kept in the :system: bucket, mailbox + "\x00" + pattern => the
+// subscription's filter, if it has one
+var cSubscriptions = []byte(":subscriptions:")
+
+func subscriptionKey(pattern, mailbox string) []byte {
+	return []byte(mailbox + "\x00" + pattern)
+}
+
+// Record sub, replacing any subscription of the same mailbox to the
+// same pattern.
+func (d *Storage) AddSubscription(sub *vega.Subscription) error {
+	value := []byte{}
+
+	if sub.Filter != nil {
+		var err error
+
+		value, err = diskDataMarshal(sub.Filter)
+		if err != nil {
+			return err
+		}
+	}
+
+	return d.db.Update(func(tx *bolt.Tx) error {
+		sys, err := tx.CreateBucketIfNotExists(cSystem)
+		if err != nil {
+			return err
+		}
+
+		buk, err := sys.CreateBucketIfNotExists(cSubscriptions)
+		if err != nil {
+			return err
+		}
+
+		return buk.Put(subscriptionKey(sub.Pattern, sub.Mailbox), value)
+	})
+}
+
+// Forget that mailbox is subscribed to pattern
+func (d *Storage) RemoveSubscription(pattern, mailbox string) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		sys := tx.Bucket(cSystem)
+		if sys == nil {
+			return nil
+		}
+
+		buk := sys.Bucket(cSubscriptions)
+		if buk == nil {
+			return nil
+		}
+
+		return buk.Delete(subscriptionKey(pattern, mailbox))
+	})
+}
+
+// Return the subscriptions that have been recorded
+func (d *Storage) Subscriptions() ([]*vega.Subscription, error) {
+	var subs []*vega.Subscription
+
+	err := d.db.View(func(tx *bolt.Tx) error {
+		sys := tx.Bucket(cSystem)
+		if sys == nil {
+			return nil
+		}
+
+		buk := sys.Bucket(cSubscriptions)
+		if buk == nil {
+			return nil
+		}
+
+		return buk.ForEach(func(k, v []byte) error {
+			sep := bytes.IndexByte(k, 0)
+			if sep == -1 {
+				return ECorruptMailbox
+			}
+
+			sub := vega.ParseSubscription(string(k[sep+1:]))
+			sub.Mailbox = string(k[:sep])
+
+			if len(v) > 0 {
+				var filter vega.SubscriptionFilter
+
+				err := diskDataUnmarshal(v, &filter)
+				if err != nil {
+					return ECorruptMailbox
+				}
+
+				sub.Filter = &filter
+			}
+
+			subs = append(subs, sub)
+			return nil
+		})
+	})
+
+	return subs, err
+}
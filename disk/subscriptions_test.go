@@ -0,0 +1,58 @@
+package disk
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/vega"
+)
+
+func TestDiskSubscriptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	d, err := NewDiskStorage(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	defer d.Close()
+
+	sub := func(pattern, mailbox string) *vega.Subscription {
+		sub := vega.ParseSubscription(pattern)
+		sub.Mailbox = mailbox
+		return sub
+	}
+
+	filtered := sub("logs/+", "b")
+	filtered.Filter = &vega.SubscriptionFilter{Type: "error"}
+
+	require.NoError(t, d.AddSubscription(sub("config/#", "a")))
+	require.NoError(t, d.AddSubscription(sub("logs/+", "b")))
+	require.NoError(t, d.AddSubscription(filtered))
+
+	subs, err := d.Subscriptions()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(subs))
+
+	assert.Equal(t, "config/#", subs[0].Pattern)
+	assert.Equal(t, "a", subs[0].Mailbox)
+	assert.True(t, subs[0].Match("config/x/y"))
+
+	require.NoError(t, d.RemoveSubscription("config/#", "a"))
+
+	subs, err = d.Subscriptions()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(subs))
+
+	assert.Equal(t, "logs/+", subs[0].Pattern)
+	assert.Equal(t, "b", subs[0].Mailbox)
+	assert.Equal(t, filtered.Filter, subs[0].Filter)
+}
@@ -0,0 +1,111 @@
+package disk
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/vektra/vega"
+)
+
+// Apply a transaction to mailboxes in this storage using a single
+// bolt transaction, so either all of it is stored or none of it is.
+func (d *Storage) Transact(parts []*vega.MailboxTx) error {
+	return d.transact(parts, nil)
+}
+
+// Apply parts, and then fn if it's set, in one bolt transaction
+func (d *Storage) transact(parts []*vega.MailboxTx, fn func(*bolt.Tx) error) error {
+	var boxes []*diskMailbox
+
+	for _, p := range parts {
+		m, ok := p.Mailbox.(*diskMailbox)
+		if !ok || m.disk != d {
+			return vega.ETransactUnsupported
+		}
+
+		boxes = append(boxes, m)
+	}
+
+	// parts are sorted by name so mailboxes are always locked in
+	// the same order.
+	for _, m := range boxes {
+		m.Lock()
+		defer m.Unlock()
+	}
+
+	// Pushes and acks hand messages to watchers, which has to be undone
+	// if the transaction fails.
+	watchers := make([][]*watchChannel, len(boxes))
+
+	for i, m := range boxes {
+		watchers[i] = append([]*watchChannel(nil), m.watchers...)
+	}
+
+	var sends []func()
+
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		for i, p := range parts {
+			m := boxes[i]
+
+			buk, err := tx.CreateBucketIfNotExists(m.prefix)
+			if err != nil {
+				return err
+			}
+
+			var header mailboxHeader
+
+			if data := buk.Get(cMInfo); len(data) > 0 {
+				err = diskDataUnmarshal(data, &header)
+				if err != nil {
+					return ECorruptMailbox
+				}
+			}
+
+			for _, id := range p.Acks {
+				s, err := m.ack(buk, &header, id)
+				if err != nil {
+					return err
+				}
+
+				sends = append(sends, s...)
+			}
+
+			for _, msg := range p.Pushes {
+				s, err := m.push(buk, &header, msg)
+				if err != nil {
+					return err
+				}
+
+				sends = append(sends, s...)
+			}
+
+			headerData, err := diskDataMarshal(&header)
+			if err != nil {
+				return err
+			}
+
+			err = buk.Put(cMInfo, headerData)
+			if err != nil {
+				return err
+			}
+		}
+
+		if fn != nil {
+			return fn(tx)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		for i, m := range boxes {
+			m.watchers = watchers[i]
+		}
+
+		return err
+	}
+
+	for _, send := range sends {
+		send()
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package disk
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/vega"
+)
+
+func TestDiskTransact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	d, err := NewDiskStorage(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	defer d.Close()
+
+	r := vega.NewRegistry(d.Mailbox)
+	r.Transactor = d
+
+	r.Declare("a")
+	r.Declare("b")
+
+	r.Push("a", vega.Msg([]byte("in")))
+
+	del, err := r.Poll("a")
+	require.NoError(t, err)
+
+	var tx vega.Transaction
+	tx.Ack("a", del.Message.MessageId)
+	tx.Push("b", vega.Msg([]byte("out")))
+
+	err = r.Transact(&tx)
+	require.NoError(t, err)
+
+	assert.Equal(t, 0, d.Mailbox("a").Stats().InFlight)
+
+	out, err := r.Poll("b")
+	require.NoError(t, err)
+	require.NotNil(t, out)
+
+	assert.Equal(t, []byte("out"), out.Message.Body)
+}
+
+func TestDiskTransactIsAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	d, err := NewDiskStorage(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	defer d.Close()
+
+	r := vega.NewRegistry(d.Mailbox)
+	r.Transactor = d
+
+	r.Declare("a")
+	r.Declare("b")
+
+	r.Push("a", vega.Msg([]byte("in")))
+
+	del, err := r.Poll("a")
+	require.NoError(t, err)
+
+	var tx vega.Transaction
+	tx.Push("b", vega.Msg([]byte("out")))
+	tx.Ack("a", del.Message.MessageId)
+	tx.Ack("a", "bogus")
+
+	err = r.Transact(&tx)
+	assert.Error(t, err)
+
+	assert.Equal(t, 1, d.Mailbox("a").Stats().InFlight)
+	assert.Equal(t, 0, d.Mailbox("b").Stats().Size)
+
+	// The ack can still be made once the transaction failed
+	err = d.Mailbox("a").Ack(del.Message.MessageId)
+	assert.NoError(t, err)
+
+	// A push that's rolled back leaves the message as it was
+	r.Declare("c")
+
+	out := vega.Msg([]byte("out"))
+
+	tx = vega.Transaction{}
+	tx.Push("b", out)
+	tx.Ack("c", "bogus")
+
+	err = r.Transact(&tx)
+	assert.Error(t, err)
+
+	assert.Equal(t, vega.MessageId(""), out.MessageId)
+}
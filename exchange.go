@@ -0,0 +1,414 @@
+package vega
+
+import (
+	"context"
+	"strings"
+
+	"github.com/vektra/errors"
+)
+
+var EUnknownExchange = errors.New("no such exchange")
+var EInvalidExchange = errors.New("invalid exchange")
+var EExchangeLoop = errors.New("exchange routes to itself")
+
+// The kinds of exchange. Exchanges route on the message's routing key,
+// which like a publish's topic is kept in CorrelationId.
+const (
+	// Routes to the bindings whose key is the routing key
+	ExchangeDirect = "direct"
+
+	// Routes to every binding
+	ExchangeFanout = "fanout"
+
+	// Routes to the bindings whose key is a pattern, in the same form as
+	// a subscription's, that matches the routing key
+	ExchangeTopic = "topic"
+
+	// Routes to the bindings whose headers match the message's
+	ExchangeHeaders = "headers"
+)
+
+// Ties a mailbox to an exchange
+type Binding struct {
+	Mailbox string `codec:"mailbox" json:"mailbox"`
+
+	// The routing key for a direct exchange, or pattern for a topic one
+	Key string `codec:"key,omitempty" json:"key,omitempty"`
+
+	// For a headers exchange, the headers a message must have set to
+	// these values
+	Headers map[string]string `codec:"headers,omitempty" json:"headers,omitempty"`
+
+	// For a headers exchange, match if any of Headers match rather than
+	// all of them
+	MatchAny bool `codec:"match_any,omitempty" json:"match_any,omitempty"`
+}
+
+func (b *Binding) equal(o *Binding) bool {
+	if b.Mailbox != o.Mailbox || b.Key != o.Key || b.MatchAny != o.MatchAny {
+		return false
+	}
+
+	if len(b.Headers) != len(o.Headers) {
+		return false
+	}
+
+	for name, val := range b.Headers {
+		if v, ok := o.Headers[name]; !ok || v != val {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (b *Binding) matchHeaders(msg *Message) bool {
+	for name, val := range b.Headers {
+		if headerIs(msg, name, val) == b.MatchAny {
+			return b.MatchAny
+		}
+	}
+
+	return !b.MatchAny
+}
+
+// A named entity in a Router that messages are pushed to and which
+// routes each one to the mailboxes bound to it, according to its type.
+type Exchange struct {
+	Name     string     `codec:"name" json:"name"`
+	Type     string     `codec:"type" json:"type"`
+	Bindings []*Binding `codec:"bindings,omitempty" json:"bindings,omitempty"`
+}
+
+func (ex *Exchange) copy() *Exchange {
+	cp := *ex
+	cp.Bindings = append([]*Binding(nil), ex.Bindings...)
+	return &cp
+}
+
+// Return the mailboxes bound to the exchange
+func (ex *Exchange) mailboxes() []string {
+	var names []string
+
+	for _, b := range ex.Bindings {
+		names = append(names, b.Mailbox)
+	}
+
+	return names
+}
+
+func (ex *Exchange) checkBinding(b *Binding) error {
+	if b == nil || b.Mailbox == "" {
+		return errors.Subject(EMalformedFrame, "binding requires a mailbox")
+	}
+
+	if ex.Type == ExchangeTopic {
+		return CheckPattern(b.Key)
+	}
+
+	return nil
+}
+
+func (ex *Exchange) bound(b *Binding) bool {
+	for _, x := range ex.Bindings {
+		if x.equal(b) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return the mailboxes msg should be pushed to, each only once
+func (ex *Exchange) Route(msg *Message) []string {
+	var names []string
+
+	seen := make(map[string]bool)
+
+	for _, b := range ex.Bindings {
+		if seen[b.Mailbox] {
+			continue
+		}
+
+		var match bool
+
+		switch ex.Type {
+		case ExchangeDirect:
+			match = b.Key == msg.CorrelationId
+		case ExchangeFanout:
+			match = true
+		case ExchangeTopic:
+			match = ParseSubscription(b.Key).Match(msg.CorrelationId)
+		case ExchangeHeaders:
+			match = b.matchHeaders(msg)
+		}
+
+		if match {
+			seen[b.Mailbox] = true
+			names = append(names, b.Mailbox)
+		}
+	}
+
+	return names
+}
+
+// Implemented by a Storage that manages exchanges
+type ExchangeManager interface {
+	DeclareExchange(*Exchange) error
+	DeleteExchange(name string) error
+	Bind(exchange string, b *Binding) error
+	Unbind(exchange string, b *Binding) error
+	Exchanges() []*Exchange
+}
+
+// Routes pushes to an exchange of a Router
+type exchangePusher struct {
+	router *Router
+	name   string
+}
+
+// Push msg to each of the mailboxes its bound to that it matches, with
+// the exchange added to its ExchangePath. A message that matches none
+// of them is dropped. If the exchange is already in the path, the
+// message has come around a loop and is refused. The mailboxes get the
+// message atomically only when they're all in one Storage, see
+// Router.pushAll.
+func (ep *exchangePusher) Push(name string, msg *Message) error {
+	r := ep.router
+
+	path := msg.ExchangePath()
+
+	for _, seen := range path {
+		if seen == ep.name {
+			return errors.Subject(EExchangeLoop, ep.name)
+		}
+	}
+
+	r.lock.Lock()
+
+	ex, ok := r.exchanges[ep.name]
+	if !ok {
+		r.lock.Unlock()
+		return errors.Subject(EUnknownExchange, ep.name)
+	}
+
+	targets := ex.Route(msg)
+
+	r.lock.Unlock()
+
+	fwd := msg.withHeader(ExchangePathHeader, strings.Join(append(path, ep.name), ","))
+
+	return r.pushAll(targets, fwd)
+}
+
+// Add ex to the router, along with any bindings it has. Declaring an
+// exchange that exists adds the bindings to it, but its type can't be
+// changed. An exchange can't share its name with a mailbox, and can't
+// be bound to itself, directly or through other exchanges or aliases.
+func (r *Router) DeclareExchange(ex *Exchange) error {
+	if ex == nil || ex.Name == "" || ex.Name[0] == ':' || strings.Contains(ex.Name, ",") {
+		return errors.Subject(EMalformedFrame, "exchange requires a name")
+	}
+
+	switch ex.Type {
+	case ExchangeDirect, ExchangeFanout, ExchangeTopic, ExchangeHeaders:
+	default:
+		return errors.Subject(EInvalidExchange, ex.Name)
+	}
+
+	for _, b := range ex.Bindings {
+		err := ex.checkBinding(b)
+		if err != nil {
+			return err
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	existing, ok := r.exchanges[ex.Name]
+	if !ok {
+		if _, taken := r.routes.Get(ex.Name); taken {
+			return errors.Subject(EInvalidExchange, ex.Name)
+		}
+
+		existing = &Exchange{Name: ex.Name, Type: ex.Type}
+	} else if existing.Type != ex.Type {
+		return errors.Subject(EInvalidExchange, ex.Name)
+	}
+
+	updated := existing.copy()
+
+	for _, b := range ex.Bindings {
+		if !updated.bound(b) {
+			updated.Bindings = append(updated.Bindings, b)
+		}
+	}
+
+	if r.loops(ex.Name, updated.mailboxes()) {
+		return errors.Subject(EExchangeLoop, ex.Name)
+	}
+
+	if !ok {
+		err := r.routes.Set(ex.Name, &exchangePusher{r, ex.Name})
+		if err != nil {
+			return err
+		}
+	}
+
+	r.exchanges[ex.Name] = updated
+
+	return nil
+}
+
+// Remove the named exchange and its bindings
+func (r *Router) DeleteExchange(name string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.exchanges[name]; !ok {
+		return errors.Subject(EUnknownExchange, name)
+	}
+
+	delete(r.exchanges, name)
+
+	return r.routes.Remove(name)
+}
+
+// Bind a mailbox to the named exchange. Binding the same way twice
+// does nothing.
+func (r *Router) Bind(name string, b *Binding) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	ex, ok := r.exchanges[name]
+	if !ok {
+		return errors.Subject(EUnknownExchange, name)
+	}
+
+	err := ex.checkBinding(b)
+	if err != nil {
+		return err
+	}
+
+	if ex.bound(b) {
+		return nil
+	}
+
+	if r.loops(name, []string{b.Mailbox}) {
+		return errors.Subject(EExchangeLoop, name)
+	}
+
+	updated := ex.copy()
+	updated.Bindings = append(updated.Bindings, b)
+
+	r.exchanges[name] = updated
+
+	return nil
+}
+
+// Remove a binding made with Bind
+func (r *Router) Unbind(name string, b *Binding) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	ex, ok := r.exchanges[name]
+	if !ok {
+		return errors.Subject(EUnknownExchange, name)
+	}
+
+	if b == nil {
+		return errors.Subject(EMalformedFrame, "binding requires a mailbox")
+	}
+
+	updated := ex.copy()
+	updated.Bindings = updated.Bindings[:0]
+
+	for _, x := range ex.Bindings {
+		if !x.equal(b) {
+			updated.Bindings = append(updated.Bindings, x)
+		}
+	}
+
+	r.exchanges[name] = updated
+
+	return nil
+}
+
+// Return the named exchange
+func (r *Router) Exchange(name string) (*Exchange, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	ex, ok := r.exchanges[name]
+	if !ok {
+		return nil, false
+	}
+
+	return ex.copy(), true
+}
+
+// Return the exchanges that have been declared
+func (r *Router) Exchanges() []*Exchange {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var exs []*Exchange
+
+	for _, ex := range r.exchanges {
+		exs = append(exs, ex.copy())
+	}
+
+	return exs
+}
+
+type DeleteExchange struct {
+	Name string
+}
+
+type BindMessage struct {
+	Exchange string
+	Binding  *Binding
+}
+
+type ExchangesResult struct {
+	Exchanges []*Exchange
+}
+
+func (c *Client) DeclareExchange(ex *Exchange) error {
+	return c.DeclareExchangeContext(context.Background(), ex)
+}
+
+// Have the server declare ex, or add ex's bindings to it if it's
+// already declared.
+func (c *Client) DeclareExchangeContext(ctx context.Context, ex *Exchange) error {
+	return c.simpleRequest(ctx, DeclareExchangeType, ex)
+}
+
+func (c *Client) DeleteExchange(name string) error {
+	return c.simpleRequest(context.Background(), DeleteExchangeType, &DeleteExchange{Name: name})
+}
+
+// Bind a mailbox to the named exchange
+func (c *Client) Bind(exchange string, b *Binding) error {
+	return c.simpleRequest(context.Background(), BindType, &BindMessage{exchange, b})
+}
+
+func (c *Client) Unbind(exchange string, b *Binding) error {
+	return c.simpleRequest(context.Background(), UnbindType, &BindMessage{exchange, b})
+}
+
+// Return the exchanges declared on the server
+func (c *Client) Exchanges() ([]*Exchange, error) {
+	resp, err := c.request(context.Background(), ExchangesType, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.Type {
+	case ExchangesResultType:
+		return resp.Exchanges.Exchanges, nil
+	default:
+		return nil, c.checkError(resp.error())
+	}
+}
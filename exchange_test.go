@@ -0,0 +1,232 @@
+package vega
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/errors"
+)
+
+func exchangeRouter(names ...string) (*Router, *Registry) {
+	reg := NewMemRegistry()
+	r := MemRouter()
+
+	for _, name := range names {
+		reg.Declare(name)
+		r.Add(name, reg)
+	}
+
+	return r, reg
+}
+
+func pending(reg *Registry, name string) int {
+	n := 0
+
+	for {
+		del, _ := reg.Poll(name)
+		if del == nil {
+			return n
+		}
+
+		n++
+	}
+}
+
+func TestExchangeTypes(t *testing.T) {
+	r, reg := exchangeRouter("a", "b", "c")
+
+	exs := []*Exchange{
+		{Name: "direct", Type: ExchangeDirect, Bindings: []*Binding{
+			{Mailbox: "a", Key: "red"},
+			{Mailbox: "b", Key: "blue"},
+			{Mailbox: "c", Key: "red"},
+		}},
+		{Name: "fanout", Type: ExchangeFanout, Bindings: []*Binding{
+			{Mailbox: "a"},
+			{Mailbox: "b"},
+		}},
+		{Name: "topic", Type: ExchangeTopic, Bindings: []*Binding{
+			{Mailbox: "a", Key: "order/+/created"},
+			{Mailbox: "b", Key: "order/#"},
+			{Mailbox: "b", Key: "order/1/created"},
+		}},
+		{Name: "headers", Type: ExchangeHeaders, Bindings: []*Binding{
+			{Mailbox: "a", Headers: map[string]string{"format": "pdf", "type": "report"}},
+			{Mailbox: "b", Headers: map[string]string{"format": "pdf", "type": "report"}, MatchAny: true},
+			{Mailbox: "c", Headers: map[string]string{"format": "zip"}, MatchAny: true},
+		}},
+	}
+
+	for _, ex := range exs {
+		require.NoError(t, r.DeclareExchange(ex))
+	}
+
+	cases := []struct {
+		exchange string
+		msg      *Message
+		a, b, c  int
+	}{
+		{"direct", &Message{CorrelationId: "red"}, 1, 0, 1},
+		{"direct", &Message{CorrelationId: "green"}, 0, 0, 0},
+		{"fanout", &Message{CorrelationId: "anything"}, 1, 1, 0},
+		{"topic", &Message{CorrelationId: "order/1/created"}, 1, 1, 0},
+		{"topic", &Message{CorrelationId: "order"}, 0, 1, 0},
+		{"headers", &Message{Headers: map[string]interface{}{"format": "pdf", "type": "report"}}, 1, 1, 0},
+		{"headers", &Message{Headers: map[string]interface{}{"format": "pdf"}}, 0, 1, 0},
+		{"headers", &Message{Headers: map[string]interface{}{"format": "zip"}}, 0, 0, 1},
+	}
+
+	for _, c := range cases {
+		require.NoError(t, r.Push(c.exchange, c.msg))
+
+		assert.Equal(t, c.a, pending(reg, "a"), "%s %#v", c.exchange, c.msg)
+		assert.Equal(t, c.b, pending(reg, "b"), "%s %#v", c.exchange, c.msg)
+		assert.Equal(t, c.c, pending(reg, "c"), "%s %#v", c.exchange, c.msg)
+	}
+}
+
+func TestExchangeFanoutAtomically(t *testing.T) {
+	r, reg := exchangeRouter("a")
+
+	// Routed to reg but never declared there
+	r.Add("missing", reg)
+
+	other := NewMemRegistry()
+	other.Declare("b")
+	r.Add("b", other)
+
+	require.NoError(t, r.DeclareExchange(&Exchange{Name: "local", Type: ExchangeFanout, Bindings: []*Binding{
+		{Mailbox: "a"},
+		{Mailbox: "missing"},
+	}}))
+
+	err := r.Push("local", Msg("hello"))
+	assert.True(t, errors.Equal(err, ENoMailbox))
+
+	assert.Equal(t, 0, pending(reg, "a"), "pushed to some of the mailboxes")
+
+	// Mailboxes in different storage are pushed to one at a time, with
+	// an id so that retries can be dropped.
+	require.NoError(t, r.DeclareExchange(&Exchange{Name: "split", Type: ExchangeFanout, Bindings: []*Binding{
+		{Mailbox: "a"},
+		{Mailbox: "b"},
+	}}))
+
+	require.NoError(t, r.Push("split", Msg("hello")))
+
+	da, err := reg.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, da)
+
+	db, err := other.Poll("b")
+	require.NoError(t, err)
+	require.NotNil(t, db)
+
+	assert.NotEqual(t, "", da.Message.DedupId())
+	assert.Equal(t, da.Message.DedupId(), db.Message.DedupId())
+}
+
+func TestExchangeBindings(t *testing.T) {
+	r, reg := exchangeRouter("a", "b")
+
+	require.NoError(t, r.DeclareExchange(&Exchange{Name: "events", Type: ExchangeDirect}))
+
+	require.NoError(t, r.Bind("events", &Binding{Mailbox: "a", Key: "x"}))
+	require.NoError(t, r.Bind("events", &Binding{Mailbox: "a", Key: "x"}))
+
+	// Declaring again keeps the bindings and adds the new ones
+	err := r.DeclareExchange(&Exchange{Name: "events", Type: ExchangeDirect, Bindings: []*Binding{
+		{Mailbox: "b", Key: "x"},
+	}})
+	require.NoError(t, err)
+
+	ex, ok := r.Exchange("events")
+	require.True(t, ok)
+	assert.Equal(t, 2, len(ex.Bindings))
+
+	require.NoError(t, r.Push("events", &Message{CorrelationId: "x"}))
+
+	assert.Equal(t, 1, pending(reg, "a"))
+	assert.Equal(t, 1, pending(reg, "b"))
+
+	require.NoError(t, r.Unbind("events", &Binding{Mailbox: "a", Key: "x"}))
+
+	require.NoError(t, r.Push("events", &Message{CorrelationId: "x"}))
+
+	assert.Equal(t, 0, pending(reg, "a"))
+	assert.Equal(t, 1, pending(reg, "b"))
+
+	err = r.DeclareExchange(&Exchange{Name: "events", Type: ExchangeFanout})
+	assert.True(t, errors.Equal(EInvalidExchange, err), "changed the type")
+
+	err = r.DeclareExchange(&Exchange{Name: "a", Type: ExchangeFanout})
+	assert.True(t, errors.Equal(EInvalidExchange, err), "took a mailbox's name")
+
+	err = r.DeclareExchange(&Exchange{Name: "other", Type: "random"})
+	assert.True(t, errors.Equal(EInvalidExchange, err))
+
+	err = r.Bind("missing", &Binding{Mailbox: "a"})
+	assert.True(t, errors.Equal(EUnknownExchange, err))
+
+	require.NoError(t, r.DeclareExchange(&Exchange{Name: "topics", Type: ExchangeTopic}))
+
+	err = r.Bind("topics", &Binding{Mailbox: "a", Key: "x/#/y"})
+	assert.True(t, errors.Equal(ESubscriptionPattern, err))
+
+	// Bound to itself, a push to it would never end
+	require.NoError(t, r.DeclareExchange(&Exchange{Name: "loop", Type: ExchangeFanout}))
+
+	err = r.Bind("loop", &Binding{Mailbox: "loop"})
+	assert.True(t, errors.Equal(EExchangeLoop, err))
+
+	err = r.DeclareExchange(&Exchange{Name: "loop", Type: ExchangeFanout, Bindings: []*Binding{
+		{Mailbox: "loop"},
+	}})
+	assert.True(t, errors.Equal(EExchangeLoop, err))
+
+	// Or through another exchange or an alias
+	require.NoError(t, r.DeclareExchange(&Exchange{Name: "other", Type: ExchangeFanout, Bindings: []*Binding{
+		{Mailbox: "loop"},
+	}}))
+
+	err = r.Bind("loop", &Binding{Mailbox: "other"})
+	assert.True(t, errors.Equal(EExchangeLoop, err))
+
+	require.NoError(t, r.SetAlias(&Alias{Name: "to-loop", Targets: []string{"loop"}}))
+
+	err = r.Bind("loop", &Binding{Mailbox: "to-loop"})
+	assert.True(t, errors.Equal(EExchangeLoop, err))
+
+	require.NoError(t, r.DeleteExchange("other"))
+	require.NoError(t, r.DeleteExchange("loop"))
+	require.NoError(t, r.RemoveAlias("to-loop"))
+
+	require.NoError(t, r.DeleteExchange("events"))
+
+	_, ok = r.Exchange("events")
+	assert.False(t, ok)
+
+	assert.Equal(t, ENoMailbox, r.Push("events", &Message{CorrelationId: "x"}))
+	assert.Equal(t, 1, len(r.Exchanges()))
+}
+
+func TestExchangeLoopThroughAnotherRouter(t *testing.T) {
+	// A loop through another router can only be caught as it happens
+	r1, _ := exchangeRouter()
+	r2, _ := exchangeRouter()
+
+	r1.Add("y", r2)
+	r2.Add("x", r1)
+
+	require.NoError(t, r1.DeclareExchange(&Exchange{Name: "x", Type: ExchangeFanout, Bindings: []*Binding{
+		{Mailbox: "y"},
+	}}))
+
+	require.NoError(t, r2.DeclareExchange(&Exchange{Name: "y", Type: ExchangeFanout, Bindings: []*Binding{
+		{Mailbox: "x"},
+	}}))
+
+	err := r1.Push("x", Msg("hello"))
+	assert.True(t, errors.Equal(EExchangeLoop, err))
+}
@@ -1,7 +1,9 @@
 package vega
 
 import (
+	"context"
 	"fmt"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -18,8 +20,16 @@ func Dial(addr string) (*FeatureClient, error) {
 	}, nil
 }
 
+// Connect to the vegad running on the local machine. If vegad is
+// listening on DefaultSocketPath, that is used rather than the tcp port.
 func Local() (*FeatureClient, error) {
-	client, err := NewInsecureClient(fmt.Sprintf("127.0.0.1:%d", DefaultPort))
+	addr := fmt.Sprintf("127.0.0.1:%d", DefaultPort)
+
+	if fi, err := os.Stat(DefaultSocketPath); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		addr = cUnixPrefix + DefaultSocketPath
+	}
+
+	client, err := NewInsecureClient(addr)
 	if err != nil {
 		return nil, err
 	}
@@ -52,6 +62,40 @@ func HandlerFunc(h func(*Message) *Message) Handler {
 
 // type Handler func(*Message) *Message
 
+// A Handler that passes each message to the Handler registered for its
+// Type, or to Default if there isn't one. Messages with no handler are
+// dropped without a reply.
+type Dispatcher struct {
+	Default Handler
+
+	handlers map[string]Handler
+}
+
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{handlers: make(map[string]Handler)}
+}
+
+// Register h to handle messages of type typ
+func (d *Dispatcher) Handle(typ string, h Handler) {
+	d.handlers[typ] = h
+}
+
+func (d *Dispatcher) HandleFunc(typ string, h func(*Message) *Message) {
+	d.Handle(typ, HandlerFunc(h))
+}
+
+func (d *Dispatcher) HandleMessage(m *Message) *Message {
+	if h, ok := d.handlers[m.Type]; ok {
+		return h.HandleMessage(m)
+	}
+
+	if d.Default != nil {
+		return d.Default.HandleMessage(m)
+	}
+
+	return nil
+}
+
 // Wraps Client to provide highlevel behaviors that build on the basics
 // of the distributed mailboxes. Should only be used by one goroutine
 // at a time.
@@ -101,8 +145,15 @@ func (fc *FeatureClient) Declare(name string) error {
 }
 
 func (fc *FeatureClient) HandleRequests(name string, h Handler) error {
+	return fc.HandleRequestsContext(context.Background(), name, h)
+}
+
+// Handle requests sent to the named mailbox until ctx is done, at which
+// point ctx's error is returned. No reply is sent for requests h returns
+// nil for.
+func (fc *FeatureClient) HandleRequestsContext(ctx context.Context, name string, h Handler) error {
 	for {
-		del, err := fc.LongPoll(name, 1*time.Minute)
+		del, err := fc.LongPollContext(ctx, name, 1*time.Minute)
 		if err != nil {
 			return err
 		}
@@ -117,20 +168,42 @@ func (fc *FeatureClient) HandleRequests(name string, h Handler) error {
 
 		del.Ack()
 
-		fc.Push(msg.ReplyTo, ret)
+		// Nothing handled it or nobody is waiting on a reply
+		if ret == nil || msg.ReplyTo == "" {
+			continue
+		}
+
+		fc.PushContext(ctx, msg.ReplyTo, ret)
 	}
 }
 
+// Handle requests sent to the named mailbox with the Handler d has
+// registered for their type.
+func (fc *FeatureClient) Dispatch(name string, d *Dispatcher) error {
+	return fc.HandleRequests(name, d)
+}
+
+// Dispatch requests until ctx is done. See Dispatch.
+func (fc *FeatureClient) DispatchContext(ctx context.Context, name string, d *Dispatcher) error {
+	return fc.HandleRequestsContext(ctx, name, d)
+}
+
 func (fc *FeatureClient) Request(name string, msg *Message) (*Delivery, error) {
+	return fc.RequestContext(context.Background(), name, msg)
+}
+
+// Send msg to the named mailbox and wait for the reply. If ctx is done
+// before the reply arrives, ctx's error is returned.
+func (fc *FeatureClient) RequestContext(ctx context.Context, name string, msg *Message) (*Delivery, error) {
 	msg.ReplyTo = fc.LocalMailbox()
 
-	err := fc.Push(name, msg)
+	err := fc.PushContext(ctx, name, msg)
 	if err != nil {
 		return nil, err
 	}
 
 	for {
-		resp, err := fc.LongPoll(msg.ReplyTo, 1*time.Minute)
+		resp, err := fc.LongPollContext(ctx, msg.ReplyTo, 1*time.Minute)
 		if err != nil {
 			return nil, err
 		}
@@ -150,42 +223,129 @@ type Receiver struct {
 	// Any error detected while receiving
 	Error error
 
-	shutdown chan struct{}
+	cancel context.CancelFunc
 }
 
+// Stop receiving. Channel is closed once any in progress poll has
+// been aborted.
 func (rec *Receiver) Close() error {
-	close(rec.shutdown)
+	rec.cancel()
 	return nil
 }
 
 func (fc *FeatureClient) Receive(name string) *Receiver {
+	return fc.ReceiveContext(context.Background(), name)
+}
+
+// Deliver messages from the named mailbox on the returned Receiver's
+// Channel until ctx is done or the Receiver is closed. A message that
+// arrives after that is nack'd.
+func (fc *FeatureClient) ReceiveContext(ctx context.Context, name string) *Receiver {
 	c := make(chan *Delivery)
 
-	rec := &Receiver{c, nil, make(chan struct{})}
+	ctx, cancel := context.WithCancel(ctx)
+
+	rec := &Receiver{Channel: c, cancel: cancel}
 
 	go func() {
+		defer close(c)
+
 		for {
-			select {
-			case <-rec.shutdown:
-				close(c)
-				return
-			default:
-				// We don't cancel this action if Receive is told to Close. Instead
-				// we let it timeout and then detect the shutdown request and exit.
-				msg, err := fc.Client.LongPoll(name, 1*time.Minute)
-				if err != nil {
-					close(c)
-					return
+			msg, err := fc.Client.LongPollContext(ctx, name, 1*time.Minute)
+			if err != nil {
+				if ctx.Err() == nil {
+					rec.Error = err
 				}
 
-				if msg == nil {
-					continue
-				}
+				return
+			}
 
-				c <- msg
+			if msg == nil {
+				continue
+			}
+
+			select {
+			case c <- msg:
+			case <-ctx.Done():
+				msg.Nack()
+				return
 			}
 		}
 	}()
 
 	return rec
 }
+
+// Publish msg to every mailbox subscribed to a pattern matching topic
+func (fc *FeatureClient) Publish(topic string, msg *Message) error {
+	return fc.PublishContext(context.Background(), topic, msg)
+}
+
+// Publish msg to topic, giving up if ctx is done first.
+func (fc *FeatureClient) PublishContext(ctx context.Context, topic string, msg *Message) error {
+	msg.CorrelationId = topic
+
+	return fc.PushContext(ctx, ":publish", msg)
+}
+
+// A Receiver for the messages published to topics matching a pattern.
+// The messages are collected in an ephemeral mailbox that is dropped
+// when the Subscriber is closed.
+type Subscriber struct {
+	*Receiver
+
+	// The ephemeral mailbox messages are delivered to
+	Mailbox string
+
+	Pattern string
+
+	fc *FeatureClient
+}
+
+// Stop receiving, unsubscribe and abandon the mailbox.
+func (s *Subscriber) Close() error {
+	s.Receiver.Close()
+
+	err := s.fc.Push(":unsubscribe", &Message{ReplyTo: s.Mailbox, CorrelationId: s.Pattern})
+
+	aerr := s.fc.Abandon(s.Mailbox)
+	if err == nil {
+		err = aerr
+	}
+
+	return err
+}
+
+func (fc *FeatureClient) Subscribe(pattern string) (*Subscriber, error) {
+	return fc.SubscribeContext(context.Background(), pattern)
+}
+
+// Subscribe a new ephemeral mailbox to pattern and deliver the messages
+// published to it on the returned Subscriber's Channel until ctx is
+// done or the Subscriber is closed.
+func (fc *FeatureClient) SubscribeContext(ctx context.Context, pattern string) (*Subscriber, error) {
+	err := CheckPattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	name := RandomMailbox()
+
+	err = fc.EphemeralDeclare(name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fc.PushContext(ctx, ":subscribe", SubscribeMessage(name, pattern, nil))
+	if err != nil {
+		fc.Abandon(name)
+		return nil, err
+	}
+
+	return &Subscriber{
+		Receiver: fc.ReceiveContext(ctx, name),
+		Mailbox:  name,
+		Pattern:  pattern,
+		fc:       fc,
+	}, nil
+}
@@ -1,6 +1,7 @@
 package vega
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/sha256"
@@ -318,6 +319,12 @@ func (p *PipeConn) SendBulk(data io.Reader) (int64, error) {
 }
 
 func (fc *FeatureClient) ListenPipe(name string) (*PipeConn, error) {
+	return fc.ListenPipeContext(context.Background(), name)
+}
+
+// Wait for a peer to connect to the named pipe. If ctx is done first,
+// ctx's error is returned.
+func (fc *FeatureClient) ListenPipeContext(ctx context.Context, name string) (*PipeConn, error) {
 	q := "pipe:" + name
 	err := fc.Declare(q)
 	if err != nil {
@@ -325,7 +332,7 @@ func (fc *FeatureClient) ListenPipe(name string) (*PipeConn, error) {
 	}
 
 	for {
-		resp, err := fc.LongPoll(q, 1*time.Minute)
+		resp, err := fc.LongPollContext(ctx, q, 1*time.Minute)
 		if err != nil {
 			return nil, err
 		}
@@ -378,6 +385,12 @@ func (fc *FeatureClient) ListenPipe(name string) (*PipeConn, error) {
 }
 
 func (fc *FeatureClient) ConnectPipe(name string) (*PipeConn, error) {
+	return fc.ConnectPipeContext(context.Background(), name)
+}
+
+// Connect to the named pipe. If ctx is done before the listener
+// answers, ctx's error is returned.
+func (fc *FeatureClient) ConnectPipeContext(ctx context.Context, name string) (*PipeConn, error) {
 	ownM := RandomMailbox()
 	fc.EphemeralDeclare(ownM)
 
@@ -388,7 +401,7 @@ func (fc *FeatureClient) ConnectPipe(name string) (*PipeConn, error) {
 
 	q := "pipe:" + name
 
-	err := fc.Push(q, &msg)
+	err := fc.PushContext(ctx, q, &msg)
 	if err != nil {
 		fc.Abandon(ownM)
 		return nil, err
@@ -396,8 +409,9 @@ func (fc *FeatureClient) ConnectPipe(name string) (*PipeConn, error) {
 
 	for {
 		debugf("waiting on %s for handshake", ownM)
-		resp, err := fc.LongPoll(ownM, 1*time.Minute)
+		resp, err := fc.LongPollContext(ctx, ownM, 1*time.Minute)
 		if err != nil {
+			fc.Abandon(ownM)
 			return nil, err
 		}
 
@@ -2,7 +2,9 @@ package vega
 
 import (
 	"bytes"
+	"context"
 	"io"
+	"net"
 	"runtime"
 	"sync"
 	"testing"
@@ -171,6 +173,97 @@ func TestFeatureClientRequestReply(t *testing.T) {
 	assert.True(t, bytes.Equal(resp.Message.Body, []byte("hey!")), "wrong message")
 }
 
+func TestFeatureClientRequestContext(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc.Declare("a")
+
+	// No one is handling requests on a, so only the deadline ends this.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err = fc.RequestContext(ctx, "a", Msg("hello"))
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	hctx, hcancel := context.WithCancel(context.Background())
+
+	done := make(chan error)
+
+	go func() {
+		done <- fc.HandleRequestsContext(hctx, "a", HandlerFunc(func(req *Message) *Message {
+			return Msg("hey!")
+		}))
+	}()
+
+	hcancel()
+
+	select {
+	case err := <-done:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(1 * time.Second):
+		t.Fatal("HandleRequestsContext didn't return when canceled")
+	}
+}
+
+func TestFeatureClientReceiveContext(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc.Declare("a")
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	rc := fc.ReceiveContext(ctx, "a")
+
+	cancel()
+
+	select {
+	case _, ok := <-rc.Channel:
+		assert.False(t, ok, "channel should be closed")
+	case <-time.After(1 * time.Second):
+		t.Fatal("channel wasn't closed after cancel")
+	}
+
+	assert.NoError(t, rc.Error)
+
+	// Nothing is left polling a, so a plain Poll sees the message.
+	msg := Msg("hello")
+
+	fc.Push("a", msg)
+
+	got, err := fc.Poll("a")
+	if err != nil {
+		panic(err)
+	}
+
+	assert.True(t, msg.Equal(got.Message), "wrong message")
+}
+
 func TestFeatureClientPipe(t *testing.T) {
 	serv, err := NewMemService(cPort)
 	if err != nil {
@@ -889,3 +982,201 @@ func TestFeatureClientPipeDetectsClosure(t *testing.T) {
 		assert.Equal(t, err, io.EOF)
 	}
 }
+
+func TestFeatureClientDispatch(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	fc, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc.Close()
+
+	fc2, err := Dial(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer fc2.Close()
+
+	fc.Declare("a")
+
+	d := NewDispatcher()
+
+	d.HandleFunc("invoice.created", func(req *Message) *Message {
+		return Msg("created " + string(req.Body))
+	})
+
+	d.HandleFunc("invoice.paid", func(req *Message) *Message {
+		return Msg("paid " + string(req.Body))
+	})
+
+	d.Default = HandlerFunc(func(req *Message) *Message {
+		return Msg("unknown " + req.Type)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go fc.DispatchContext(ctx, "a", d)
+
+	cases := []struct {
+		typ, body, reply string
+	}{
+		{"invoice.created", "1", "created 1"},
+		{"invoice.paid", "2", "paid 2"},
+		{"invoice.void", "3", "unknown invoice.void"},
+	}
+
+	for _, c := range cases {
+		req := Msg(c.body)
+		req.Type = c.typ
+
+		resp, err := fc2.Request("a", req)
+		if err != nil {
+			panic(err)
+		}
+
+		assert.Equal(t, c.reply, string(resp.Message.Body))
+	}
+}
+
+// Collects what is written to it, safe to read while being written
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Contains(s string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return bytes.Contains(b.buf.Bytes(), []byte(s))
+}
+
+func TestFeatureClientDispatchUnhandledSendsNothing(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.AcceptInsecure()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+
+	defer l.Close()
+
+	var sent lockedBuffer
+
+	// Records everything the dispatching client sends to the server
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		up, err := net.Dial("tcp", cPort)
+		if err != nil {
+			return
+		}
+
+		defer up.Close()
+
+		go func() {
+			io.Copy(conn, up)
+			conn.Close()
+		}()
+
+		io.Copy(up, io.TeeReader(conn, &sent))
+	}()
+
+	client, err := NewInsecureClient(l.Addr().String())
+	if err != nil {
+		panic(err)
+	}
+
+	fc := &FeatureClient{Client: client}
+
+	defer fc.Close()
+
+	client2, err := NewInsecureClient(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	fc2 := &FeatureClient{Client: client2}
+
+	defer fc2.Close()
+
+	fc.Declare("a")
+	fc2.Declare("replies")
+	fc2.Declare("void.replies")
+
+	d := NewDispatcher()
+
+	d.HandleFunc("invoice.created", func(req *Message) *Message {
+		return Msg("created " + string(req.Body))
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go fc.DispatchContext(ctx, "a", d)
+
+	req := Msg("1")
+	req.Type = "invoice.void"
+	req.ReplyTo = "void.replies"
+
+	err = fc2.Push("a", req)
+	if err != nil {
+		panic(err)
+	}
+
+	req = Msg("2")
+	req.Type = "invoice.created"
+	req.ReplyTo = "replies"
+
+	err = fc2.Push("a", req)
+	if err != nil {
+		panic(err)
+	}
+
+	// Requests are handled in order, so once the second is answered
+	// the first one is done with too.
+	resp, err := fc2.LongPoll("replies", 5*time.Second)
+	if err != nil {
+		panic(err)
+	}
+
+	assert.Equal(t, "created 2", string(resp.Message.Body))
+
+	resp, err = fc2.Poll("void.replies")
+	if err != nil {
+		panic(err)
+	}
+
+	assert.Nil(t, resp)
+
+	assert.True(t, sent.Contains("replies"))
+	assert.False(t, sent.Contains("void.replies"))
+}
@@ -0,0 +1,174 @@
+package vega
+
+import (
+	"io"
+
+	"github.com/vektra/errors"
+)
+
+// How deeply maps and arrays may be nested within a frame
+const maxFrameDepth = 32
+
+// frameReader copies a single msgpack encoded value from r into buf,
+// checking every length against limit before reading or allocating
+// anything. This keeps a client from making us allocate huge buffers
+// by lying about the length of a string or collection.
+type frameReader struct {
+	r     io.Reader
+	buf   []byte
+	limit int
+}
+
+func readFrame(r io.Reader, limit int) ([]byte, error) {
+	fr := &frameReader{r: r, limit: limit}
+
+	err := fr.value(0)
+	if err != nil {
+		return nil, err
+	}
+
+	return fr.buf, nil
+}
+
+func (fr *frameReader) read(n int) ([]byte, error) {
+	if n < 0 || n > fr.limit-len(fr.buf) {
+		return nil, EFrameTooLarge
+	}
+
+	start := len(fr.buf)
+
+	fr.buf = append(fr.buf, make([]byte, n)...)
+
+	_, err := io.ReadFull(fr.r, fr.buf[start:])
+	if err != nil {
+		return nil, err
+	}
+
+	return fr.buf[start:], nil
+}
+
+func (fr *frameReader) length(size int) (int, error) {
+	b, err := fr.read(size)
+	if err != nil {
+		return 0, err
+	}
+
+	var n uint64
+
+	for _, x := range b {
+		n = n<<8 | uint64(x)
+	}
+
+	if n > uint64(fr.limit) {
+		return 0, EFrameTooLarge
+	}
+
+	return int(n), nil
+}
+
+func (fr *frameReader) values(n, depth int) error {
+	// Every value takes at least one byte, so we can reject
+	// impossible counts up front.
+	if n > fr.limit-len(fr.buf) {
+		return EFrameTooLarge
+	}
+
+	for i := 0; i < n; i++ {
+		if err := fr.value(depth + 1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (fr *frameReader) sized(size, extra int) error {
+	n, err := fr.length(size)
+	if err != nil {
+		return err
+	}
+
+	_, err = fr.read(n + extra)
+	return err
+}
+
+func (fr *frameReader) value(depth int) error {
+	if depth > maxFrameDepth {
+		return errors.Subject(EMalformedFrame, "nested too deeply")
+	}
+
+	b, err := fr.read(1)
+	if err != nil {
+		return err
+	}
+
+	c := b[0]
+
+	switch {
+	case c <= 0x7f, c >= 0xe0:
+		// fixint
+		return nil
+	case c <= 0x8f:
+		return fr.values(2*int(c&0x0f), depth)
+	case c <= 0x9f:
+		return fr.values(int(c&0x0f), depth)
+	case c <= 0xbf:
+		_, err = fr.read(int(c & 0x1f))
+		return err
+	}
+
+	switch c {
+	case 0xc0, 0xc2, 0xc3:
+		return nil
+	case 0xc4, 0xd9:
+		return fr.sized(1, 0)
+	case 0xc5, 0xda:
+		return fr.sized(2, 0)
+	case 0xc6, 0xdb:
+		return fr.sized(4, 0)
+	case 0xc7:
+		return fr.sized(1, 1)
+	case 0xc8:
+		return fr.sized(2, 1)
+	case 0xc9:
+		return fr.sized(4, 1)
+	case 0xcc, 0xd0:
+		_, err = fr.read(1)
+	case 0xcd, 0xd1:
+		_, err = fr.read(2)
+	case 0xca, 0xce, 0xd2:
+		_, err = fr.read(4)
+	case 0xcb, 0xcf, 0xd3:
+		_, err = fr.read(8)
+	case 0xd4:
+		_, err = fr.read(2)
+	case 0xd5:
+		_, err = fr.read(3)
+	case 0xd6:
+		_, err = fr.read(5)
+	case 0xd7:
+		_, err = fr.read(9)
+	case 0xd8:
+		_, err = fr.read(17)
+	case 0xdc, 0xdd, 0xde, 0xdf:
+		size := 2
+		if c == 0xdd || c == 0xdf {
+			size = 4
+		}
+
+		n, err := fr.length(size)
+		if err != nil {
+			return err
+		}
+
+		if c == 0xde || c == 0xdf {
+			n *= 2
+		}
+
+		return fr.values(n, depth)
+	default:
+		return errors.Subject(EMalformedFrame, "invalid msgpack type")
+	}
+
+	return err
+}
@@ -0,0 +1,48 @@
+package vega
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ugorji/go/codec"
+)
+
+func TestReadFrame(t *testing.T) {
+	var body []byte
+
+	err := codec.NewEncoderBytes(&body, &msgpack).Encode(&Push{Name: "a", Message: Msg("hello")})
+	require.NoError(t, err)
+
+	trailing := append(append([]byte{}, body...), uint8(PollType))
+
+	r := bytes.NewReader(trailing)
+
+	frame, err := readFrame(r, 1024)
+	require.NoError(t, err)
+
+	assert.Equal(t, body, frame)
+	assert.Equal(t, 1, r.Len(), "read past the end of the frame")
+}
+
+func TestReadFrameRejectsLyingLength(t *testing.T) {
+	// a str32 claiming to be 2GB long
+	data := []byte{0xdb, 0x7f, 0xff, 0xff, 0xf0, 'a'}
+
+	_, err := readFrame(bytes.NewReader(data), 1024)
+	assert.Equal(t, EFrameTooLarge, err)
+
+	// a map32 claiming 2 billion entries
+	data = []byte{0xdf, 0x7f, 0xff, 0xff, 0xf0, 0x01}
+
+	_, err = readFrame(bytes.NewReader(data), 1024)
+	assert.Equal(t, EFrameTooLarge, err)
+}
+
+func TestReadFrameRejectsDeepNesting(t *testing.T) {
+	data := bytes.Repeat([]byte{0x91}, maxFrameDepth+2)
+
+	_, err := readFrame(bytes.NewReader(data), 1024)
+	assert.Error(t, err)
+}
@@ -4,12 +4,14 @@ import (
 	"encoding/json"
 	"net"
 	"net/http"
+	"os"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/bmizerany/pat"
 	"github.com/ugorji/go/codec"
+	"github.com/vektra/errors"
 )
 
 var DefaultHTTPPort = 8477
@@ -26,9 +28,14 @@ type HTTPService struct {
 	Address  string
 	Registry Storage
 
-	listener net.Listener
-	server   *http.Server
-	mux      *pat.PatternServeMux
+	// The exclusive consumer locks on mailboxes. Share these with a
+	// Service serving the same Registry.
+	Locks *ConsumerLocks
+
+	listener     net.Listener
+	unixListener net.Listener
+	server       *http.Server
+	mux          *pat.PatternServeMux
 
 	defaultLease time.Duration
 	lock         sync.Mutex
@@ -36,19 +43,23 @@ type HTTPService struct {
 
 	background chan struct{}
 
-	wg   sync.WaitGroup
-	done chan struct{}
+	wg     sync.WaitGroup
+	done   chan struct{}
+	drain  chan struct{}
+	closed bool
 }
 
 func NewHTTPService(port string, reg Storage) *HTTPService {
 	h := &HTTPService{
 		Address:      port,
 		Registry:     reg,
+		Locks:        NewConsumerLocks(),
 		mux:          pat.New(),
 		defaultLease: 5 * time.Minute,
 		inflight:     make(map[MessageId]*inflightDelivery),
 		background:   make(chan struct{}, 3),
 		done:         make(chan struct{}),
+		drain:        make(chan struct{}),
 	}
 
 	h.mux.Post("/mailbox/:name", http.HandlerFunc(h.declare))
@@ -59,6 +70,25 @@ func NewHTTPService(port string, reg Storage) *HTTPService {
 	h.mux.Add("DELETE", "/message/:id", http.HandlerFunc(h.ack))
 	h.mux.Put("/message/:id", http.HandlerFunc(h.nack))
 
+	h.mux.Add("DELETE", "/messages", http.HandlerFunc(h.ackMany))
+	h.mux.Put("/messages", http.HandlerFunc(h.nackMany))
+
+	h.mux.Get("/subscriptions", http.HandlerFunc(h.subscriptions))
+
+	h.mux.Get("/exchanges", http.HandlerFunc(h.exchanges))
+	h.mux.Post("/exchange/:name", http.HandlerFunc(h.declareExchange))
+	h.mux.Add("DELETE", "/exchange/:name", http.HandlerFunc(h.deleteExchange))
+	h.mux.Put("/exchange/:name/binding", http.HandlerFunc(h.bind))
+	h.mux.Add("DELETE", "/exchange/:name/binding", http.HandlerFunc(h.unbind))
+
+	h.mux.Get("/aliases", http.HandlerFunc(h.aliases))
+	h.mux.Put("/alias/:name", http.HandlerFunc(h.setAlias))
+	h.mux.Add("DELETE", "/alias/:name", http.HandlerFunc(h.removeAlias))
+
+	h.mux.Get("/type-routes", http.HandlerFunc(h.typeRoutes))
+	h.mux.Put("/type-route/:name", http.HandlerFunc(h.setTypeRoute))
+	h.mux.Add("DELETE", "/type-route/:name", http.HandlerFunc(h.removeTypeRoute))
+
 	s := &http.Server{
 		Addr:           port,
 		Handler:        h.mux,
@@ -153,15 +183,39 @@ func (h *HTTPService) Listen() error {
 	return nil
 }
 
+// Listen on the unix domain socket at path in addition to Address.
+// The socket file is given the permissions in perm.
+func (h *HTTPService) ListenUnix(path string, perm os.FileMode) error {
+	l, err := listenUnix(path, perm)
+	if err != nil {
+		return err
+	}
+
+	h.unixListener = l
+	return nil
+}
+
 func (h *HTTPService) Close() {
 	h.lock.Lock()
 
+	if h.closed {
+		h.lock.Unlock()
+		return
+	}
+
+	h.closed = true
+
 	close(h.done)
+	h.stopDeliveries()
 
 	if h.listener != nil {
 		h.listener.Close()
 	}
 
+	if h.unixListener != nil {
+		h.unixListener.Close()
+	}
+
 	for _, inf := range h.inflight {
 		inf.delivery.Nack()
 	}
@@ -171,10 +225,59 @@ func (h *HTTPService) Close() {
 	h.wg.Wait()
 }
 
+// Stop handing out messages and give clients up to grace to ack or
+// nack the messages they have leased before closing the service.
+// Requests continue to be served while draining so that acks and nacks
+// can come in, but polls fail with 503.
+func (h *HTTPService) Drain(grace time.Duration) {
+	h.lock.Lock()
+	h.stopDeliveries()
+	h.lock.Unlock()
+
+	deadline := time.Now().Add(grace)
+
+	for time.Now().Before(deadline) {
+		h.lock.Lock()
+		left := len(h.inflight)
+		h.lock.Unlock()
+
+		if left == 0 {
+			break
+		}
+
+		time.Sleep(drainCheckInterval)
+	}
+
+	h.Close()
+}
+
+// Abort long polls and refuse new ones. Must be called with h.lock held.
+func (h *HTTPService) stopDeliveries() {
+	select {
+	case <-h.drain:
+	default:
+		close(h.drain)
+	}
+}
+
+func (h *HTTPService) draining() bool {
+	select {
+	case <-h.drain:
+		return true
+	default:
+		return false
+	}
+}
+
 func (h *HTTPService) Accept() error {
 	return h.server.Serve(&gracefulListener{h.listener, &h.wg})
 }
 
+// Serve requests arriving on the unix domain socket setup by ListenUnix
+func (h *HTTPService) AcceptUnix() error {
+	return h.server.Serve(&gracefulListener{h.unixListener, &h.wg})
+}
+
 func (h *HTTPService) declare(rw http.ResponseWriter, req *http.Request) {
 	name := req.URL.Query().Get(":name")
 
@@ -234,7 +337,8 @@ func (h *HTTPService) push(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	err = h.Registry.Push(name, &msg)
+	// Only nodes may say where a message has been
+	err = h.Registry.Push(name, msg.untraced())
 	if err != nil {
 		rw.WriteHeader(500)
 		rw.Write([]byte(err.Error()))
@@ -247,17 +351,63 @@ func (h *HTTPService) poll(rw http.ResponseWriter, req *http.Request) {
 	var err error
 	var del *Delivery
 
+	if h.draining() {
+		rw.WriteHeader(503)
+		rw.Write([]byte(EDraining.Error()))
+		return
+	}
+
+	dur := h.defaultLease
+
+	lease := req.URL.Query().Get("lease")
+	if lease != "" {
+		d, err := time.ParseDuration(lease)
+		if err == nil {
+			dur = d
+		}
+	}
+
+	var til time.Duration
+
 	wait := req.URL.Query().Get("wait")
 	if wait != "" {
-		dur, err := time.ParseDuration(wait)
+		til, err = time.ParseDuration(wait)
 
 		if err != nil {
 			rw.WriteHeader(500)
 			rw.Write([]byte(err.Error()))
 			return
 		}
+	}
+
+	// A consumer that polls with exclusive=<id> takes the mailbox's lock
+	// for the lease, renewing it with each poll. If the lock is held by
+	// someone else and wait is given, the poll waits for it as a standby.
+	consumer := req.URL.Query().Get("exclusive")
+
+	if consumer != "" {
+		start := time.Now()
+
+		if til > 0 {
+			err = h.Locks.Wait(name, consumer, dur+til, til, h.drain)
+		} else {
+			err = h.Locks.Acquire(name, consumer, dur)
+		}
 
-		del, err = h.Registry.LongPollCancelable(name, dur, h.done)
+		// what's left of the wait goes to polling
+		til -= time.Since(start)
+	} else {
+		err = h.Locks.Check(name, "")
+	}
+
+	if err != nil {
+		rw.WriteHeader(409)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	if wait != "" && til > 0 {
+		del, err = h.Registry.LongPollCancelable(name, til, h.drain)
 	} else {
 		del, err = h.Registry.Poll(name)
 	}
@@ -292,16 +442,6 @@ func (h *HTTPService) poll(rw http.ResponseWriter, req *http.Request) {
 
 	h.lock.Lock()
 
-	dur := h.defaultLease
-
-	lease := req.URL.Query().Get("lease")
-	if lease != "" {
-		d, err := time.ParseDuration(lease)
-		if err == nil {
-			dur = d
-		}
-	}
-
 	expires := time.Now().Add(dur)
 
 	h.inflight[del.Message.MessageId] = &inflightDelivery{del, expires}
@@ -339,6 +479,11 @@ func (h *HTTPService) ack(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if req.URL.Query().Get("through") != "" {
+		h.ackThrough(rw, req, del.delivery)
+		return
+	}
+
 	err := del.delivery.Ack()
 
 	if err != nil {
@@ -347,6 +492,310 @@ func (h *HTTPService) ack(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// Write out the active subscriptions, if the Registry has any
+func (h *HTTPService) subscriptions(rw http.ResponseWriter, req *http.Request) {
+	lister, ok := h.Registry.(SubscriptionLister)
+	if !ok {
+		rw.WriteHeader(404)
+		return
+	}
+
+	encodeBody(rw, req, lister.Subscriptions())
+}
+
+// Write out the exchanges, if the Registry manages any
+func (h *HTTPService) exchanges(rw http.ResponseWriter, req *http.Request) {
+	em, ok := h.Registry.(ExchangeManager)
+	if !ok {
+		rw.WriteHeader(404)
+		return
+	}
+
+	encodeBody(rw, req, &ExchangesResult{em.Exchanges()})
+}
+
+// Decode the request body, as msgpack or json depending on its
+// Content-Type, into v.
+func decodeBody(req *http.Request, v interface{}) error {
+	if req.Header.Get("Content-Type") == ctMsgPack {
+		return codec.NewDecoder(req.Body, &msgpack).Decode(v)
+	}
+
+	return json.NewDecoder(req.Body).Decode(v)
+}
+
+// Decode the request body into v, writing out the error if it can't be
+func readBody(rw http.ResponseWriter, req *http.Request, v interface{}) bool {
+	err := decodeBody(req, v)
+	if err != nil {
+		rw.WriteHeader(400)
+		rw.Write([]byte(err.Error()))
+		return false
+	}
+
+	return true
+}
+
+// Encode v as msgpack or json, depending on the request's Accept
+func encodeBody(rw http.ResponseWriter, req *http.Request, v interface{}) error {
+	if req.Header.Get("Accept") == ctMsgPack {
+		return codec.NewEncoder(rw, &msgpack).Encode(v)
+	}
+
+	return json.NewEncoder(rw).Encode(v)
+}
+
+// Write out the error from a change to the exchanges, aliases or type
+// routes, if there was one
+func writeChangeError(rw http.ResponseWriter, err error) {
+	if err == nil {
+		return
+	}
+
+	switch {
+	case errors.Equal(err, EUnknownExchange), errors.Equal(err, EUnknownAlias),
+		errors.Equal(err, EUnknownTypeRoute):
+		rw.WriteHeader(404)
+	case errors.Equal(err, EAliasLoop), errors.Equal(err, EInvalidAlias):
+		rw.WriteHeader(409)
+	default:
+		rw.WriteHeader(500)
+	}
+
+	rw.Write([]byte(err.Error()))
+}
+
+// Perform a change to the exchanges, writing out the error if any
+func (h *HTTPService) changeExchange(rw http.ResponseWriter, change func(ExchangeManager) error) {
+	em, ok := h.Registry.(ExchangeManager)
+	if !ok {
+		rw.WriteHeader(404)
+		return
+	}
+
+	writeChangeError(rw, change(em))
+}
+
+// Declare the named exchange. The body gives its type and any bindings.
+func (h *HTTPService) declareExchange(rw http.ResponseWriter, req *http.Request) {
+	var ex Exchange
+
+	if !readBody(rw, req, &ex) {
+		return
+	}
+
+	ex.Name = req.URL.Query().Get(":name")
+
+	h.changeExchange(rw, func(em ExchangeManager) error {
+		return em.DeclareExchange(&ex)
+	})
+}
+
+func (h *HTTPService) deleteExchange(rw http.ResponseWriter, req *http.Request) {
+	name := req.URL.Query().Get(":name")
+
+	h.changeExchange(rw, func(em ExchangeManager) error {
+		return em.DeleteExchange(name)
+	})
+}
+
+func (h *HTTPService) bind(rw http.ResponseWriter, req *http.Request) {
+	h.binding(rw, req, ExchangeManager.Bind)
+}
+
+func (h *HTTPService) unbind(rw http.ResponseWriter, req *http.Request) {
+	h.binding(rw, req, ExchangeManager.Unbind)
+}
+
+// Apply the binding in the body to the named exchange with apply
+func (h *HTTPService) binding(rw http.ResponseWriter, req *http.Request, apply func(ExchangeManager, string, *Binding) error) {
+	var b Binding
+
+	if !readBody(rw, req, &b) {
+		return
+	}
+
+	name := req.URL.Query().Get(":name")
+
+	h.changeExchange(rw, func(em ExchangeManager) error {
+		return apply(em, name, &b)
+	})
+}
+
+// Write out the aliases, if the Registry manages any
+func (h *HTTPService) aliases(rw http.ResponseWriter, req *http.Request) {
+	am, ok := h.Registry.(AliasManager)
+	if !ok {
+		rw.WriteHeader(404)
+		return
+	}
+
+	encodeBody(rw, req, &AliasesResult{am.Aliases()})
+}
+
+// Perform a change to the aliases, writing out the error if any
+func (h *HTTPService) changeAlias(rw http.ResponseWriter, change func(AliasManager) error) {
+	am, ok := h.Registry.(AliasManager)
+	if !ok {
+		rw.WriteHeader(404)
+		return
+	}
+
+	writeChangeError(rw, change(am))
+}
+
+// Point the named alias at the targets in the body
+func (h *HTTPService) setAlias(rw http.ResponseWriter, req *http.Request) {
+	var alias Alias
+
+	if !readBody(rw, req, &alias) {
+		return
+	}
+
+	alias.Name = req.URL.Query().Get(":name")
+
+	h.changeAlias(rw, func(am AliasManager) error {
+		return am.SetAlias(&alias)
+	})
+}
+
+func (h *HTTPService) removeAlias(rw http.ResponseWriter, req *http.Request) {
+	name := req.URL.Query().Get(":name")
+
+	h.changeAlias(rw, func(am AliasManager) error {
+		return am.RemoveAlias(name)
+	})
+}
+
+// Write out the type routes, if the Registry manages any
+func (h *HTTPService) typeRoutes(rw http.ResponseWriter, req *http.Request) {
+	tm, ok := h.Registry.(TypeRouteManager)
+	if !ok {
+		rw.WriteHeader(404)
+		return
+	}
+
+	encodeBody(rw, req, &TypeRoutesResult{tm.TypeRoutes()})
+}
+
+// Perform a change to the type routes, writing out the error if any
+func (h *HTTPService) changeTypeRoute(rw http.ResponseWriter, change func(TypeRouteManager) error) {
+	tm, ok := h.Registry.(TypeRouteManager)
+	if !ok {
+		rw.WriteHeader(404)
+		return
+	}
+
+	writeChangeError(rw, change(tm))
+}
+
+// Route the messages pushed to the named mailbox by type. The body
+// gives the fallback, if any.
+func (h *HTTPService) setTypeRoute(rw http.ResponseWriter, req *http.Request) {
+	var route TypeRoute
+
+	if !readBody(rw, req, &route) {
+		return
+	}
+
+	route.Mailbox = req.URL.Query().Get(":name")
+
+	h.changeTypeRoute(rw, func(tm TypeRouteManager) error {
+		return tm.SetTypeRoute(&route)
+	})
+}
+
+func (h *HTTPService) removeTypeRoute(rw http.ResponseWriter, req *http.Request) {
+	name := req.URL.Query().Get(":name")
+
+	h.changeTypeRoute(rw, func(tm TypeRouteManager) error {
+		return tm.RemoveTypeRoute(name)
+	})
+}
+
+// Ack del and every message before it in its mailbox, writing out
+// the ids of the messages acked.
+func (h *HTTPService) ackThrough(rw http.ResponseWriter, req *http.Request, del *Delivery) {
+	if del.AckThrough == nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(EUnknownMessage.Error()))
+		return
+	}
+
+	acked, err := del.AckThrough()
+	if err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	h.lock.Lock()
+
+	for _, id := range acked {
+		delete(h.inflight, id)
+	}
+
+	h.lock.Unlock()
+
+	encodeBody(rw, req, &AckedResult{MessageIds: acked})
+}
+
+// Return the deliveries for the id query parameters. Returns false if
+// any aren't inflight.
+func (h *HTTPService) findInflight(req *http.Request) ([]*Delivery, bool) {
+	ids := req.URL.Query()["id"]
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	dels := make([]*Delivery, 0, len(ids))
+
+	for _, id := range ids {
+		del, ok := h.inflight[MessageId(id)]
+		if !ok {
+			return nil, false
+		}
+
+		dels = append(dels, del.delivery)
+	}
+
+	return dels, true
+}
+
+// Ack or nack the deliveries for the id query parameters with apply.
+// They're only taken out of inflight once apply succeeds, so that they
+// can be tried again or expire if it fails.
+func (h *HTTPService) applyMany(rw http.ResponseWriter, req *http.Request, apply func([]*Delivery) error) {
+	dels, ok := h.findInflight(req)
+	if !ok {
+		rw.WriteHeader(404)
+		return
+	}
+
+	err := apply(dels)
+	if err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	h.lock.Lock()
+
+	for _, del := range dels {
+		delete(h.inflight, del.Message.MessageId)
+	}
+
+	h.lock.Unlock()
+}
+
+func (h *HTTPService) ackMany(rw http.ResponseWriter, req *http.Request) {
+	h.applyMany(rw, req, AckMany)
+}
+
+func (h *HTTPService) nackMany(rw http.ResponseWriter, req *http.Request) {
+	h.applyMany(rw, req, NackMany)
+}
+
 func (h *HTTPService) nack(rw http.ResponseWriter, req *http.Request) {
 	id := req.URL.Query().Get(":id")
 
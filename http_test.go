@@ -1,17 +1,23 @@
 package vega
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/ugorji/go/codec"
 )
 
@@ -566,3 +572,580 @@ func TestHTTPShutdownHandlesLongPoll(t *testing.T) {
 
 	assert.Equal(t, 204, rw.Code)
 }
+
+func TestHTTPDrain(t *testing.T) {
+	reg := NewMemRegistry()
+	serv := NewHTTPService(cPort, reg)
+
+	reg.Declare("a")
+
+	reg.Push("a", Msg("hello"))
+	reg.Push("a", Msg("again"))
+
+	url := fmt.Sprintf("http://%s/mailbox/a", cPort)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	rw := httptest.NewRecorder()
+
+	serv.mux.ServeHTTP(rw, req)
+
+	assert.Equal(t, 200, rw.Code)
+
+	var ret Message
+
+	err = json.NewDecoder(rw.Body).Decode(&ret)
+	if err != nil {
+		panic(err)
+	}
+
+	drained := make(chan struct{})
+
+	go func() {
+		serv.Drain(10 * time.Second)
+		close(drained)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	// No more messages are handed out while draining
+	rw = httptest.NewRecorder()
+
+	serv.mux.ServeHTTP(rw, req)
+
+	assert.Equal(t, 503, rw.Code)
+
+	// but the leased one can still be acked
+	url = fmt.Sprintf("http://%s/message/%s", cPort, ret.MessageId)
+
+	req, err = http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	rw = httptest.NewRecorder()
+
+	serv.mux.ServeHTTP(rw, req)
+
+	assert.Equal(t, 200, rw.Code)
+
+	select {
+	case <-drained:
+	case <-time.After(1 * time.Second):
+		t.Fatal("drain didn't finish once all leases were acked")
+	}
+
+	del, err := reg.Poll("a")
+	if err != nil {
+		panic(err)
+	}
+
+	if assert.NotNil(t, del) {
+		assert.Equal(t, []byte("again"), del.Message.Body)
+	}
+}
+
+func TestHTTPUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vega")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	reg := NewMemRegistry()
+	serv := NewHTTPService(cPort, reg)
+
+	path := filepath.Join(dir, "http.sock")
+
+	err = serv.ListenUnix(path, 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	go serv.AcceptUnix()
+
+	defer serv.Close()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		panic(err)
+	}
+
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		panic(err)
+	}
+
+	req, err := http.NewRequest("POST", "http://vega/mailbox/a", nil)
+	if err != nil {
+		panic(err)
+	}
+
+	err = req.Write(conn)
+	if err != nil {
+		panic(err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		panic(err)
+	}
+
+	conn.Close()
+
+	assert.Equal(t, 200, resp.StatusCode, "server error")
+
+	err = reg.Push("a", Msg("hello"))
+	assert.NoError(t, err, "mailbox was not created")
+}
+
+func TestHTTPExclusiveConsumer(t *testing.T) {
+	reg := NewMemRegistry()
+	serv := NewHTTPService(cPort, reg)
+
+	reg.Declare("a")
+
+	reg.Push("a", Msg("hello"))
+	reg.Push("a", Msg("again"))
+
+	poll := func(query string) *httptest.ResponseRecorder {
+		url := fmt.Sprintf("http://%s/mailbox/a?%s", cPort, query)
+
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			panic(err)
+		}
+
+		rw := httptest.NewRecorder()
+
+		serv.mux.ServeHTTP(rw, req)
+
+		return rw
+	}
+
+	rw := poll("exclusive=one&lease=100ms")
+	assert.Equal(t, 200, rw.Code)
+
+	assert.Equal(t, 409, poll("exclusive=two").Code)
+	assert.Equal(t, 409, poll("").Code)
+
+	// two waits as a standby until one's lease runs out
+	rw = poll("exclusive=two&wait=1s")
+	assert.Equal(t, 200, rw.Code)
+
+	assert.Equal(t, "two", serv.Locks.Owner("a"))
+	assert.Equal(t, 409, poll("exclusive=one").Code)
+}
+
+func TestHTTPAckManyAndThrough(t *testing.T) {
+	reg := NewMemRegistry()
+	serv := NewHTTPService(cPort, reg)
+
+	reg.Declare("a")
+
+	for _, body := range []string{"1", "2", "3", "4"} {
+		reg.Push("a", Msg(body))
+	}
+
+	var ids []MessageId
+
+	for i := 0; i < 4; i++ {
+		url := fmt.Sprintf("http://%s/mailbox/a", cPort)
+
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			panic(err)
+		}
+
+		rw := httptest.NewRecorder()
+
+		serv.mux.ServeHTTP(rw, req)
+
+		require.Equal(t, 200, rw.Code)
+
+		var ret Message
+
+		err = json.NewDecoder(rw.Body).Decode(&ret)
+		if err != nil {
+			panic(err)
+		}
+
+		ids = append(ids, ret.MessageId)
+	}
+
+	url := fmt.Sprintf("http://%s/messages?id=%s&id=%s", cPort, ids[0], ids[1])
+
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	rw := httptest.NewRecorder()
+
+	serv.mux.ServeHTTP(rw, req)
+
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, 2, len(serv.inflight))
+
+	url = fmt.Sprintf("http://%s/message/%s?through=1", cPort, ids[3])
+
+	req, err = http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	rw = httptest.NewRecorder()
+
+	serv.mux.ServeHTTP(rw, req)
+
+	assert.Equal(t, 200, rw.Code)
+
+	var res AckedResult
+
+	err = json.NewDecoder(rw.Body).Decode(&res)
+	if err != nil {
+		panic(err)
+	}
+
+	assert.Equal(t, ids[2:], res.MessageIds)
+	assert.Equal(t, 0, len(serv.inflight))
+
+	url = fmt.Sprintf("http://%s/messages?id=%s", cPort, ids[0])
+
+	req, err = http.NewRequest("PUT", url, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	rw = httptest.NewRecorder()
+
+	serv.mux.ServeHTTP(rw, req)
+
+	assert.Equal(t, 404, rw.Code)
+}
+
+func TestHTTPAckManyKeepsInflightOnFailure(t *testing.T) {
+	reg := NewMemRegistry()
+	serv := NewHTTPService(cPort, reg)
+
+	reg.Declare("a")
+
+	reg.Push("a", Msg("1"))
+	reg.Push("a", Msg("2"))
+
+	var ids []MessageId
+
+	for i := 0; i < 2; i++ {
+		url := fmt.Sprintf("http://%s/mailbox/a", cPort)
+
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			panic(err)
+		}
+
+		rw := httptest.NewRecorder()
+
+		serv.mux.ServeHTTP(rw, req)
+
+		require.Equal(t, 200, rw.Code)
+
+		var ret Message
+
+		err = json.NewDecoder(rw.Body).Decode(&ret)
+		if err != nil {
+			panic(err)
+		}
+
+		ids = append(ids, ret.MessageId)
+	}
+
+	// Acked behind the service's back, so acking both fails
+	require.NoError(t, serv.inflight[ids[1]].delivery.Ack())
+
+	url := fmt.Sprintf("http://%s/messages?id=%s&id=%s", cPort, ids[0], ids[1])
+
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	rw := httptest.NewRecorder()
+
+	serv.mux.ServeHTTP(rw, req)
+
+	assert.Equal(t, 500, rw.Code)
+	assert.Equal(t, 2, len(serv.inflight))
+
+	// and the one that's still in flight can be acked after
+	url = fmt.Sprintf("http://%s/messages?id=%s", cPort, ids[0])
+
+	req, err = http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	rw = httptest.NewRecorder()
+
+	serv.mux.ServeHTTP(rw, req)
+
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, 1, len(serv.inflight))
+}
+
+type subscribedRegistry struct {
+	*Registry
+	subs []*Subscription
+}
+
+func (s *subscribedRegistry) Subscriptions() []*Subscription {
+	return s.subs
+}
+
+func TestHTTPListSubscriptions(t *testing.T) {
+	sub := ParseSubscription("config/+/current")
+	sub.Mailbox = "a"
+
+	reg := &subscribedRegistry{NewMemRegistry(), []*Subscription{sub}}
+	serv := NewHTTPService(cPort, reg)
+
+	url := fmt.Sprintf("http://%s/subscriptions", cPort)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	rw := httptest.NewRecorder()
+
+	serv.mux.ServeHTTP(rw, req)
+
+	require.Equal(t, 200, rw.Code)
+
+	var subs []*Subscription
+
+	err = json.NewDecoder(rw.Body).Decode(&subs)
+	if err != nil {
+		panic(err)
+	}
+
+	require.Equal(t, 1, len(subs))
+
+	assert.Equal(t, "config/+/current", subs[0].Pattern)
+	assert.Equal(t, "a", subs[0].Mailbox)
+
+	// Without pub/sub there's nothing to list
+	serv = NewHTTPService(cPort, NewMemRegistry())
+
+	rw = httptest.NewRecorder()
+
+	serv.mux.ServeHTTP(rw, req)
+
+	assert.Equal(t, 404, rw.Code)
+}
+
+// A Registry whose pushes go through a Router that has exchanges,
+// aliases and type routes
+type exchangeRegistry struct {
+	*Registry
+	router *Router
+}
+
+func (e *exchangeRegistry) Push(name string, msg *Message) error {
+	return e.router.Push(name, msg)
+}
+
+func (e *exchangeRegistry) DeclareExchange(ex *Exchange) error { return e.router.DeclareExchange(ex) }
+func (e *exchangeRegistry) DeleteExchange(name string) error   { return e.router.DeleteExchange(name) }
+func (e *exchangeRegistry) Bind(name string, b *Binding) error { return e.router.Bind(name, b) }
+func (e *exchangeRegistry) Unbind(name string, b *Binding) error {
+	return e.router.Unbind(name, b)
+}
+func (e *exchangeRegistry) Exchanges() []*Exchange        { return e.router.Exchanges() }
+func (e *exchangeRegistry) SetAlias(alias *Alias) error   { return e.router.SetAlias(alias) }
+func (e *exchangeRegistry) RemoveAlias(name string) error { return e.router.RemoveAlias(name) }
+func (e *exchangeRegistry) Aliases() []*Alias             { return e.router.Aliases() }
+func (e *exchangeRegistry) SetTypeRoute(route *TypeRoute) error {
+	return e.router.SetTypeRoute(route)
+}
+func (e *exchangeRegistry) RemoveTypeRoute(mailbox string) error {
+	return e.router.RemoveTypeRoute(mailbox)
+}
+func (e *exchangeRegistry) TypeRoutes() []*TypeRoute { return e.router.TypeRoutes() }
+
+func TestHTTPExchanges(t *testing.T) {
+	router, reg := exchangeRouter("a")
+
+	serv := NewHTTPService(cPort, &exchangeRegistry{reg, router})
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		url := fmt.Sprintf("http://%s%s", cPort, path)
+
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			panic(err)
+		}
+
+		rw := httptest.NewRecorder()
+
+		serv.mux.ServeHTTP(rw, req)
+
+		return rw
+	}
+
+	rw := do("POST", "/exchange/events", `{"type": "topic"}`)
+	require.Equal(t, 200, rw.Code, rw.Body.String())
+
+	rw = do("PUT", "/exchange/events/binding", `{"mailbox": "a", "key": "order/#"}`)
+	require.Equal(t, 200, rw.Code, rw.Body.String())
+
+	rw = do("PUT", "/mailbox/events", `{"correlation_id": "order/1", "body": "aGVsbG8="}`)
+	require.Equal(t, 200, rw.Code, rw.Body.String())
+
+	del, err := reg.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	assert.Equal(t, []byte("hello"), del.Message.Body)
+
+	rw = do("GET", "/exchanges", "")
+	require.Equal(t, 200, rw.Code)
+
+	var res ExchangesResult
+
+	err = json.NewDecoder(rw.Body).Decode(&res)
+	if err != nil {
+		panic(err)
+	}
+
+	require.Equal(t, 1, len(res.Exchanges))
+
+	assert.Equal(t, "events", res.Exchanges[0].Name)
+	assert.Equal(t, ExchangeTopic, res.Exchanges[0].Type)
+	assert.Equal(t, []*Binding{{Mailbox: "a", Key: "order/#"}}, res.Exchanges[0].Bindings)
+
+	rw = do("DELETE", "/exchange/events/binding", `{"mailbox": "a", "key": "order/#"}`)
+	require.Equal(t, 200, rw.Code, rw.Body.String())
+
+	rw = do("DELETE", "/exchange/events", "")
+	require.Equal(t, 200, rw.Code, rw.Body.String())
+
+	rw = do("DELETE", "/exchange/events", "")
+	assert.Equal(t, 404, rw.Code)
+
+	// Without exchanges there's nothing to manage
+	serv = NewHTTPService(cPort, NewMemRegistry())
+
+	rw = do("GET", "/exchanges", "")
+	assert.Equal(t, 404, rw.Code)
+}
+
+func TestHTTPAliases(t *testing.T) {
+	router, reg := exchangeRouter("users")
+
+	serv := NewHTTPService(cPort, &exchangeRegistry{reg, router})
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		url := fmt.Sprintf("http://%s%s", cPort, path)
+
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			panic(err)
+		}
+
+		rw := httptest.NewRecorder()
+
+		serv.mux.ServeHTTP(rw, req)
+
+		return rw
+	}
+
+	rw := do("PUT", "/alias/accounts", `{"targets": ["users"]}`)
+	require.Equal(t, 200, rw.Code, rw.Body.String())
+
+	rw = do("PUT", "/alias/users", `{"targets": ["accounts"]}`)
+	assert.Equal(t, 409, rw.Code)
+
+	rw = do("PUT", "/mailbox/accounts", `{"body": "aGVsbG8="}`)
+	require.Equal(t, 200, rw.Code, rw.Body.String())
+
+	del, err := reg.Poll("users")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	assert.Equal(t, []byte("hello"), del.Message.Body)
+
+	rw = do("GET", "/aliases", "")
+	require.Equal(t, 200, rw.Code)
+
+	var res AliasesResult
+
+	err = json.NewDecoder(rw.Body).Decode(&res)
+	if err != nil {
+		panic(err)
+	}
+
+	assert.Equal(t, []*Alias{{Name: "accounts", Targets: []string{"users"}}}, res.Aliases)
+
+	rw = do("DELETE", "/alias/accounts", "")
+	require.Equal(t, 200, rw.Code, rw.Body.String())
+
+	rw = do("DELETE", "/alias/accounts", "")
+	assert.Equal(t, 404, rw.Code)
+}
+
+func TestHTTPTypeRoutes(t *testing.T) {
+	router, reg := exchangeRouter("billing", "billing.invoice.created")
+
+	serv := NewHTTPService(cPort, &exchangeRegistry{reg, router})
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		url := fmt.Sprintf("http://%s%s", cPort, path)
+
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			panic(err)
+		}
+
+		rw := httptest.NewRecorder()
+
+		serv.mux.ServeHTTP(rw, req)
+
+		return rw
+	}
+
+	rw := do("PUT", "/type-route/billing", `{}`)
+	require.Equal(t, 200, rw.Code, rw.Body.String())
+
+	rw = do("PUT", "/mailbox/billing", `{"type": "invoice.created", "body": "aGVsbG8="}`)
+	require.Equal(t, 200, rw.Code, rw.Body.String())
+
+	del, err := reg.Poll("billing.invoice.created")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	assert.Equal(t, []byte("hello"), del.Message.Body)
+
+	rw = do("GET", "/type-routes", "")
+	require.Equal(t, 200, rw.Code)
+
+	var res TypeRoutesResult
+
+	err = json.NewDecoder(rw.Body).Decode(&res)
+	if err != nil {
+		panic(err)
+	}
+
+	assert.Equal(t, []*TypeRoute{{Mailbox: "billing"}}, res.TypeRoutes)
+
+	rw = do("DELETE", "/type-route/billing", "")
+	require.Equal(t, 200, rw.Code, rw.Body.String())
+
+	rw = do("DELETE", "/type-route/billing", "")
+	assert.Equal(t, 404, rw.Code)
+}
@@ -21,6 +21,7 @@ type Mailbox interface {
 	Poll() (*Message, error)
 	Ack(MessageId) error
 	Nack(MessageId) error
+
 	AddWatcher() <-chan *Message
 	AddWatcherCancelable(chan struct{}) <-chan *Message
 	Stats() *MailboxStats
@@ -41,19 +42,97 @@ func (id MessageId) AppendLocalIndex(idxStr string) MessageId {
 
 type Acker func() error
 type Nacker func() error
+type CumulativeAcker func() ([]MessageId, error)
+
+// Acks or nacks many messages from the same place at once, all of
+// them or none of them if any of them aren't in flight. Mailboxes that
+// don't implement it have their messages acked one at a time.
+type batchAcker interface {
+	AckMany([]MessageId) error
+	NackMany([]MessageId) error
+}
+
+// Acks a message and every other message in flight that was pushed
+// before it, returning the ids of the messages acked. Deliveries from
+// mailboxes that don't implement it have no AckThrough.
+type throughAcker interface {
+	AckThrough(MessageId) ([]MessageId, error)
+}
 
 type Delivery struct {
-	Message *Message
-	Ack     Acker
-	Nack    Nacker
+	Message    *Message
+	Ack        Acker
+	Nack       Nacker
+	AckThrough CumulativeAcker
+
+	// where the message came from, so that acks can be batched
+	batch batchAcker
 }
 
 func NewDelivery(m Mailbox, msg *Message) *Delivery {
-	return &Delivery{
+	del := &Delivery{
 		Message: msg,
 		Ack:     func() error { return m.Ack(msg.MessageId) },
 		Nack:    func() error { return m.Nack(msg.MessageId) },
 	}
+
+	if ta, ok := m.(throughAcker); ok {
+		del.AckThrough = func() ([]MessageId, error) { return ta.AckThrough(msg.MessageId) }
+	}
+
+	if ba, ok := m.(batchAcker); ok {
+		del.batch = ba
+	}
+
+	return del
+}
+
+// Ack all the deliveries, batching together those from the same
+// mailbox or client. The deliveries of each batch are acked all or
+// nothing, but an error from one batch doesn't undo the others.
+func AckMany(dels []*Delivery) error {
+	return batchDeliveries(dels, batchAcker.AckMany, func(del *Delivery) error {
+		return del.Ack()
+	})
+}
+
+// Nack all the deliveries, batching them like AckMany does
+func NackMany(dels []*Delivery) error {
+	return batchDeliveries(dels, batchAcker.NackMany, func(del *Delivery) error {
+		return del.Nack()
+	})
+}
+
+func batchDeliveries(dels []*Delivery, many func(batchAcker, []MessageId) error, one func(*Delivery) error) error {
+	var (
+		order   []batchAcker
+		batches = make(map[batchAcker][]MessageId)
+		err     error
+	)
+
+	for _, del := range dels {
+		if del.batch == nil {
+			if e := one(del); e != nil && err == nil {
+				err = e
+			}
+
+			continue
+		}
+
+		if _, ok := batches[del.batch]; !ok {
+			order = append(order, del.batch)
+		}
+
+		batches[del.batch] = append(batches[del.batch], del.Message.MessageId)
+	}
+
+	for _, b := range order {
+		if e := many(b, batches[b]); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return err
 }
 
 type Storage interface {
@@ -63,6 +142,7 @@ type Storage interface {
 	Poll(string) (*Delivery, error)
 	LongPoll(string, time.Duration) (*Delivery, error)
 	LongPollCancelable(string, time.Duration, chan struct{}) (*Delivery, error)
+	Transact(*Transaction) error
 }
 
 type Pusher interface {
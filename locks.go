@@ -0,0 +1,267 @@
+package vega
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/vektra/errors"
+)
+
+var EMailboxLocked = errors.New("mailbox is locked by another consumer")
+
+// Tracks which consumer, if any, has exclusive use of each mailbox.
+// A Service and HTTPService that serve the same Storage should share
+// one so that a lock taken through either is honored by both.
+//
+// Locks are advisory: a mailbox is only exclusive once a consumer has
+// locked it. Until then anyone may poll it, whether or not they take
+// the lock, so every consumer of a mailbox meant to have one active
+// consumer should lock it before polling.
+type ConsumerLocks struct {
+	lock  sync.Mutex
+	locks map[string]*consumerLock
+}
+
+type consumerLock struct {
+	owner string
+
+	// zero if the lock is held until released
+	expires time.Time
+
+	// closed when the lock is released or found to have expired
+	released chan struct{}
+}
+
+func NewConsumerLocks() *ConsumerLocks {
+	return &ConsumerLocks{locks: make(map[string]*consumerLock)}
+}
+
+// Return the lock on name, dropping it if it has expired. Must be
+// called with l.lock held.
+func (l *ConsumerLocks) current(name string) *consumerLock {
+	cl, ok := l.locks[name]
+	if !ok {
+		return nil
+	}
+
+	if !cl.expires.IsZero() && !time.Now().Before(cl.expires) {
+		debugf("consumer lock on %s held by %s expired\n", name, cl.owner)
+		l.drop(name, cl)
+		return nil
+	}
+
+	return cl
+}
+
+// Must be called with l.lock held
+func (l *ConsumerLocks) drop(name string, cl *consumerLock) {
+	delete(l.locks, name)
+	close(cl.released)
+}
+
+// Take or renew the lock on name for owner. Returns the lock held by
+// someone else if it couldn't be taken.
+func (l *ConsumerLocks) tryAcquire(name, owner string, lease time.Duration) *consumerLock {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	cl := l.current(name)
+	if cl == nil {
+		cl = &consumerLock{owner: owner, released: make(chan struct{})}
+		l.locks[name] = cl
+	} else if cl.owner != owner {
+		return cl
+	}
+
+	if lease > 0 {
+		cl.expires = time.Now().Add(lease)
+	} else {
+		cl.expires = time.Time{}
+	}
+
+	return nil
+}
+
+// Take the lock on name for owner, or renew it if owner already holds
+// it. If lease is positive the lock expires unless it is renewed within
+// lease, otherwise it is held until released. Returns EMailboxLocked if
+// another owner holds the lock.
+func (l *ConsumerLocks) Acquire(name, owner string, lease time.Duration) error {
+	if l.tryAcquire(name, owner, lease) != nil {
+		return errors.Subject(EMailboxLocked, name)
+	}
+
+	return nil
+}
+
+// Like Acquire, but if another owner holds the lock, wait up to til for
+// it to be released and take it over. Returns EMailboxLocked if the lock
+// couldn't be taken in time or done is closed first.
+func (l *ConsumerLocks) Wait(name, owner string, lease, til time.Duration, done <-chan struct{}) error {
+	timeout := time.NewTimer(til)
+	defer timeout.Stop()
+
+	for {
+		held := l.tryAcquire(name, owner, lease)
+		if held == nil {
+			return nil
+		}
+
+		l.lock.Lock()
+		expires := held.expires
+		l.lock.Unlock()
+
+		// A lock with a lease may expire without anyone releasing it
+		var expired *time.Timer
+
+		if expires.IsZero() {
+			expired = time.NewTimer(til)
+		} else {
+			expired = time.NewTimer(expires.Sub(time.Now()))
+		}
+
+		select {
+		case <-held.released:
+		case <-expired.C:
+		case <-timeout.C:
+			expired.Stop()
+			return errors.Subject(EMailboxLocked, name)
+		case <-done:
+			expired.Stop()
+			return errors.Subject(EMailboxLocked, name)
+		}
+
+		expired.Stop()
+	}
+}
+
+// Returns nil if name isn't locked or is locked by owner, otherwise
+// EMailboxLocked.
+func (l *ConsumerLocks) Check(name, owner string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if cl := l.current(name); cl != nil && cl.owner != owner {
+		return errors.Subject(EMailboxLocked, name)
+	}
+
+	return nil
+}
+
+// Release the lock on name if owner holds it
+func (l *ConsumerLocks) Release(name, owner string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if cl, ok := l.locks[name]; ok && cl.owner == owner {
+		l.drop(name, cl)
+	}
+}
+
+// Release every lock owner holds
+func (l *ConsumerLocks) ReleaseAll(owner string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for name, cl := range l.locks {
+		if cl.owner == owner {
+			l.drop(name, cl)
+		}
+	}
+}
+
+// Return who holds the lock on name, or "" if no one does
+func (l *ConsumerLocks) Owner(name string) string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if cl := l.current(name); cl != nil {
+		return cl.owner
+	}
+
+	return ""
+}
+
+// Take exclusive use of the named mailbox for this client. While the
+// client holds the lock, polls of the mailbox by anyone else fail with
+// EMailboxLocked. Returns EMailboxLocked if someone else already holds
+// it. The lock is released by UnlockMailbox or when the session ends,
+// and is taken again after reconnecting if it's still free. Polls made
+// before anyone locks the mailbox aren't refused, see ConsumerLocks.
+func (c *Client) LockMailbox(name string) error {
+	return c.LockMailboxContext(context.Background(), name)
+}
+
+func (c *Client) LockMailboxContext(ctx context.Context, name string) error {
+	err := c.simpleRequest(ctx, LockType, &Lock{Name: name})
+	if err != nil {
+		return err
+	}
+
+	c.rememberLock(name)
+	return nil
+}
+
+// How long each request made by WaitLockMailbox waits on the server
+const lockWaitInterval = 1 * time.Minute
+
+// Like LockMailbox, but wait as a hot standby while someone else holds the
+// lock, taking it over once they release it or go away. If ctx is done
+// first, ctx's error is returned.
+func (c *Client) WaitLockMailbox(ctx context.Context, name string) error {
+	for {
+		til := lockWaitInterval
+
+		if deadline, ok := ctx.Deadline(); ok {
+			left := deadline.Sub(time.Now())
+			if left <= 0 {
+				return context.DeadlineExceeded
+			}
+
+			if left < til {
+				til = left
+			}
+		}
+
+		err := c.simpleRequest(ctx, LockType, &Lock{Name: name, Wait: til.String()})
+		if err == nil {
+			c.rememberLock(name)
+			return nil
+		}
+
+		if !errors.Equal(err, EMailboxLocked) {
+			return err
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// Release the lock on the named mailbox
+func (c *Client) UnlockMailbox(name string) error {
+	err := c.simpleRequest(context.Background(), UnlockType, &Unlock{Name: name})
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.locks, name)
+
+	return nil
+}
+
+func (c *Client) rememberLock(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.locks == nil {
+		c.locks = make(map[string]struct{})
+	}
+
+	c.locks[name] = struct{}{}
+}
@@ -0,0 +1,63 @@
+package vega
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vektra/errors"
+)
+
+func TestConsumerLocksExclusive(t *testing.T) {
+	l := NewConsumerLocks()
+
+	assert.NoError(t, l.Acquire("a", "one", 0))
+	assert.NoError(t, l.Acquire("a", "one", 0))
+
+	err := l.Acquire("a", "two", 0)
+	assert.True(t, errors.Equal(err, EMailboxLocked))
+
+	assert.NoError(t, l.Check("a", "one"))
+	assert.True(t, errors.Equal(l.Check("a", "two"), EMailboxLocked))
+	assert.NoError(t, l.Check("b", "two"))
+
+	l.Release("a", "two")
+	assert.Equal(t, "one", l.Owner("a"))
+
+	l.ReleaseAll("one")
+	assert.Equal(t, "", l.Owner("a"))
+
+	assert.NoError(t, l.Acquire("a", "two", 0))
+}
+
+func TestConsumerLocksLeaseExpires(t *testing.T) {
+	l := NewConsumerLocks()
+
+	assert.NoError(t, l.Acquire("a", "one", 50*time.Millisecond))
+	assert.Error(t, l.Acquire("a", "two", 0))
+
+	time.Sleep(60 * time.Millisecond)
+
+	assert.NoError(t, l.Acquire("a", "two", 0))
+}
+
+func TestConsumerLocksWaitTakesOver(t *testing.T) {
+	l := NewConsumerLocks()
+
+	assert.NoError(t, l.Acquire("a", "one", 0))
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		l.Release("a", "one")
+	}()
+
+	assert.NoError(t, l.Wait("a", "two", 0, 1*time.Second, nil))
+	assert.Equal(t, "two", l.Owner("a"))
+
+	err := l.Wait("a", "three", 0, 50*time.Millisecond, nil)
+	assert.True(t, errors.Equal(err, EMailboxLocked))
+
+	// A lock with a lease is taken over when it expires
+	assert.NoError(t, l.Acquire("b", "one", 50*time.Millisecond))
+	assert.NoError(t, l.Wait("b", "two", 0, 1*time.Second, nil))
+}
@@ -1,36 +1,171 @@
 package vega
 
+import (
+	"sort"
+	"sync"
+)
+
 type MemMailbox struct {
+	sync.Mutex
+
 	name     string
 	values   []*Message
 	inflight map[MessageId]*Message
 	watchers []*watchChannel
+
+	// groups with a message in flight
+	groups map[string]struct{}
+
+	// the order messages were pushed in
+	seqs    map[*Message]uint64
+	nextSeq uint64
 }
 
 func NewMemMailbox(name string) Mailbox {
-	return &MemMailbox{name, nil, make(map[MessageId]*Message), nil}
+	return &MemMailbox{
+		name:     name,
+		inflight: make(map[MessageId]*Message),
+		groups:   make(map[string]struct{}),
+		seqs:     make(map[*Message]uint64),
+	}
 }
 
 func (mm *MemMailbox) Ack(id MessageId) error {
-	if _, ok := mm.inflight[id]; ok {
-		delete(mm.inflight, id)
+	mm.Lock()
+	defer mm.Unlock()
+
+	if c, ok := mm.inflight[id]; ok {
+		mm.ack(c)
 		return nil
 	}
 
 	return EUnknownMessage
 }
 
+// Must be called with mm locked
+func (mm *MemMailbox) ack(msg *Message) {
+	delete(mm.inflight, msg.MessageId)
+	delete(mm.seqs, msg)
+	mm.release(msg)
+}
+
+// Look up the messages in flight with ids. Returns EUnknownMessage if
+// any aren't in flight or appear twice. Must be called with mm locked.
+func (mm *MemMailbox) inflightMessages(ids []MessageId) ([]*Message, error) {
+	msgs := make([]*Message, 0, len(ids))
+	seen := make(map[MessageId]bool)
+
+	for _, id := range ids {
+		msg, ok := mm.inflight[id]
+		if !ok || seen[id] {
+			return nil, EUnknownMessage
+		}
+
+		seen[id] = true
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, nil
+}
+
+func (mm *MemMailbox) AckMany(ids []MessageId) error {
+	mm.Lock()
+	defer mm.Unlock()
+
+	msgs, err := mm.inflightMessages(ids)
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range msgs {
+		mm.ack(msg)
+	}
+
+	return nil
+}
+
+func (mm *MemMailbox) NackMany(ids []MessageId) error {
+	mm.Lock()
+	defer mm.Unlock()
+
+	msgs, err := mm.inflightMessages(ids)
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range msgs {
+		delete(mm.inflight, msg.MessageId)
+	}
+
+	mm.values = append(msgs, mm.values...)
+
+	for _, msg := range msgs {
+		mm.release(msg)
+	}
+
+	return nil
+}
+
+func (mm *MemMailbox) AckThrough(id MessageId) ([]MessageId, error) {
+	mm.Lock()
+	defer mm.Unlock()
+
+	last, ok := mm.inflight[id]
+	if !ok {
+		return nil, EUnknownMessage
+	}
+
+	var msgs []*Message
+
+	for _, msg := range mm.inflight {
+		if mm.seqs[msg] <= mm.seqs[last] {
+			msgs = append(msgs, msg)
+		}
+	}
+
+	sort.Sort(messagesBySeq{msgs, mm.seqs})
+
+	ids := make([]MessageId, len(msgs))
+
+	for i, msg := range msgs {
+		ids[i] = msg.MessageId
+		mm.ack(msg)
+	}
+
+	return ids, nil
+}
+
 func (mm *MemMailbox) Nack(id MessageId) error {
+	mm.Lock()
+	defer mm.Unlock()
+
 	if c, ok := mm.inflight[id]; ok {
 		delete(mm.inflight, id)
 		mm.values = append([]*Message{c}, mm.values...)
+		mm.release(c)
 		return nil
 	}
 
 	return EUnknownMessage
 }
 
+// Let the next message in msg's group be delivered, handing it to a
+// watcher if one is waiting. Must be called with mm locked.
+func (mm *MemMailbox) release(msg *Message) {
+	if group := msg.Group(); group != "" {
+		delete(mm.groups, group)
+		mm.feedWatchers()
+	}
+}
+
 func (mm *MemMailbox) Abandon() error {
+	mm.Lock()
+	defer mm.Unlock()
+
+	for _, msg := range mm.values {
+		delete(mm.seqs, msg)
+	}
+
 	mm.values = nil
 	for _, w := range mm.watchers {
 		w.indicator <- nil
@@ -39,61 +174,107 @@ func (mm *MemMailbox) Abandon() error {
 	return nil
 }
 
-func (mm *MemMailbox) Poll() (*Message, error) {
-	if len(mm.values) > 0 {
-		val := mm.values[0]
-		mm.values = mm.values[1:]
+// Take the first message that isn't held back by another message
+// in its group being in flight, and put it in flight. Must be called
+// with mm locked.
+func (mm *MemMailbox) next() *Message {
+	for i, val := range mm.values {
+		group := val.Group()
+
+		if group != "" {
+			if _, busy := mm.groups[group]; busy {
+				continue
+			}
+
+			mm.groups[group] = struct{}{}
+		}
+
+		mm.values = append(mm.values[:i:i], mm.values[i+1:]...)
 
 		if val.MessageId == "" {
 			val.MessageId = NextMessageID()
 		}
 
 		mm.inflight[val.MessageId] = val
-		return val, nil
+		return val
 	}
 
-	return nil, nil
+	return nil
+}
+
+func (mm *MemMailbox) Poll() (*Message, error) {
+	mm.Lock()
+	defer mm.Unlock()
+
+	return mm.next(), nil
 }
 
 func (mm *MemMailbox) Push(value *Message) error {
-RETRY:
+	mm.Lock()
+	defer mm.Unlock()
+
+	mm.add(value)
+	mm.feedWatchers()
+
+	return nil
+}
 
-	if len(mm.watchers) > 0 {
+// Queue msgs after those already in mm. Must be called with mm locked.
+func (mm *MemMailbox) add(msgs ...*Message) {
+	for _, msg := range msgs {
+		mm.seqs[msg] = mm.nextSeq
+		mm.nextSeq++
+	}
+
+	mm.values = append(mm.values, msgs...)
+}
+
+// Hand messages to waiting watchers while there are any that can be
+// delivered. Must be called with mm locked.
+func (mm *MemMailbox) feedWatchers() {
+	for len(mm.watchers) > 0 {
 		watch := mm.watchers[0]
-		mm.watchers = mm.watchers[1:]
 
 		if watch.done != nil {
 			select {
 			case <-watch.done:
+				mm.watchers = mm.watchers[1:]
 				close(watch.indicator)
-				goto RETRY
+				continue
 			default:
 			}
 		}
 
-		if value.MessageId == "" {
-			value.MessageId = NextMessageID()
+		value := mm.next()
+		if value == nil {
+			return
 		}
 
-		mm.inflight[value.MessageId] = value
+		mm.watchers = mm.watchers[1:]
 
 		watch.indicator <- value
 		close(watch.indicator)
-
-		return nil
 	}
+}
 
-	mm.values = append(mm.values, value)
-
-	return nil
+type messagesBySeq struct {
+	msgs []*Message
+	seqs map[*Message]uint64
 }
 
+func (m messagesBySeq) Len() int           { return len(m.msgs) }
+func (m messagesBySeq) Swap(i, j int)      { m.msgs[i], m.msgs[j] = m.msgs[j], m.msgs[i] }
+func (m messagesBySeq) Less(i, j int) bool { return m.seqs[m.msgs[i]] < m.seqs[m.msgs[j]] }
+
 type watchChannel struct {
 	indicator chan *Message
 	done      chan struct{}
 }
 
 func (mm *MemMailbox) AddWatcher() <-chan *Message {
+	mm.Lock()
+	defer mm.Unlock()
+
 	indicator := make(chan *Message, 1)
 
 	mm.watchers = append(mm.watchers, &watchChannel{indicator, nil})
@@ -102,6 +283,9 @@ func (mm *MemMailbox) AddWatcher() <-chan *Message {
 }
 
 func (mm *MemMailbox) AddWatcherCancelable(done chan struct{}) <-chan *Message {
+	mm.Lock()
+	defer mm.Unlock()
+
 	indicator := make(chan *Message, 1)
 
 	mm.watchers = append(mm.watchers, &watchChannel{indicator, done})
@@ -110,6 +294,9 @@ func (mm *MemMailbox) AddWatcherCancelable(done chan struct{}) <-chan *Message {
 }
 
 func (mm *MemMailbox) Stats() *MailboxStats {
+	mm.Lock()
+	defer mm.Unlock()
+
 	return &MailboxStats{
 		Size:     len(mm.values),
 		InFlight: len(mm.inflight),
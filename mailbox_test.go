@@ -172,3 +172,175 @@ func TestMailboxWatcherIsCancelable(t *testing.T) {
 
 	assert.True(t, msg.Equal(out))
 }
+
+func groupMsg(group, body string) *Message {
+	msg := Msg(body)
+	msg.SetGroup(group)
+	return msg
+}
+
+func TestMailboxGroupsDeliverInOrder(t *testing.T) {
+	m := NewMemMailbox("")
+
+	m.Push(groupMsg("a", "a1"))
+	m.Push(groupMsg("a", "a2"))
+	m.Push(groupMsg("b", "b1"))
+	m.Push(Msg("plain"))
+
+	// a2 is held back while a1 is in flight
+	a1, _ := m.Poll()
+	assert.Equal(t, []byte("a1"), a1.Body)
+
+	b1, _ := m.Poll()
+	assert.Equal(t, []byte("b1"), b1.Body)
+
+	plain, _ := m.Poll()
+	assert.Equal(t, []byte("plain"), plain.Body)
+
+	out, _ := m.Poll()
+	assert.Nil(t, out)
+
+	// A nack'd message is redelivered before the rest of its group
+	m.Nack(a1.MessageId)
+
+	out, _ = m.Poll()
+	assert.Equal(t, []byte("a1"), out.Body)
+
+	m.Ack(out.MessageId)
+
+	out, _ = m.Poll()
+	assert.Equal(t, []byte("a2"), out.Body)
+}
+
+func TestMailboxGroupReleaseWakesWatcher(t *testing.T) {
+	m := NewMemMailbox("")
+
+	m.Push(groupMsg("a", "a1"))
+	m.Push(groupMsg("a", "a2"))
+
+	a1, _ := m.Poll()
+
+	watch := m.AddWatcher()
+
+	m.Ack(a1.MessageId)
+
+	select {
+	case out := <-watch:
+		assert.Equal(t, []byte("a2"), out.Body)
+	default:
+		t.Fatal("watcher wasn't given the next message in the group")
+	}
+}
+
+func TestMailboxAckMany(t *testing.T) {
+	m := NewMemMailbox("").(*MemMailbox)
+
+	m.Push(Msg([]byte("1")))
+	m.Push(Msg([]byte("2")))
+
+	a, _ := m.Poll()
+	b, _ := m.Poll()
+
+	// All or nothing
+	err := m.AckMany([]MessageId{a.MessageId, "bogus"})
+	assert.Equal(t, EUnknownMessage, err)
+
+	err = m.AckMany([]MessageId{a.MessageId, a.MessageId})
+	assert.Equal(t, EUnknownMessage, err)
+
+	assert.Equal(t, 2, m.Stats().InFlight)
+
+	err = m.AckMany([]MessageId{a.MessageId, b.MessageId})
+	if err != nil {
+		panic(err)
+	}
+
+	assert.Equal(t, 0, m.Stats().InFlight)
+}
+
+func TestMailboxNackMany(t *testing.T) {
+	m := NewMemMailbox("").(*MemMailbox)
+
+	m.Push(Msg([]byte("1")))
+	m.Push(Msg([]byte("2")))
+	m.Push(Msg([]byte("3")))
+
+	a, _ := m.Poll()
+	b, _ := m.Poll()
+
+	err := m.NackMany([]MessageId{a.MessageId, b.MessageId})
+	if err != nil {
+		panic(err)
+	}
+
+	stats := m.Stats()
+
+	assert.Equal(t, 3, stats.Size)
+	assert.Equal(t, 0, stats.InFlight)
+
+	for _, body := range []string{"1", "2", "3"} {
+		out, _ := m.Poll()
+		assert.Equal(t, []byte(body), out.Body)
+	}
+}
+
+func TestMailboxAckThrough(t *testing.T) {
+	m := NewMemMailbox("").(*MemMailbox)
+
+	m.Push(Msg([]byte("1")))
+	m.Push(Msg([]byte("2")))
+	m.Push(Msg([]byte("3")))
+	m.Push(Msg([]byte("4")))
+
+	a, _ := m.Poll()
+	b, _ := m.Poll()
+	c, _ := m.Poll()
+	d, _ := m.Poll()
+
+	// b isn't in flight so it's left alone
+	m.Nack(b.MessageId)
+
+	acked, err := m.AckThrough(c.MessageId)
+	if err != nil {
+		panic(err)
+	}
+
+	assert.Equal(t, []MessageId{a.MessageId, c.MessageId}, acked)
+
+	stats := m.Stats()
+
+	assert.Equal(t, 1, stats.Size)
+	assert.Equal(t, 1, stats.InFlight)
+
+	err = m.Ack(d.MessageId)
+	assert.NoError(t, err)
+
+	_, err = m.AckThrough(a.MessageId)
+	assert.Equal(t, EUnknownMessage, err)
+}
+
+// Has only the methods every Mailbox has
+type plainMailbox struct {
+	Mailbox
+}
+
+func TestDeliveryWithoutBatchAcks(t *testing.T) {
+	m := &plainMailbox{NewMemMailbox("")}
+
+	m.Push(Msg([]byte("1")))
+	m.Push(Msg([]byte("2")))
+
+	a, _ := m.Poll()
+	b, _ := m.Poll()
+
+	da := NewDelivery(m, a)
+	db := NewDelivery(m, b)
+
+	assert.Nil(t, da.AckThrough)
+
+	// Acked one at a time instead
+	err := AckMany([]*Delivery{da, db})
+	assert.NoError(t, err)
+
+	assert.Equal(t, 0, m.Stats().InFlight)
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -48,6 +49,175 @@ func (m *Message) GetHeader(name string) (interface{}, bool) {
 	return v, ok
 }
 
+// The header that puts a message in a group. Messages in the same
+// group are delivered one at a time, in the order they were pushed.
+const GroupHeader = "group"
+
+// Return the group the message is in, or "" if it's in none
+func (m *Message) Group() string {
+	return m.headerString(GroupHeader)
+}
+
+// Put the message in a group. See GroupHeader.
+func (m *Message) SetGroup(group string) {
+	m.AddHeader(GroupHeader, group)
+}
+
+// The header holding a producer supplied id for a message. A node
+// configured to dedup pushes drops a message pushed to a mailbox with
+// an id it has already seen within its window.
+const DedupHeader = "dedup-id"
+
+// Return the producer supplied id of the message, or "" if it has none
+func (m *Message) DedupId() string {
+	return m.headerString(DedupHeader)
+}
+
+// Set the producer supplied id of the message. See DedupHeader.
+func (m *Message) SetDedupId(id string) {
+	m.AddHeader(DedupHeader, id)
+}
+
+// The header that marks a published message as retained. The last
+// retained message published to a topic is kept and sent to each new
+// subscription that matches the topic. A retained message with an empty
+// body clears the topic's retained message.
+const RetainHeader = "retain"
+
+// Returns true if the message is marked retained
+func (m *Message) Retained() bool {
+	retain, _ := m.Headers[RetainHeader].(bool)
+	return retain
+}
+
+// Mark the message as retained. See RetainHeader.
+func (m *Message) SetRetained() {
+	m.AddHeader(RetainHeader, true)
+}
+
+// The header listing the aliases a message has been forwarded through,
+// separated by commas, so that aliases that loop are caught.
+const AliasPathHeader = "alias-path"
+
+// Return the aliases the message has been forwarded through
+func (m *Message) AliasPath() []string {
+	path := m.headerString(AliasPathHeader)
+	if path == "" {
+		return nil
+	}
+
+	return strings.Split(path, ",")
+}
+
+// The header listing the exchanges a message has been routed through,
+// separated by commas, so that exchanges that loop are caught.
+const ExchangePathHeader = "exchange-path"
+
+// Return the exchanges the message has been routed through
+func (m *Message) ExchangePath() []string {
+	path := m.headerString(ExchangePathHeader)
+	if path == "" {
+		return nil
+	}
+
+	return strings.Split(path, ",")
+}
+
+// The header counting the times a message has been forwarded from one
+// node to another
+const HopsHeader = "hops"
+
+// The header listing the ids of the nodes a message has been forwarded
+// from, in order and separated by commas
+const NodePathHeader = "node-path"
+
+// Return the number of times the message has been forwarded between
+// nodes
+func (m *Message) Hops() int {
+	switch v := m.Headers[HopsHeader].(type) {
+	case int:
+		return v
+	case int64:
+		return int(v)
+	case uint64:
+		return int(v)
+	case float64:
+		return int(v)
+	default:
+		return 0
+	}
+}
+
+// Return the ids of the nodes the message has been forwarded from
+func (m *Message) NodePath() []string {
+	path := m.headerString(NodePathHeader)
+	if path == "" {
+		return nil
+	}
+
+	return strings.Split(path, ",")
+}
+
+// Return a copy of the message to forward on from node, with the hop
+// counted and node added to its path.
+func (m *Message) Forwarded(node string) *Message {
+	path := append(m.NodePath(), node)
+
+	fwd := m.withHeader(HopsHeader, m.Hops()+1)
+	fwd.Headers[NodePathHeader] = strings.Join(path, ",")
+
+	return fwd
+}
+
+// Return the message without its hops and node path, which only nodes
+// may set. The headers are copied if either has to be removed.
+func (m *Message) untraced() *Message {
+	_, hops := m.Headers[HopsHeader]
+	_, path := m.Headers[NodePathHeader]
+
+	if !hops && !path {
+		return m
+	}
+
+	cp := *m
+	cp.Headers = make(map[string]interface{}, len(m.Headers))
+
+	for k, v := range m.Headers {
+		if k != HopsHeader && k != NodePathHeader {
+			cp.Headers[k] = v
+		}
+	}
+
+	return &cp
+}
+
+// Return a copy of the message with the header name set to val. The
+// headers are copied so the original message isn't changed.
+func (m *Message) withHeader(name string, val interface{}) *Message {
+	cp := *m
+	cp.Headers = make(map[string]interface{}, len(m.Headers)+1)
+
+	for k, v := range m.Headers {
+		cp.Headers[k] = v
+	}
+
+	cp.Headers[name] = val
+
+	return &cp
+}
+
+// Header values that were strings may come back from msgpack as bytes
+func (m *Message) headerString(name string) string {
+	switch v := m.Headers[name].(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return ""
+	}
+}
+
 // Create a message with a body
 func Msg(body interface{}) *Message {
 	var bytes []byte
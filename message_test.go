@@ -25,3 +25,28 @@ func TestMailboxGetEmpty(t *testing.T) {
 	_, ok := m.GetHeader("age")
 	assert.False(t, ok)
 }
+
+func TestMessageForwarded(t *testing.T) {
+	m := Msg("hello")
+
+	assert.Equal(t, 0, m.Hops())
+	assert.Nil(t, m.NodePath())
+
+	fwd := m.Forwarded("a:8476").Forwarded("b:8476")
+
+	assert.Equal(t, 2, fwd.Hops())
+	assert.Equal(t, []string{"a:8476", "b:8476"}, fwd.NodePath())
+
+	assert.Equal(t, 0, m.Hops(), "original was changed")
+
+	// The trace survives being sent
+	var got Message
+
+	err := got.FromBytes(fwd.AsBytes())
+	if err != nil {
+		panic(err)
+	}
+
+	assert.Equal(t, 2, got.Hops())
+	assert.Equal(t, []string{"a:8476", "b:8476"}, got.NodePath())
+}
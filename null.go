@@ -16,4 +16,6 @@ func (ns *nullStorage) LongPollCancelable(string, time.Duration, chan struct{})
 	return nil, nil
 }
 
+func (ns *nullStorage) Transact(*Transaction) error { return ETransactUnsupported }
+
 var NullStorage = &nullStorage{}
@@ -0,0 +1,325 @@
+package vega
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/yamux"
+	"github.com/ugorji/go/codec"
+	"github.com/vektra/errors"
+)
+
+// Returned internally when the caller stopped waiting on a request
+var errCanceled = errors.New("request canceled")
+
+// A decoded response from the server
+type response struct {
+	Type  MessageType
+	Error Error
+	Poll  PollResult
+	Stats ClientStats
+	Hello Hello
+	Acked AckedResult
+
+	Exchanges ExchangesResult
+	Aliases   AliasesResult
+
+	TypeRoutes TypeRoutesResult
+
+	// set when the response could not be read at all
+	err error
+}
+
+// The error a response represents. Responses of a type the caller
+// wasn't expecting are reported as EProtocolError.
+func (r *response) error() error {
+	if r.Type == ErrorType {
+		return remoteError(r.Error.Error)
+	}
+
+	return EProtocolError
+}
+
+// Errors sent by the server that are turned back into themselves so
+// that callers can check for them with errors.Equal.
+var remoteErrors = []error{
+	EMailboxLocked,
+	EUnknownExchange,
+	EInvalidExchange,
+	EExchangeLoop,
+	EUnknownAlias,
+	EInvalidAlias,
+	EAliasLoop,
+	EUnknownTypeRoute,
+	ETooManyWaiting,
+}
+
+func remoteError(msg string) error {
+	for _, e := range remoteErrors {
+		if !strings.HasPrefix(msg, e.Error()) {
+			continue
+		}
+
+		subject := strings.TrimLeft(msg[len(e.Error()):], ": ")
+		if subject == "" {
+			return e
+		}
+
+		return errors.Subject(e, subject)
+	}
+
+	return errors.New(msg)
+}
+
+func decodeResponseFrame(r io.Reader, max int, v interface{}) error {
+	frame, err := readFrame(r, max)
+	if err != nil {
+		return err
+	}
+
+	return codec.NewDecoderBytes(frame, &msgpack).Decode(v)
+}
+
+// Read a response of any type off r, whose frames may be up to max
+// bytes long
+func readResponse(r *bufio.Reader, max int) (*response, error) {
+	t, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &response{Type: MessageType(t)}
+
+	switch resp.Type {
+	case SuccessType:
+		return resp, nil
+	case ErrorType:
+		err = decodeResponseFrame(r, max, &resp.Error)
+	case PollResultType:
+		err = decodeResponseFrame(r, max, &resp.Poll)
+	case StatsResultType:
+		err = decodeResponseFrame(r, max, &resp.Stats)
+	case HelloResultType:
+		err = decodeResponseFrame(r, max, &resp.Hello)
+	case AckedResultType:
+		err = decodeResponseFrame(r, max, &resp.Acked)
+	case ExchangesResultType:
+		err = decodeResponseFrame(r, max, &resp.Exchanges)
+	case AliasesResultType:
+		err = decodeResponseFrame(r, max, &resp.Aliases)
+	case TypeRoutesResultType:
+		err = decodeResponseFrame(r, max, &resp.TypeRoutes)
+	default:
+		return nil, EProtocolError
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// Encode a request into a single frame so that it can be written
+// in one call.
+func encodeRequest(t MessageType, req interface{}) ([]byte, error) {
+	out := []byte{uint8(t)}
+
+	if req == nil {
+		return out, nil
+	}
+
+	var body []byte
+
+	err := codec.NewEncoderBytes(&body, &msgpack).Encode(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(out, body...), nil
+}
+
+func writeRequest(w io.Writer, t MessageType, req interface{}) error {
+	frame, err := encodeRequest(t, req)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(frame)
+	return err
+}
+
+// Multiplexes many concurrent requests over one stream. Each request
+// is tagged with an id and the server tags the response with the same
+// id, so responses may come back in any order.
+type pipeline struct {
+	client *Client
+	stream io.ReadWriteCloser
+
+	// whether the server will abort requests we cancel
+	cancelable bool
+
+	wlock sync.Mutex
+
+	lock    sync.Mutex
+	nextId  uint64
+	pending map[uint64]chan *response
+	err     error
+}
+
+func newPipeline(c *Client, sess *yamux.Session, cancelable bool) (*pipeline, error) {
+	s, err := sess.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &pipeline{
+		client:     c,
+		stream:     s,
+		cancelable: cancelable,
+		pending:    make(map[uint64]chan *response),
+	}
+
+	go p.readLoop()
+
+	return p, nil
+}
+
+func (p *pipeline) close() error {
+	return p.stream.Close()
+}
+
+// Route each response to the request waiting on it. When the stream
+// fails, every pending request fails with it.
+func (p *pipeline) readLoop() {
+	r := bufio.NewReader(p.stream)
+	max := p.client.maxFrameSize()
+
+	var err error
+
+	for {
+		var t byte
+
+		t, err = r.ReadByte()
+		if err != nil {
+			break
+		}
+
+		if MessageType(t) != TaggedType {
+			err = EProtocolError
+			break
+		}
+
+		var id uint64
+
+		err = decodeResponseFrame(r, max, &id)
+		if err != nil {
+			break
+		}
+
+		var resp *response
+
+		resp, err = readResponse(r, max)
+		if err != nil {
+			break
+		}
+
+		p.lock.Lock()
+		ch, ok := p.pending[id]
+		delete(p.pending, id)
+		p.lock.Unlock()
+
+		if ok {
+			ch <- resp
+		}
+	}
+
+	debugf("client %s: pipeline failed: %s\n", p.client.addr, err)
+
+	p.client.dropPipeline(p)
+	p.stream.Close()
+
+	p.lock.Lock()
+	p.err = err
+
+	for id, ch := range p.pending {
+		ch <- &response{err: err}
+		delete(p.pending, id)
+	}
+
+	p.lock.Unlock()
+}
+
+// Send a request and wait for its response. If done is closed first,
+// errCanceled is returned and the response is abandoned when it arrives.
+func (p *pipeline) request(t MessageType, req interface{}, done <-chan struct{}) (*response, error) {
+	body, err := encodeRequest(t, req)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan *response, 1)
+
+	p.lock.Lock()
+
+	if p.err != nil {
+		p.lock.Unlock()
+		return nil, p.err
+	}
+
+	id := p.nextId
+	p.nextId++
+	p.pending[id] = ch
+
+	p.lock.Unlock()
+
+	err = p.write(id, body)
+	if err != nil {
+		p.lock.Lock()
+		delete(p.pending, id)
+		p.lock.Unlock()
+
+		return nil, err
+	}
+
+	select {
+	case resp := <-ch:
+		if resp.err != nil {
+			return nil, resp.err
+		}
+
+		return resp, nil
+	case <-done:
+		// The server still responds to a canceled request, so the
+		// response is read and any message in it given back.
+		if p.cancelable {
+			p.write(id, []byte{uint8(CancelType)})
+		}
+
+		go func() {
+			p.client.abandonResponse(<-ch)
+		}()
+
+		return nil, errCanceled
+	}
+}
+
+// Write body tagged with id as a single frame
+func (p *pipeline) write(id uint64, body []byte) error {
+	var hdr []byte
+
+	err := codec.NewEncoderBytes(&hdr, &msgpack).Encode(id)
+	if err != nil {
+		return err
+	}
+
+	frame := append(append([]byte{uint8(TaggedType)}, hdr...), body...)
+
+	p.wlock.Lock()
+	defer p.wlock.Unlock()
+
+	_, err = p.stream.Write(frame)
+	return err
+}
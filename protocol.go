@@ -18,8 +18,71 @@ const (
 	AckType
 	StatsType
 	StatsResultType
+	HelloType
+	HelloResultType
+	TaggedType
+	CancelType
+	HeartbeatType
+	LockType
+	UnlockType
+	TransactType
+	AckManyType
+	NackManyType
+	AckThroughType
+	AckedResultType
+	DeclareExchangeType
+	DeleteExchangeType
+	BindType
+	UnbindType
+	ExchangesType
+	ExchangesResultType
+	SetAliasType
+	RemoveAliasType
+	AliasesType
+	AliasesResultType
+	SetTypeRouteType
+	RemoveTypeRouteType
+	TypeRoutesType
+	TypeRoutesResultType
 )
 
+// The version of the native protocol spoken by this package. Peers
+// that predate the hello exchange are treated as version 0.
+const ProtocolVersion = 1
+
+// Features that can be advertised in a Hello. A peer only uses a
+// feature if the other side has advertised it.
+const (
+	FeatureLWT       = "lwt"
+	FeaturePubSub    = "pubsub"
+	FeatureStats     = "stats"
+	FeaturePipeline  = "pipeline"
+	FeatureCancel    = "cancel"
+	FeatureHeartbeat = "heartbeat"
+	FeatureExclusive = "exclusive"
+	FeatureTransact  = "transact"
+	FeatureBatchAck  = "batch-ack"
+	FeatureExchanges = "exchanges"
+	FeatureAliases   = "aliases"
+	FeatureTypeRoute = "type-route"
+)
+
+// The features a Service advertises to its clients
+var serverFeatures = []string{
+	FeatureLWT,
+	FeaturePubSub,
+	FeatureStats,
+	FeaturePipeline,
+	FeatureCancel,
+	FeatureHeartbeat,
+	FeatureExclusive,
+	FeatureTransact,
+	FeatureBatchAck,
+	FeatureExchanges,
+	FeatureAliases,
+	FeatureTypeRoute,
+}
+
 type Error struct {
 	Error string
 }
@@ -41,6 +104,18 @@ type LongPoll struct {
 	Duration string
 }
 
+// Ask for exclusive use of a mailbox. If Wait is set and another
+// consumer holds the lock, the server waits that long for it to be
+// released before giving up.
+type Lock struct {
+	Name string
+	Wait string
+}
+
+type Unlock struct {
+	Name string
+}
+
 type PollResult struct {
 	Message *Message
 }
@@ -58,6 +133,73 @@ type AckMessage struct {
 	MessageId MessageId
 }
 
+type AckManyMessage struct {
+	MessageIds []MessageId
+}
+
+type NackManyMessage struct {
+	MessageIds []MessageId
+}
+
+// Ack a message and every message before it in its mailbox
+type AckThroughMessage struct {
+	MessageId MessageId
+}
+
+// The messages acked by an AckThroughMessage
+type AckedResult struct {
+	MessageIds []MessageId
+}
+
+// A message to ack as part of a Transaction
+type TxAck struct {
+	Name      string
+	MessageId MessageId
+}
+
+// Acks messages and pushes new ones as a single atomic operation.
+// Either all of it happens or none of it does.
+type Transaction struct {
+	Acks   []*TxAck
+	Pushes []*Push
+}
+
+// Add the ack of a message polled from the named mailbox
+func (tx *Transaction) Ack(name string, id MessageId) {
+	tx.Acks = append(tx.Acks, &TxAck{Name: name, MessageId: id})
+}
+
+// Add a push of msg to the named mailbox
+func (tx *Transaction) Push(name string, msg *Message) {
+	tx.Pushes = append(tx.Pushes, &Push{Name: name, Message: msg})
+}
+
 type ClientStats struct {
 	InFlight int
 }
+
+// Exchanged by the client and server when a session is setup so that
+// each side knows what the other supports.
+type Hello struct {
+	Version  int
+	Features []string
+	NodeId   string
+
+	// How often the client sends heartbeats, empty if it doesn't
+	Heartbeat string
+
+	// Set by a node that connects to another to forward messages, with
+	// the secret the nodes share. See Service.NodeSecret.
+	Node       bool
+	NodeSecret string
+}
+
+func (h *Hello) HasFeature(name string) bool {
+	for _, f := range h.Features {
+		if f == name {
+			return true
+		}
+	}
+
+	return false
+}
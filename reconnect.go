@@ -0,0 +1,301 @@
+package vega
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/vektra/errors"
+)
+
+const DefaultReconnectDelay = 100 * time.Millisecond
+const DefaultMaxReconnectDelay = 30 * time.Second
+
+var ESessionLost = errors.New("session to server lost")
+
+type ClientEventType int
+
+const (
+	// The session to the server was lost. The Client is reconnecting
+	// in the background.
+	Disconnected ClientEventType = iota
+
+	// A new session was setup and the client's ephemeral mailboxes,
+	// LWTs and locks were restored.
+	Reconnected
+)
+
+type ClientEvent struct {
+	Type ClientEventType
+
+	// Why the session was lost, or for Reconnected, the first error
+	// restoring ephemeral mailboxes, LWTs and locks, if any.
+	Err error
+}
+
+// Return a channel that reports when the session to the server is
+// lost and when it is reestablished. Events are dropped if the channel
+// is not kept drained.
+func (c *Client) Events() <-chan ClientEvent {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.events == nil {
+		c.events = make(chan ClientEvent, 16)
+	}
+
+	return c.events
+}
+
+// Must be called with c.lock held
+func (c *Client) emit(ev ClientEvent) {
+	if c.events == nil {
+		return
+	}
+
+	select {
+	case c.events <- ev:
+	default:
+		debugf("client %s: dropped event %d\n", c.addr, ev.Type)
+	}
+}
+
+func (c *Client) reconnectDelay() time.Duration {
+	if c.ReconnectDelay > 0 {
+		return c.ReconnectDelay
+	}
+
+	return DefaultReconnectDelay
+}
+
+func (c *Client) maxReconnectDelay() time.Duration {
+	if c.MaxReconnectDelay > 0 {
+		return c.MaxReconnectDelay
+	}
+
+	return DefaultMaxReconnectDelay
+}
+
+// Notice when sess goes away even if the client is idle
+func (c *Client) watch(sess *yamux.Session) {
+	<-sess.CloseChan()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.lost(sess, ESessionLost)
+}
+
+func (c *Client) heartbeatInterval() time.Duration {
+	if c.HeartbeatInterval != 0 {
+		return c.HeartbeatInterval
+	}
+
+	return DefaultHeartbeatInterval
+}
+
+// Let the server know we're alive and check that it is too. A heartbeat
+// that goes unanswered means the session is lost.
+func (c *Client) heartbeat(sess *yamux.Session, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sess.CloseChan():
+			return
+		case <-ticker.C:
+		}
+
+		c.lock.Lock()
+		current := c.sess == sess
+		c.lock.Unlock()
+
+		if !current {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		_, err := c.request(ctx, HeartbeatType, nil)
+		cancel()
+
+		if err != nil {
+			c.lock.Lock()
+			c.lost(sess, errors.Subject(ESessionLost, "heartbeat failed: "+err.Error()))
+			c.lock.Unlock()
+			return
+		}
+	}
+}
+
+// Forget sess because it has failed and start reconnecting. Must be
+// called with c.lock held.
+func (c *Client) lost(sess *yamux.Session, err error) {
+	if c.sess != sess {
+		return
+	}
+
+	debugf("client %s: lost session: %s\n", c.addr, err)
+
+	if c.pipe != nil {
+		c.pipe.close()
+		c.pipe = nil
+	}
+
+	sess.Close()
+
+	c.sess = nil
+	c.conn = nil
+	c.server = nil
+	c.disconnected = true
+
+	c.emit(ClientEvent{Type: Disconnected, Err: err})
+
+	if !c.reconnecting {
+		c.reconnecting = true
+		go c.reconnect()
+	}
+}
+
+// Try to setup a new session, backing off between attempts. Stops
+// once a session exists, either setup here or by a request, or if
+// the client is closed.
+func (c *Client) reconnect() {
+	delay := c.reconnectDelay()
+
+	// Checked with c.lock held so that a session lost right after is
+	// noticed by lost, which starts reconnecting again.
+	finished := func() bool {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		if c.closed || c.sess != nil {
+			c.reconnecting = false
+			return true
+		}
+
+		return false
+	}
+
+	for {
+		time.Sleep(delay)
+
+		if finished() {
+			return
+		}
+
+		_, err := c.session()
+		if err == nil {
+			if finished() {
+				return
+			}
+
+			continue
+		}
+
+		debugf("client %s: reconnect failed: %s\n", c.addr, err)
+
+		delay *= 2
+		if max := c.maxReconnectDelay(); delay > max {
+			delay = max
+		}
+	}
+}
+
+func (c *Client) rememberLWT(msg *Message) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.lwts == nil {
+		c.lwts = make(map[string]*Message)
+	}
+
+	dup := *msg
+	c.lwts[msg.CorrelationId] = &dup
+}
+
+// The server side state of a client, copied so that it can be restored
+// on a new session without holding c.lock
+type clientState struct {
+	ephemerals []string
+	lwts       []*Message
+	locks      []string
+}
+
+// Must be called with c.lock held
+func (c *Client) state() *clientState {
+	st := &clientState{}
+
+	for name := range c.ephemerals {
+		st.ephemerals = append(st.ephemerals, name)
+	}
+
+	for _, lwt := range c.lwts {
+		msg := *lwt
+		st.lwts = append(st.lwts, &msg)
+	}
+
+	for name := range c.locks {
+		st.locks = append(st.locks, name)
+	}
+
+	return st
+}
+
+// Declare the client's ephemeral mailboxes and LWTs and take its locks
+// again on a new session. The locks that couldn't be taken again are
+// returned first.
+// Errors reported by the server are returned as the second value so
+// that one bad mailbox doesn't prevent reconnecting.
+func (c *Client) restore(sess *yamux.Session, st *clientState) (lostLocks []string, restoreErr, err error) {
+	check := func(resp *response) {
+		if resp.Type != SuccessType && restoreErr == nil {
+			restoreErr = resp.error()
+		}
+	}
+
+	for _, name := range st.ephemerals {
+		var resp *response
+
+		resp, err = c.streamRequest(sess, EphemeralDeclareType, &Declare{Name: name}, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		check(resp)
+	}
+
+	for _, msg := range st.lwts {
+		var resp *response
+
+		resp, err = c.streamRequest(sess, PushType, &Push{Name: ":lwt", Message: msg}, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		check(resp)
+	}
+
+	// A standby may have taken over a lock while we were away, in
+	// which case it's no longer ours.
+	for _, name := range st.locks {
+		var resp *response
+
+		resp, err = c.streamRequest(sess, LockType, &Lock{Name: name}, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if resp.Type != SuccessType {
+			lostLocks = append(lostLocks, name)
+		}
+
+		check(resp)
+	}
+
+	if restoreErr != nil {
+		debugf("client %s: error restoring state: %s\n", c.addr, restoreErr)
+	}
+
+	return lostLocks, restoreErr, nil
+}
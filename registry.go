@@ -12,6 +12,10 @@ type Registry struct {
 
 	mailboxes map[string]Mailbox
 	creator   func(string) Mailbox
+
+	// Applies transactions to the mailboxes made by creator. Only
+	// needed if they aren't MemMailboxes.
+	Transactor MailboxTransactor
 }
 
 func NewRegistry(create func(string) Mailbox) *Registry {
@@ -120,3 +120,70 @@ func TestLongPollRegistryIsCancelable(t *testing.T) {
 	assert.NotNil(t, try)
 	assert.True(t, msg.Equal(try.Message))
 }
+
+func TestRegistryTransact(t *testing.T) {
+	r := NewMemRegistry()
+
+	r.Declare("a")
+	r.Declare("b")
+
+	r.Push("a", Msg([]byte("in")))
+
+	del, err := r.Poll("a")
+	if err != nil {
+		panic(err)
+	}
+
+	var tx Transaction
+	tx.Ack("a", del.Message.MessageId)
+	tx.Push("b", Msg([]byte("out")))
+
+	err = r.Transact(&tx)
+	if err != nil {
+		panic(err)
+	}
+
+	assert.Equal(t, 0, r.mailboxes["a"].Stats().InFlight)
+
+	out, err := r.Poll("b")
+	if err != nil {
+		panic(err)
+	}
+
+	assert.Equal(t, []byte("out"), out.Message.Body)
+}
+
+func TestRegistryTransactIsAtomic(t *testing.T) {
+	r := NewMemRegistry()
+
+	r.Declare("a")
+	r.Declare("b")
+
+	r.Push("a", Msg([]byte("in")))
+
+	del, err := r.Poll("a")
+	if err != nil {
+		panic(err)
+	}
+
+	var tx Transaction
+	tx.Ack("a", del.Message.MessageId)
+	tx.Ack("a", "bogus")
+	tx.Push("b", Msg([]byte("out")))
+
+	err = r.Transact(&tx)
+	assert.Error(t, err)
+
+	assert.Equal(t, 1, r.mailboxes["a"].Stats().InFlight)
+	assert.Equal(t, 0, r.mailboxes["b"].Stats().Size)
+
+	// Unknown mailboxes fail the whole transaction too
+	tx = Transaction{}
+	tx.Ack("a", del.Message.MessageId)
+	tx.Push("c", Msg([]byte("out")))
+
+	err = r.Transact(&tx)
+	assert.Error(t, err)
+
+	assert.Equal(t, 1, r.mailboxes["a"].Stats().InFlight)
+}
@@ -1,5 +1,11 @@
 package vega
 
+import (
+	"sync"
+
+	"github.com/vektra/errors"
+)
+
 type MemRouteTable map[string]Pusher
 
 func (ht MemRouteTable) Set(name string, st Pusher) error {
@@ -19,10 +25,22 @@ func (ht MemRouteTable) Get(name string) (Pusher, bool) {
 
 type Router struct {
 	routes RouteTable
+
+	lock      sync.Mutex
+	exchanges map[string]*Exchange
+	aliases   map[string]*Alias
+
+	typeRoutes map[string]*TypeRoute
 }
 
 func NewRouter(rt RouteTable) *Router {
-	return &Router{rt}
+	return &Router{
+		routes:    rt,
+		exchanges: make(map[string]*Exchange),
+		aliases:   make(map[string]*Alias),
+
+		typeRoutes: make(map[string]*TypeRoute),
+	}
 }
 
 func MemRouter() *Router {
@@ -43,11 +61,75 @@ func (r *Router) DiscoverEndpoint(name string) (Pusher, bool) {
 	return reg, ok
 }
 
+// Return the name that body pushed to name is delivered to, after any
+// type route, and the Pusher that handles it.
+func (r *Router) Route(name string, body *Message) (string, Pusher, bool) {
+	name = r.typeTarget(name, body)
+
+	reg, ok := r.routes.Get(name)
+
+	return name, reg, ok
+}
+
 func (r *Router) Push(name string, body *Message) error {
-	if storage, ok := r.routes.Get(name); ok {
+	name, storage, ok := r.Route(name, body)
+
+	if ok {
 		debugf("Routing %s to %#v\n", name, storage)
 		return storage.Push(name, body)
 	}
 
 	return ENoMailbox
 }
+
+// Push msg to each of targets. If they're all mailboxes of the same
+// Storage, msg is pushed to them in one transaction so that either all
+// of them get it or none do. Otherwise they're pushed to in turn and an
+// error part way leaves msg with the targets before it, so delivery is
+// at least once. In that case msg is given a DedupId, if it has none,
+// so that retries of the pushes are dropped by nodes that dedup them.
+func (r *Router) pushAll(targets []string, msg *Message) error {
+	var (
+		tx    Transaction
+		local Storage
+	)
+
+	for _, target := range targets {
+		name, pusher, ok := r.Route(target, msg)
+		if !ok {
+			local = nil
+			break
+		}
+
+		st, ok := pusher.(Storage)
+		if !ok || (local != nil && st != local) {
+			local = nil
+			break
+		}
+
+		local = st
+		tx.Push(name, msg)
+	}
+
+	if local != nil {
+		err := local.Transact(&tx)
+		if err == nil || !errors.Equal(err, ETransactUnsupported) {
+			return err
+		}
+	}
+
+	if len(targets) > 1 && msg.DedupId() == "" {
+		msg = msg.withHeader(DedupHeader, generateUUID())
+	}
+
+	var final error
+
+	for _, target := range targets {
+		err := r.Push(target, msg)
+		if err != nil {
+			final = err
+		}
+	}
+
+	return final
+}
@@ -1,10 +1,16 @@
 package vega
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
 	"io"
 	"net"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/yamux"
@@ -15,21 +21,95 @@ import (
 
 const DefaultPort = 8475
 
+// The path of the unix domain socket a local vegad listens on when
+// it's configured to. Local() prefers this over DefaultPort when present.
+const DefaultSocketPath = "/var/run/vega.sock"
+
 var msgpack codec.MsgpackHandle
 
 var EProtocolError = errors.New("protocol error")
+var EMalformedFrame = errors.New("malformed frame")
+var EFrameTooLarge = errors.New("frame too large")
+var EMessageTooLarge = errors.New("message too large")
+var ETooManyWaiting = errors.New("too many pipelined requests waiting")
+
+// Limits used when a Service doesn't specify its own
+const DefaultMaxMessageSize = 16 * 1024 * 1024
+const DefaultMaxFrameSize = DefaultMaxMessageSize + 64*1024
+const DefaultMaxPipelined = 256
+
+// How long a client that sends heartbeats may go quiet before the
+// service gives up on it, and how often a Client sends them.
+const DefaultHeartbeatTimeout = 90 * time.Second
+const DefaultHeartbeatInterval = 30 * time.Second
+
+// Where yamux logs to
+var muxLogOutput io.Writer = os.Stderr
+
+// Build the yamux config for a new session. Zero values leave the
+// yamux defaults in place.
+func newMuxConfig(keepAlive, writeTimeout time.Duration) *yamux.Config {
+	conf := yamux.DefaultConfig()
+	conf.LogOutput = muxLogOutput
+
+	if keepAlive > 0 {
+		conf.KeepAliveInterval = keepAlive
+	}
+
+	if writeTimeout > 0 {
+		conf.ConnectionWriteTimeout = writeTimeout
+	}
 
-var muxConfig = yamux.DefaultConfig()
+	return conf
+}
 
 type Service struct {
 	Address  string
 	Registry Storage
 
-	listener net.Listener
+	// Identifies this node to clients in the hello exchange
+	NodeId string
+
+	// The hops and node path of pushed messages are only kept from
+	// connections that say in their hello that they're from another
+	// node, see NewNodeClient, and carry this secret. Everyone else's
+	// are stripped. Empty means no connection is trusted as a node.
+	NodeSecret string
+
+	// The largest frame and message body a client may send.
+	// Zero means DefaultMaxFrameSize and DefaultMaxMessageSize.
+	MaxFrameSize   int
+	MaxMessageSize int
+
+	// How many pipelined requests on one stream are worked on at
+	// once, and separately how many long polls and waits for locks
+	// may be outstanding on it. Zero means DefaultMaxPipelined.
+	MaxPipelined int
+
+	// How often yamux pings each client and how long a write to one
+	// may block before the connection is dropped. Zero means the yamux
+	// defaults.
+	KeepAliveInterval      time.Duration
+	ConnectionWriteTimeout time.Duration
+
+	// Clients that send heartbeats are cleaned up if nothing is heard
+	// from them for this long, or 3 of their heartbeat intervals if that
+	// is longer. Zero means DefaultHeartbeatTimeout.
+	HeartbeatTimeout time.Duration
+
+	// The exclusive consumer locks on mailboxes. Share these with an
+	// HTTPService serving the same Registry.
+	Locks *ConsumerLocks
+
+	listener     net.Listener
+	unixListener net.Listener
 
 	wg     sync.WaitGroup
 	closed bool
 
+	clients map[*clientData]struct{}
+
+	drain    chan struct{}
 	shutdown chan struct{}
 	lock     sync.Mutex
 }
@@ -53,7 +133,11 @@ func NewService(addr string, reg Storage) (*Service, error) {
 	s := &Service{
 		Address:  addr,
 		Registry: reg,
+		NodeId:   l.Addr().String(),
+		Locks:    NewConsumerLocks(),
 		listener: l,
+		clients:  make(map[*clientData]struct{}),
+		drain:    make(chan struct{}),
 		shutdown: make(chan struct{}),
 	}
 
@@ -67,20 +151,123 @@ func NewMemService(addr string) (*Service, error) {
 }
 
 func (s *Service) Close() error {
-	debugf("beginning shutdown\n")
+	s.lock.Lock()
+
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+
 	s.closed = true
+
+	s.lock.Unlock()
+
+	debugf("beginning shutdown\n")
 	close(s.shutdown)
-	s.listener.Close()
+	s.closeListeners()
 	s.wg.Wait()
 	debugf("finished shutdown\n")
 	return nil
 }
 
+func (s *Service) closeListeners() {
+	s.listener.Close()
+	if s.unixListener != nil {
+		s.unixListener.Close()
+	}
+}
+
+var EDraining = errors.New("service is draining")
+
+// How often Drain checks if clients have finished with their messages
+const drainCheckInterval = 50 * time.Millisecond
+
+// Stop taking new connections and handing out messages, then give
+// clients up to grace to ack or nack the messages they already hold
+// before closing the service. Polls made while draining fail with
+// EDraining. Clients that still hold messages after grace are cleaned
+// up as usual: their LWTs fire and their messages are nack'd.
+func (s *Service) Drain(grace time.Duration) error {
+	s.lock.Lock()
+
+	select {
+	case <-s.drain:
+	default:
+		close(s.drain)
+	}
+
+	s.lock.Unlock()
+
+	debugf("%s: draining\n", s.Address)
+
+	s.closeListeners()
+
+	deadline := time.Now().Add(grace)
+
+	for s.inflightCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainCheckInterval)
+	}
+
+	return s.Close()
+}
+
+func (s *Service) draining() bool {
+	select {
+	case <-s.drain:
+		return true
+	default:
+		return false
+	}
+}
+
+// The number of messages handed to clients that are not yet
+// ack'd or nack'd.
+func (s *Service) inflightCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	count := 0
+
+	for data := range s.clients {
+		count += len(data.inflight)
+	}
+
+	return count
+}
+
+// Listen on the unix domain socket at path as well as the address
+// the service was created with. The socket file is given the permissions
+// in perm so that access to it can be restricted to certain users.
+// Connections on the socket are handled by AcceptUnix.
+func (s *Service) ListenUnix(path string, perm os.FileMode) error {
+	l, err := listenUnix(path, perm)
+	if err != nil {
+		return err
+	}
+
+	s.unixListener = l
+
+	s.wg.Add(1)
+
+	return nil
+}
+
+// Accept connections on the unix domain socket setup by ListenUnix.
+// Like AcceptInsecure, the connections are not encrypted because the
+// permissions on the socket file protect it.
+func (s *Service) AcceptUnix() error {
+	return s.acceptInsecure(s.unixListener)
+}
+
 func (s *Service) AcceptInsecure() error {
+	return s.acceptInsecure(s.listener)
+}
+
+func (s *Service) acceptInsecure(l net.Listener) error {
 	defer s.wg.Done()
 
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := l.Accept()
 		if err != nil {
 			return err
 		}
@@ -138,13 +325,24 @@ type clientEphemeralInfo struct {
 }
 
 type clientData struct {
+	// UnixNano of the last frame from the client, kept first
+	// for atomic access.
+	lastSeen int64
+
+	id         string
 	parent     net.Conn
 	session    *yamux.Session
 	inflight   map[MessageId]*Delivery
+	mailboxes  map[MessageId]string
 	ephemerals map[string]*clientEphemeralInfo
 	closed     bool
 	done       chan struct{}
 	lwt        *Message
+	hello      *Hello
+	heartbeat  bool
+
+	// set if the client proved in its hello that it's another node
+	node bool
 }
 
 func (s *Service) cleanupConn(c net.Conn, data *clientData) {
@@ -176,8 +374,13 @@ func (s *Service) cleanupConn(c net.Conn, data *clientData) {
 		}
 
 		data.inflight = nil
+		data.mailboxes = nil
 	}
 
+	// Released after the nacks so a standby that takes over sees
+	// the messages this client held.
+	s.Locks.ReleaseAll(data.id)
+
 	for name, info := range data.ephemerals {
 		s.Registry.Abandon(name)
 		if info.lwt != nil {
@@ -198,6 +401,8 @@ func (s *Service) cleanupConn(c net.Conn, data *clientData) {
 	data.session.Close()
 
 	data.closed = true
+
+	delete(s.clients, data)
 }
 
 type acceptStream struct {
@@ -208,13 +413,11 @@ type acceptStream struct {
 func (s *Service) acceptMux(c net.Conn) {
 	defer s.wg.Done()
 
-	session, err := yamux.Server(c, muxConfig)
+	session, err := yamux.Server(c, newMuxConfig(s.KeepAliveInterval, s.ConnectionWriteTimeout))
 	if err != nil {
-		if eofish(err) {
-			return
-		}
-
-		panic(err)
+		debugf("unable to start session for %s: %s\n", c.RemoteAddr(), err)
+		c.Close()
+		return
 	}
 
 	defer session.Close()
@@ -224,13 +427,20 @@ func (s *Service) acceptMux(c net.Conn) {
 	debugf("new session for %s\n", c.RemoteAddr())
 
 	data := &clientData{
+		id:         generateUUIDSecure(),
 		parent:     c,
 		session:    session,
 		inflight:   make(map[MessageId]*Delivery),
+		mailboxes:  make(map[MessageId]string),
 		ephemerals: make(map[string]*clientEphemeralInfo),
 		done:       make(chan struct{}),
+		lastSeen:   time.Now().UnixNano(),
 	}
 
+	s.lock.Lock()
+	s.clients[data] = struct{}{}
+	s.lock.Unlock()
+
 	for {
 		go func() {
 			stream, err := session.AcceptStream()
@@ -244,13 +454,9 @@ func (s *Service) acceptMux(c net.Conn) {
 			return
 		case ac := <-acs:
 			if ac.err != nil {
-				if eofish(ac.err) {
-					debugf("eof detected starting a new stream\n")
-					s.cleanupConn(c, data)
-					return
-				}
-
-				panic(ac.err)
+				debugf("error accepting stream from %s: %s\n", c.RemoteAddr(), ac.err)
+				s.cleanupConn(c, data)
+				return
 			}
 
 			go s.handle(c, ac.stream, data)
@@ -258,229 +464,629 @@ func (s *Service) acceptMux(c net.Conn) {
 	}
 }
 
+// Read the body of a frame into v, reading at most MaxFrameSize bytes.
+// Errors other than the client going away are reported as EMalformedFrame
+// or EFrameTooLarge.
+func (s *Service) decodeFrame(r io.Reader, v interface{}) error {
+	frame, err := readFrame(r, s.maxFrameSize())
+	if err != nil {
+		if err == EFrameTooLarge || errors.Equal(err, EMalformedFrame) || eofish(err) {
+			return err
+		}
+
+		return errors.Subject(EMalformedFrame, err.Error())
+	}
+
+	err = codec.NewDecoderBytes(frame, &msgpack).Decode(v)
+	if err != nil {
+		return errors.Subject(EMalformedFrame, err.Error())
+	}
+
+	return nil
+}
+
+func (s *Service) maxFrameSize() int {
+	if s.MaxFrameSize > 0 {
+		return s.MaxFrameSize
+	}
+
+	return DefaultMaxFrameSize
+}
+
+func (s *Service) maxPipelined() int {
+	if s.MaxPipelined > 0 {
+		return s.MaxPipelined
+	}
+
+	return DefaultMaxPipelined
+}
+
+func (s *Service) maxMessageSize() int {
+	if s.MaxMessageSize > 0 {
+		return s.MaxMessageSize
+	}
+
+	return DefaultMaxMessageSize
+}
+
+// Drop a client whose request caused a panic. A bug tickled by one
+// client must not take down the whole service. Only the session is
+// closed here, acceptMux sees it go and cleans up the client, so that
+// recovering never waits on s.lock.
+func (s *Service) recoverClient(parent net.Conn, data *clientData) {
+	if r := recover(); r != nil {
+		debugf("%s: panic handling %s: %v\n", s.Address, parent.RemoteAddr(), r)
+		data.session.Close()
+	}
+}
+
+// Run fn holding s.lock. Handlers take the lock through this so that
+// the lock is released even if fn panics.
+func (s *Service) locked(fn func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	fn()
+}
+
+// Serializes whole responses onto a stream so that responses to
+// pipelined requests don't interleave.
+type streamWriter struct {
+	lock sync.Mutex
+	c    net.Conn
+}
+
+func (sw *streamWriter) respond(tagged bool, id uint64, resp []byte) error {
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+
+	if tagged {
+		var hdr []byte
+
+		err := codec.NewEncoderBytes(&hdr, &msgpack).Encode(id)
+		if err != nil {
+			return err
+		}
+
+		resp = append(append([]byte{uint8(TaggedType)}, hdr...), resp...)
+	}
+
+	_, err := sw.c.Write(resp)
+	return err
+}
+
+func errorResponse(err error) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteByte(uint8(ErrorType))
+	codec.NewEncoder(&buf, &msgpack).Encode(&Error{err.Error()})
+
+	return buf.Bytes()
+}
+
 func (s *Service) handle(parent, c net.Conn, data *clientData) {
 	defer c.Close()
+	defer s.recoverClient(parent, data)
+
+	r := bufio.NewReader(c)
+	sw := &streamWriter{c: c}
 
-	buf := []byte{0}
+	// Limits how many pipelined requests on this stream we'll
+	// work on at once, and how many more may wait for a slot.
+	slots := make(chan struct{}, s.maxPipelined())
+	queued := make(chan struct{}, s.maxPipelined())
+
+	// Long polls and waits for locks can take as long as they like,
+	// so they have a budget of their own rather than holding slots
+	// that acks and nacks need. Once it's used up more of them are
+	// refused rather than waited on, so that this loop keeps reading
+	// cancels.
+	waiting := make(chan struct{}, s.maxPipelined())
+
+	pending := &pendingRequests{requests: make(map[uint64]chan struct{})}
+
+	run := func(t MessageType, req interface{}, id uint64, cancel <-chan struct{}) {
+		defer pending.remove(id)
+
+		resp := s.process(t, req, cancel, parent, data)
+		if resp != nil {
+			sw.respond(true, id, resp)
+		}
+	}
 
 	for {
-		n, err := c.Read(buf)
-		if n == 0 || err != nil {
+		t, err := r.ReadByte()
+		if err != nil {
 			return
 		}
 
-		switch MessageType(buf[0]) {
-		case DeclareType:
-			msg := &Declare{}
-			dec := codec.NewDecoder(c, &msgpack)
+		atomic.StoreInt64(&data.lastSeen, time.Now().UnixNano())
 
-			err = dec.Decode(msg)
-			if err != nil {
-				return
+		var id uint64
+
+		tagged := MessageType(t) == TaggedType
+
+		if tagged {
+			err = s.decodeFrame(r, &id)
+			if err == nil {
+				t, err = r.ReadByte()
 			}
+		}
+
+		var req interface{}
 
-			err = s.handleDeclare(c, msg)
-		case EphemeralDeclareType:
-			msg := &Declare{}
-			dec := codec.NewDecoder(c, &msgpack)
+		if err == nil {
+			req, err = s.readRequest(r, MessageType(t))
+		}
 
-			err = dec.Decode(msg)
-			if err != nil {
+		if err != nil {
+			if eofish(err) {
 				return
 			}
 
-			err = s.handleEphemeralDeclare(c, msg, parent, data)
-		case AbandonType:
-			msg := &Abandon{}
-			dec := codec.NewDecoder(c, &msgpack)
-
-			err = dec.Decode(msg)
-			if err != nil {
+			if sw.respond(tagged, id, errorResponse(err)) != nil {
 				return
 			}
 
-			err = s.handleAbandon(c, msg, data)
-		case PollType:
-			msg := &Poll{}
-			dec := codec.NewDecoder(c, &msgpack)
+			// An unknown type leaves the rest of the frame unparsable,
+			// so we give up on the stream but leave the session alone.
+			// Otherwise we can't trust anything else this client sends.
+			if err != EProtocolError {
+				debugf("%s: closing session to %s: %s\n", s.Address, parent.RemoteAddr(), err)
+				s.cleanupConn(parent, data)
+			}
+
+			return
+		}
 
-			err = dec.Decode(msg)
-			if err != nil {
-				panic(err)
+		if !tagged {
+			resp := s.process(MessageType(t), req, nil, parent, data)
+			if resp == nil {
+				return
 			}
 
-			err = s.handlePoll(c, msg, data)
-		case LongPollType:
-			msg := &LongPoll{}
-			dec := codec.NewDecoder(c, &msgpack)
+			if sw.respond(false, 0, resp) != nil {
+				return
+			}
 
-			err = dec.Decode(msg)
-			if err != nil {
-				if eofish(err) {
-					return
-				}
+			continue
+		}
 
-				panic(err)
+		// Cancels and heartbeats are answered here rather than taking
+		// a slot, so that they get through while every slot is busy.
+		switch MessageType(t) {
+		case CancelType:
+			// Refers to an earlier request with the same id. The
+			// canceled request still sends its response.
+			pending.cancel(id)
+			continue
+		case HeartbeatType:
+			resp := s.process(HeartbeatType, req, nil, parent, data)
+			if resp == nil || sw.respond(true, id, resp) != nil {
+				return
 			}
 
-			err = s.handleLongPoll(c, msg, data)
-		case PushType:
-			msg := &Push{}
-			dec := codec.NewDecoder(c, &msgpack)
+			continue
+		}
 
-			err = dec.Decode(msg)
-			if err != nil {
-				if eofish(err) {
+		if waits(MessageType(t), req) {
+			select {
+			case waiting <- struct{}{}:
+			default:
+				if sw.respond(true, id, errorResponse(ETooManyWaiting)) != nil {
 					return
 				}
 
-				panic(err)
+				continue
 			}
 
-			err = s.handlePush(c, msg, data)
-		case CloseType:
-			err = s.handleClose(c, parent, data)
-		case StatsType:
-			err = s.handleStats(c, data)
+			cancel := pending.add(id)
 
-		case AckType:
-			msg := &AckMessage{}
-			dec := codec.NewDecoder(c, &msgpack)
+			go func(t MessageType, req interface{}, id uint64) {
+				defer func() { <-waiting }()
 
-			err = dec.Decode(msg)
-			if err != nil {
-				return
-			}
+				run(t, req, id, cancel)
+			}(MessageType(t), req, id)
 
-			err = s.handleAck(c, msg, data)
-		case NackType:
-			msg := &NackMessage{}
-			dec := codec.NewDecoder(c, &msgpack)
+			continue
+		}
 
-			err = dec.Decode(msg)
-			if err != nil {
-				return
-			}
+		cancel := pending.add(id)
 
-			err = s.handleNack(c, msg, data)
-		default:
-			err = EProtocolError
-		}
+		// Requests wait for a slot off of this loop so it keeps reading
+		// cancels, until too many are waiting.
+		queued <- struct{}{}
 
-		if err != nil {
-			c.Write([]byte{uint8(ErrorType)})
+		go func(t MessageType, req interface{}, id uint64) {
+			slots <- struct{}{}
+			<-queued
 
-			enc := codec.NewEncoder(c, &msgpack)
+			defer func() { <-slots }()
 
-			err = enc.Encode(&Error{err.Error()})
-			if err != nil {
-				switch err {
-				case yamux.ErrStreamClosed:
-					return
-				case yamux.ErrSessionShutdown:
-					return
-				default:
-					panic(err)
-				}
-			}
-		}
+			run(t, req, id, cancel)
+		}(MessageType(t), req, id)
 	}
 }
 
-func (s *Service) handleDeclare(c net.Conn, msg *Declare) error {
-	err := s.Registry.Declare(msg.Name)
-	if err != nil {
-		return err
+// Indicates if a request may wait on other clients, rather than only
+// on the Registry.
+func waits(t MessageType, req interface{}) bool {
+	switch t {
+	case LongPollType:
+		return true
+	case LockType:
+		return req.(*Lock).Wait != ""
+	default:
+		return false
 	}
+}
 
-	_, err = c.Write([]byte{uint8(SuccessType)})
-	return err
+// The pipelined requests on a stream that are still being worked on,
+// so that they can be canceled.
+type pendingRequests struct {
+	lock     sync.Mutex
+	requests map[uint64]chan struct{}
 }
 
-func (s *Service) handleEphemeralDeclare(
-	c net.Conn, msg *Declare,
-	parent net.Conn, data *clientData) error {
+func (p *pendingRequests) add(id uint64) chan struct{} {
+	p.lock.Lock()
+	defer p.lock.Unlock()
 
-	err := s.Registry.Declare(msg.Name)
+	cancel := make(chan struct{})
+	p.requests[id] = cancel
+
+	return cancel
+}
+
+func (p *pendingRequests) remove(id uint64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	delete(p.requests, id)
+}
+
+func (p *pendingRequests) cancel(id uint64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if cancel, ok := p.requests[id]; ok {
+		close(cancel)
+		delete(p.requests, id)
+	}
+}
+
+// Read the body of a request of type t
+func (s *Service) readRequest(r io.Reader, t MessageType) (interface{}, error) {
+	var msg interface{}
+
+	switch t {
+	case DeclareType, EphemeralDeclareType:
+		msg = &Declare{}
+	case AbandonType:
+		msg = &Abandon{}
+	case PollType:
+		msg = &Poll{}
+	case LongPollType:
+		msg = &LongPoll{}
+	case PushType:
+		msg = &Push{}
+	case HelloType:
+		msg = &Hello{}
+	case AckType:
+		msg = &AckMessage{}
+	case NackType:
+		msg = &NackMessage{}
+	case LockType:
+		msg = &Lock{}
+	case UnlockType:
+		msg = &Unlock{}
+	case TransactType:
+		msg = &Transaction{}
+	case AckManyType:
+		msg = &AckManyMessage{}
+	case NackManyType:
+		msg = &NackManyMessage{}
+	case AckThroughType:
+		msg = &AckThroughMessage{}
+	case DeclareExchangeType:
+		msg = &Exchange{}
+	case DeleteExchangeType:
+		msg = &DeleteExchange{}
+	case BindType, UnbindType:
+		msg = &BindMessage{}
+	case SetAliasType:
+		msg = &Alias{}
+	case RemoveAliasType:
+		msg = &RemoveAlias{}
+	case SetTypeRouteType:
+		msg = &TypeRoute{}
+	case RemoveTypeRouteType:
+		msg = &RemoveTypeRoute{}
+	case CloseType, StatsType, CancelType, HeartbeatType, ExchangesType, AliasesType,
+		TypeRoutesType:
+		return nil, nil
+	default:
+		return nil, EProtocolError
+	}
+
+	err := s.decodeFrame(r, msg)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	s.lock.Lock()
+	return msg, nil
+}
 
-	data.ephemerals[msg.Name] = &clientEphemeralInfo{}
+// Perform a request and return the encoded response. Returns nil if
+// the client has gone away and there is no one to respond to. cancel
+// is closed if the client gives up on the request.
+func (s *Service) process(t MessageType, req interface{}, cancel <-chan struct{}, parent net.Conn, data *clientData) []byte {
+	defer s.recoverClient(parent, data)
 
-	s.lock.Unlock()
+	var buf bytes.Buffer
 
-	_, err = c.Write([]byte{uint8(SuccessType)})
-	return err
+	err := s.dispatch(&buf, t, req, cancel, parent, data)
+	if err == nil {
+		return buf.Bytes()
+	}
+
+	if eofish(err) {
+		return nil
+	}
+
+	return errorResponse(err)
 }
 
-func (s *Service) handleAbandon(c net.Conn, msg *Abandon, data *clientData) error {
-	err := s.Registry.Abandon(msg.Name)
-	if err != nil {
+func (s *Service) dispatch(w io.Writer, t MessageType, req interface{}, cancel <-chan struct{}, parent net.Conn, data *clientData) error {
+	switch t {
+	case DeclareType:
+		return s.handleDeclare(w, req.(*Declare))
+	case EphemeralDeclareType:
+		return s.handleEphemeralDeclare(w, req.(*Declare), parent, data)
+	case AbandonType:
+		return s.handleAbandon(w, req.(*Abandon), data)
+	case PollType:
+		return s.handlePoll(w, req.(*Poll), data)
+	case LongPollType:
+		return s.handleLongPoll(w, req.(*LongPoll), cancel, data)
+	case PushType:
+		return s.handlePush(w, req.(*Push), data)
+	case HelloType:
+		return s.handleHello(w, req.(*Hello), data)
+	case CloseType:
+		return s.handleClose(w, parent, data)
+	case StatsType:
+		return s.handleStats(w, data)
+	case AckType:
+		return s.handleAck(w, req.(*AckMessage), data)
+	case NackType:
+		return s.handleNack(w, req.(*NackMessage), data)
+	case LockType:
+		return s.handleLock(w, req.(*Lock), cancel, data)
+	case UnlockType:
+		return s.handleUnlock(w, req.(*Unlock), data)
+	case TransactType:
+		return s.handleTransact(w, req.(*Transaction), data)
+	case AckManyType:
+		return s.handleAckMany(w, req.(*AckManyMessage).MessageIds, AckMany, data)
+	case NackManyType:
+		return s.handleAckMany(w, req.(*NackManyMessage).MessageIds, NackMany, data)
+	case AckThroughType:
+		return s.handleAckThrough(w, req.(*AckThroughMessage), data)
+	case DeclareExchangeType, DeleteExchangeType, BindType, UnbindType,
+		SetAliasType, RemoveAliasType, SetTypeRouteType, RemoveTypeRouteType:
+		return s.handleChange(w, t, req)
+	case ExchangesType, AliasesType, TypeRoutesType:
+		return s.handleList(w, t)
+	case HeartbeatType:
+		_, err := w.Write([]byte{uint8(SuccessType)})
 		return err
+	default:
+		return EProtocolError
 	}
+}
 
-	if info, ok := data.ephemerals[msg.Name]; ok {
-		if info.lwt != nil {
-			debugf("injecting ephemeral lwt 2 to %s\n", info.lwt.ReplyTo)
-			name := info.lwt.ReplyTo
-			info.lwt.ReplyTo = ""
-			err := s.Registry.Push(name, info.lwt)
-			if !errors.Equal(err, ENoMailbox) {
-				debugf("lwt ephemeral injection 2 error: %#v\n", err)
-			}
-		}
+func (s *Service) handleHello(c io.Writer, msg *Hello, data *clientData) error {
+	debugf("%s: client hello from %s (version %d)\n", s.Address, msg.NodeId, msg.Version)
+
+	interval, err := time.ParseDuration(msg.Heartbeat)
+	if err != nil {
+		interval = 0
 	}
 
-	_, err = c.Write([]byte{uint8(SuccessType)})
-	return err
-}
+	node := msg.Node && s.NodeSecret != "" &&
+		subtle.ConstantTimeCompare([]byte(msg.NodeSecret), []byte(s.NodeSecret)) == 1
 
-func (s *Service) handlePoll(c net.Conn, msg *Poll, data *clientData) error {
-	var ret PollResult
+	var start bool
 
-	if msg.Name == ":lwt" {
-		ret.Message = data.lwt
-	} else {
-		val, err := s.Registry.Poll(msg.Name)
-		if err != nil {
-			return err
+	s.locked(func() {
+		data.hello = msg
+		data.node = node
+		start = interval > 0 && !data.heartbeat
+		if start {
+			data.heartbeat = true
 		}
+	})
 
-		if val != nil {
-			data.inflight[val.Message.MessageId] = val
-			ret.Message = val.Message
+	if start {
+		timeout := s.heartbeatTimeout()
+		if timeout < 3*interval {
+			timeout = 3 * interval
 		}
+
+		go s.watchHeartbeat(data, timeout)
 	}
 
-	c.Write([]byte{uint8(PollResultType)})
+	ret := Hello{
+		Version:  ProtocolVersion,
+		Features: serverFeatures,
+		NodeId:   s.NodeId,
+	}
+
+	c.Write([]byte{uint8(HelloResultType)})
 	enc := codec.NewEncoder(c, &msgpack)
 	return enc.Encode(&ret)
 }
 
-func (s *Service) handleLongPoll(c net.Conn, msg *LongPoll, data *clientData) error {
-	debugf("handleLongPoll for %#v\n", s.Registry)
+func (s *Service) heartbeatTimeout() time.Duration {
+	if s.HeartbeatTimeout > 0 {
+		return s.HeartbeatTimeout
+	}
+
+	return DefaultHeartbeatTimeout
+}
+
+// Cleanup a client that promised heartbeats once nothing has been
+// heard from it for timeout. This catches half-open connections that
+// yamux would otherwise take much longer to notice.
+func (s *Service) watchHeartbeat(data *clientData, timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-data.done:
+			return
+		case <-ticker.C:
+			last := time.Unix(0, atomic.LoadInt64(&data.lastSeen))
+
+			if time.Since(last) > timeout {
+				debugf("%s: no heartbeat from %s in %s\n", s.Address, data.parent.RemoteAddr(), timeout)
+				s.cleanupConn(data.parent, data)
+				return
+			}
+		}
+	}
+}
+
+func (s *Service) handleDeclare(c io.Writer, msg *Declare) error {
+	err := s.Registry.Declare(msg.Name)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Write([]byte{uint8(SuccessType)})
+	return err
+}
+
+func (s *Service) handleEphemeralDeclare(
+	c io.Writer, msg *Declare,
+	parent net.Conn, data *clientData) error {
+
+	err := s.Registry.Declare(msg.Name)
+	if err != nil {
+		return err
+	}
+
+	s.locked(func() {
+		data.ephemerals[msg.Name] = &clientEphemeralInfo{}
+	})
 
+	_, err = c.Write([]byte{uint8(SuccessType)})
+	return err
+}
+
+func (s *Service) handleAbandon(c io.Writer, msg *Abandon, data *clientData) error {
+	err := s.Registry.Abandon(msg.Name)
+	if err != nil {
+		return err
+	}
+
+	var (
+		info *clientEphemeralInfo
+		ok   bool
+	)
+
+	s.locked(func() {
+		info, ok = data.ephemerals[msg.Name]
+	})
+
+	if ok {
+		if info.lwt != nil {
+			debugf("injecting ephemeral lwt 2 to %s\n", info.lwt.ReplyTo)
+			name := info.lwt.ReplyTo
+			info.lwt.ReplyTo = ""
+			err := s.Registry.Push(name, info.lwt)
+			if !errors.Equal(err, ENoMailbox) {
+				debugf("lwt ephemeral injection 2 error: %#v\n", err)
+			}
+		}
+	}
+
+	_, err = c.Write([]byte{uint8(SuccessType)})
+	return err
+}
+
+func (s *Service) handlePoll(c io.Writer, msg *Poll, data *clientData) error {
 	var ret PollResult
 
 	if msg.Name == ":lwt" {
 		ret.Message = data.lwt
 	} else {
+		if s.draining() {
+			return EDraining
+		}
+
+		err := s.Locks.Check(msg.Name, data.id)
+		if err != nil {
+			return err
+		}
+
+		val, err := s.Registry.Poll(msg.Name)
+		if err != nil {
+			return err
+		}
+
+		if val != nil {
+			if !s.addInflight(data, msg.Name, val) {
+				return io.EOF
+			}
+
+			ret.Message = val.Message
+		}
+	}
+
+	c.Write([]byte{uint8(PollResultType)})
+	enc := codec.NewEncoder(c, &msgpack)
+	return enc.Encode(&ret)
+}
+
+func (s *Service) handleLongPoll(c io.Writer, msg *LongPoll, cancel <-chan struct{}, data *clientData) error {
+	debugf("handleLongPoll for %#v\n", s.Registry)
+
+	var ret PollResult
+
+	if msg.Name == ":lwt" {
+		ret.Message = data.lwt
+	} else {
+		if s.draining() {
+			return EDraining
+		}
+
+		err := s.Locks.Check(msg.Name, data.id)
+		if err != nil {
+			return err
+		}
+
 		dur, err := time.ParseDuration(msg.Duration)
 		if err != nil {
 			return err
 		}
 
-		val, err := s.Registry.LongPollCancelable(msg.Name, dur, data.done)
+		done, finished := s.waitDone(cancel, data)
+		defer finished()
+
+		val, err := s.Registry.LongPollCancelable(msg.Name, dur, done)
 		if err != nil {
 			return err
 		}
 
 		if val != nil {
 			debugf("inflight for %s: %#v\n", data.parent.RemoteAddr(), data)
-			data.inflight[val.Message.MessageId] = val
+			if !s.addInflight(data, msg.Name, val) {
+				return io.EOF
+			}
+
 			ret.Message = val.Message
 		}
 	}
@@ -490,6 +1096,108 @@ func (s *Service) handleLongPoll(c net.Conn, msg *LongPoll, data *clientData) er
 	return enc.Encode(&ret)
 }
 
+// Return a channel that is closed if the client goes away, cancels
+// the request or the service starts draining. finished must be called
+// once the caller is no longer waiting.
+func (s *Service) waitDone(cancel <-chan struct{}, data *clientData) (done chan struct{}, finished func()) {
+	done = make(chan struct{})
+	stop := make(chan struct{})
+
+	go func() {
+		select {
+		case <-data.done:
+		case <-cancel:
+		case <-s.drain:
+		case <-stop:
+			return
+		}
+
+		close(done)
+	}()
+
+	return done, func() { close(stop) }
+}
+
+// Give the client exclusive use of a mailbox until it releases it or
+// goes away. Other clients' polls of the mailbox fail with
+// EMailboxLocked meanwhile.
+func (s *Service) handleLock(c io.Writer, msg *Lock, cancel <-chan struct{}, data *clientData) error {
+	var err error
+
+	if msg.Wait == "" {
+		err = s.Locks.Acquire(msg.Name, data.id, 0)
+	} else {
+		dur, perr := time.ParseDuration(msg.Wait)
+		if perr != nil {
+			return perr
+		}
+
+		done, finished := s.waitDone(cancel, data)
+		err = s.Locks.Wait(msg.Name, data.id, 0, dur, done)
+		finished()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// The client may have gone while we waited
+	var closed bool
+
+	s.locked(func() {
+		closed = data.closed
+	})
+
+	if closed {
+		s.Locks.Release(msg.Name, data.id)
+		return io.EOF
+	}
+
+	_, err = c.Write([]byte{uint8(SuccessType)})
+	return err
+}
+
+func (s *Service) handleUnlock(c io.Writer, msg *Unlock, data *clientData) error {
+	s.Locks.Release(msg.Name, data.id)
+
+	_, err := c.Write([]byte{uint8(SuccessType)})
+	return err
+}
+
+// Track a delivery from the named mailbox handed to the client. If the
+// client has already been cleaned up the delivery is nack'd so that it
+// isn't lost and false is returned.
+func (s *Service) addInflight(data *clientData, name string, del *Delivery) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if data.closed {
+		del.Nack()
+		return false
+	}
+
+	data.inflight[del.Message.MessageId] = del
+	data.mailboxes[del.Message.MessageId] = name
+	return true
+}
+
+func (s *Service) findInflight(data *clientData, id MessageId) (*Delivery, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	del, ok := data.inflight[id]
+	return del, ok
+}
+
+func (s *Service) removeInflight(data *clientData, id MessageId) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	debugf("removing %s from inflight\n", id)
+	delete(data.inflight, id)
+	delete(data.mailboxes, id)
+}
+
 func (s *Service) setupLWT(msg *Message, data *clientData) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -510,14 +1218,23 @@ func (s *Service) setupLWT(msg *Message, data *clientData) error {
 
 var ErrUknownSystemMailbox = errors.New("unknown system mailbox")
 
-func (s *Service) handleInternal(c net.Conn, msg *Push, data *clientData) error {
+// Indicates if the client is another node, whose messages' hops and
+// node path are trusted
+func (s *Service) fromNode(data *clientData) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return data.node
+}
+
+func (s *Service) handleInternal(c io.Writer, msg *Push, data *clientData) error {
 	var err error
 
 	switch msg.Name {
 	case ":lwt":
 		debugf("%s: setup LWT", s.Address)
 		err = s.setupLWT(msg.Message, data)
-	case ":publish", ":subscribe":
+	case ":publish", ":subscribe", ":unsubscribe":
 		err = s.Registry.Push(msg.Name, msg.Message)
 	default:
 		err = errors.Subject(ErrUknownSystemMailbox, msg.Name)
@@ -526,8 +1243,21 @@ func (s *Service) handleInternal(c net.Conn, msg *Push, data *clientData) error
 	return err
 }
 
-func (s *Service) handlePush(c net.Conn, msg *Push, data *clientData) error {
+func (s *Service) handlePush(c io.Writer, msg *Push, data *clientData) error {
 	debugf("%s: handlePush for %#v\n", s.Address, s.Registry)
+
+	if msg.Name == "" || msg.Message == nil {
+		return errors.Subject(EMalformedFrame, "push requires a name and message")
+	}
+
+	if len(msg.Message.Body) > s.maxMessageSize() {
+		return errors.Subject(EMessageTooLarge, msg.Name)
+	}
+
+	if !s.fromNode(data) {
+		msg.Message = msg.Message.untraced()
+	}
+
 	if msg.Name[0] == ':' {
 		err := s.handleInternal(c, msg, data)
 		if err != nil {
@@ -546,34 +1276,185 @@ func (s *Service) handlePush(c net.Conn, msg *Push, data *clientData) error {
 	return err
 }
 
-func (s *Service) handleClose(c, parent net.Conn, data *clientData) error {
+// Ack messages the client holds and push new ones atomically
+func (s *Service) handleTransact(c io.Writer, msg *Transaction, data *clientData) error {
+	var err error
+
+	s.locked(func() {
+		for _, ack := range msg.Acks {
+			if name, ok := data.mailboxes[ack.MessageId]; !ok || name != ack.Name {
+				err = errors.Subject(EUnknownMessage, string(ack.MessageId))
+				return
+			}
+		}
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, push := range msg.Pushes {
+		if push.Name == "" || push.Message == nil {
+			return errors.Subject(EMalformedFrame, "push requires a name and message")
+		}
+
+		if push.Name[0] == ':' {
+			return errors.Subject(ErrUknownSystemMailbox, push.Name)
+		}
+
+		if len(push.Message.Body) > s.maxMessageSize() {
+			return errors.Subject(EMessageTooLarge, push.Name)
+		}
+
+		if !s.fromNode(data) {
+			push.Message = push.Message.untraced()
+		}
+	}
+
+	err = s.Registry.Transact(msg)
+	if err != nil {
+		return err
+	}
+
+	for _, ack := range msg.Acks {
+		s.removeInflight(data, ack.MessageId)
+	}
+
+	_, err = c.Write([]byte{uint8(SuccessType)})
+	return err
+}
+
+func (s *Service) handleClose(c io.Writer, parent net.Conn, data *clientData) error {
 	s.cleanupConn(parent, data)
 
 	_, err := c.Write([]byte{uint8(SuccessType)})
 	return err
 }
 
-func (s *Service) handleStats(c net.Conn, data *clientData) error {
-	stats := &ClientStats{
-		InFlight: len(data.inflight),
+var (
+	EExchangesUnsupported  = errors.New("registry does not support exchanges")
+	EAliasesUnsupported    = errors.New("registry does not support aliases")
+	ETypeRoutesUnsupported = errors.New("registry does not support type routes")
+)
+
+// Change the exchanges, aliases or type routes of a Registry that
+// manages them
+func (s *Service) handleChange(c io.Writer, t MessageType, req interface{}) error {
+	err := s.change(t, req)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Write([]byte{uint8(SuccessType)})
+	return err
+}
+
+func (s *Service) change(t MessageType, req interface{}) error {
+	switch t {
+	case DeclareExchangeType, DeleteExchangeType, BindType, UnbindType:
+		em, ok := s.Registry.(ExchangeManager)
+		if !ok {
+			return EExchangesUnsupported
+		}
+
+		switch t {
+		case DeclareExchangeType:
+			return em.DeclareExchange(req.(*Exchange))
+		case DeleteExchangeType:
+			return em.DeleteExchange(req.(*DeleteExchange).Name)
+		case BindType:
+			msg := req.(*BindMessage)
+			return em.Bind(msg.Exchange, msg.Binding)
+		default:
+			msg := req.(*BindMessage)
+			return em.Unbind(msg.Exchange, msg.Binding)
+		}
+	case SetAliasType, RemoveAliasType:
+		am, ok := s.Registry.(AliasManager)
+		if !ok {
+			return EAliasesUnsupported
+		}
+
+		if t == SetAliasType {
+			return am.SetAlias(req.(*Alias))
+		}
+
+		return am.RemoveAlias(req.(*RemoveAlias).Name)
+	case SetTypeRouteType, RemoveTypeRouteType:
+		tm, ok := s.Registry.(TypeRouteManager)
+		if !ok {
+			return ETypeRoutesUnsupported
+		}
+
+		if t == SetTypeRouteType {
+			return tm.SetTypeRoute(req.(*TypeRoute))
+		}
+
+		return tm.RemoveTypeRoute(req.(*RemoveTypeRoute).Mailbox)
+	}
+
+	return EProtocolError
+}
+
+// Write out the exchanges, aliases or type routes of a Registry that
+// manages them
+func (s *Service) handleList(c io.Writer, t MessageType) error {
+	var (
+		rt  MessageType
+		res interface{}
+	)
+
+	switch t {
+	case ExchangesType:
+		em, ok := s.Registry.(ExchangeManager)
+		if !ok {
+			return EExchangesUnsupported
+		}
+
+		rt, res = ExchangesResultType, &ExchangesResult{em.Exchanges()}
+	case AliasesType:
+		am, ok := s.Registry.(AliasManager)
+		if !ok {
+			return EAliasesUnsupported
+		}
+
+		rt, res = AliasesResultType, &AliasesResult{am.Aliases()}
+	case TypeRoutesType:
+		tm, ok := s.Registry.(TypeRouteManager)
+		if !ok {
+			return ETypeRoutesUnsupported
+		}
+
+		rt, res = TypeRoutesResultType, &TypeRoutesResult{tm.TypeRoutes()}
+	default:
+		return EProtocolError
 	}
 
+	c.Write([]byte{uint8(rt)})
+	return codec.NewEncoder(c, &msgpack).Encode(res)
+}
+
+func (s *Service) handleStats(c io.Writer, data *clientData) error {
+	stats := &ClientStats{}
+
+	s.locked(func() {
+		stats.InFlight = len(data.inflight)
+	})
+
 	c.Write([]byte{uint8(StatsResultType)})
 	enc := codec.NewEncoder(c, &msgpack)
 	return enc.Encode(&stats)
 }
 
-func (s *Service) handleAck(c net.Conn, msg *AckMessage, data *clientData) error {
-	if del, ok := data.inflight[msg.MessageId]; ok {
+func (s *Service) handleAck(c io.Writer, msg *AckMessage, data *clientData) error {
+	if del, ok := s.findInflight(data, msg.MessageId); ok {
 		err := del.Ack()
 		if err != nil {
 			debugf("internal nack error: %s\n", err)
 			return err
 		}
 
-		debugf("removing %s from inflight\n", msg.MessageId)
-		delete(data.inflight, msg.MessageId)
-		debugf("inflight now: %#v\n", data.inflight)
+		s.removeInflight(data, msg.MessageId)
 	} else {
 		return EUnknownMessage
 	}
@@ -582,17 +1463,15 @@ func (s *Service) handleAck(c net.Conn, msg *AckMessage, data *clientData) error
 	return err
 }
 
-func (s *Service) handleNack(c net.Conn, msg *NackMessage, data *clientData) error {
-	if del, ok := data.inflight[msg.MessageId]; ok {
+func (s *Service) handleNack(c io.Writer, msg *NackMessage, data *clientData) error {
+	if del, ok := s.findInflight(data, msg.MessageId); ok {
 		err := del.Nack()
 		if err != nil {
 			debugf("internal nack error: %s\n", err)
 			return err
 		}
 
-		debugf("removing %s from inflight\n", msg.MessageId)
-		delete(data.inflight, msg.MessageId)
-		debugf("inflight now: %#v\n", data.inflight)
+		s.removeInflight(data, msg.MessageId)
 	} else {
 		return EUnknownMessage
 	}
@@ -601,715 +1480,808 @@ func (s *Service) handleNack(c net.Conn, msg *NackMessage, data *clientData) err
 	return err
 }
 
-type Client struct {
-	conn   net.Conn
-	sess   *yamux.Session
-	addr   string
-	secure bool
-	lwt    *Message
-}
-
-func NewClient(addr string) (*Client, error) {
-	cl := &Client{
-		addr:   addr,
-		secure: true,
-	}
+// Ack or nack, using apply, the messages with ids that the client holds
+func (s *Service) handleAckMany(c io.Writer, ids []MessageId, apply func([]*Delivery) error, data *clientData) error {
+	var dels []*Delivery
 
-	cl.Session()
-
-	return cl, nil
-}
-
-func NewInsecureClient(addr string) (*Client, error) {
-	cl := &Client{addr: addr}
-
-	cl.Session()
-
-	return cl, nil
-}
-
-func (c *Client) checkError(err error) error {
-	debugf("client %s error: %s\n", c.addr, err)
-	if err == io.EOF {
-		c.conn = nil
-	}
-
-	return err
-}
-
-func (c *Client) Session() (*yamux.Session, error) {
-	if c.sess == nil {
-		s, err := net.Dial("tcp", c.addr)
-		if err != nil {
-			return nil, err
-		}
+	var err error
 
-		if c.secure {
-			sec, err := seconn.NewClient(s)
-			if err != nil {
-				return nil, err
+	s.locked(func() {
+		for _, id := range ids {
+			del, ok := data.inflight[id]
+			if !ok {
+				err = errors.Subject(EUnknownMessage, string(id))
+				return
 			}
 
-			c.conn = sec
-		} else {
-			c.conn = s
+			dels = append(dels, del)
 		}
+	})
 
-		sess, err := yamux.Client(c.conn, muxConfig)
-		if err != nil {
-			return nil, err
-		}
-
-		c.sess = sess
-	}
-
-	return c.sess, nil
-}
-
-func (c *Client) Close() (err error) {
-	if c.conn == nil {
-		return nil
-	}
-
-	sess, err := c.Session()
 	if err != nil {
 		return err
 	}
 
-	s, err := sess.Open()
+	err = apply(dels)
 	if err != nil {
+		debugf("internal batch ack error: %s\n", err)
 		return err
 	}
 
-	_, err = s.Write([]byte{uint8(CloseType)})
-
-	defer func() {
-		s.Close()
-
-		err = c.sess.Close()
-		c.sess = nil
-		c.conn = nil
-	}()
-
-	buf := []byte{0}
-
-	io.ReadFull(s, buf)
-	if err == nil {
-		switch MessageType(buf[0]) {
-		case ErrorType:
-			var msgerr Error
-
-			err = codec.NewDecoder(s, &msgpack).Decode(&msgerr)
-			if err != nil {
-				return c.checkError(err)
-			}
-
-			return errors.New(msgerr.Error)
-		case SuccessType:
-			return nil
-		default:
-			return c.checkError(EProtocolError)
-		}
+	for _, id := range ids {
+		s.removeInflight(data, id)
 	}
 
+	_, err = c.Write([]byte{uint8(SuccessType)})
 	return err
 }
 
-func (c *Client) Stats() (*ClientStats, error) {
-	if c.conn == nil {
-		return nil, nil
+func (s *Service) handleAckThrough(c io.Writer, msg *AckThroughMessage, data *clientData) error {
+	del, ok := s.findInflight(data, msg.MessageId)
+	if !ok || del.AckThrough == nil {
+		return EUnknownMessage
 	}
 
-	sess, err := c.Session()
+	acked, err := del.AckThrough()
 	if err != nil {
-		return nil, err
+		debugf("internal cumulative ack error: %s\n", err)
+		return err
 	}
 
-	s, err := sess.Open()
-	if err != nil {
-		return nil, err
+	// Messages held by other clients may have been acked too, only
+	// this client's are tracked here.
+	for _, id := range acked {
+		s.removeInflight(data, id)
 	}
 
-	_, err = s.Write([]byte{uint8(StatsType)})
+	c.Write([]byte{uint8(AckedResultType)})
+	enc := codec.NewEncoder(c, &msgpack)
+	return enc.Encode(&AckedResult{MessageIds: acked})
+}
 
-	buf := []byte{0}
+type Client struct {
+	// How often yamux pings the server and how long a write may block
+	// before the connection is dropped. Zero means the yamux defaults.
+	// Changes take effect on the next session.
+	KeepAliveInterval      time.Duration
+	ConnectionWriteTimeout time.Duration
 
-	_, err = io.ReadFull(s, buf)
-	if err != nil {
-		return nil, err
-	}
+	// How often to send a heartbeat to servers that support them. A
+	// heartbeat not answered within the interval drops the session.
+	// Zero means DefaultHeartbeatInterval and negative disables them.
+	HeartbeatInterval time.Duration
 
-	switch MessageType(buf[0]) {
-	case StatsResultType:
-		dec := codec.NewDecoder(s, &msgpack)
+	// How long to wait before trying to reconnect after the session
+	// is lost, doubling after each failed attempt up to MaxReconnectDelay.
+	// Zero means DefaultReconnectDelay and DefaultMaxReconnectDelay.
+	ReconnectDelay    time.Duration
+	MaxReconnectDelay time.Duration
 
-		var res ClientStats
+	// The largest response frame accepted from the server. Raise it
+	// to match a server with a larger MaxMessageSize. Zero means
+	// DefaultMaxFrameSize.
+	MaxFrameSize int
 
-		if err := dec.Decode(&res); err != nil {
-			return nil, c.checkError(err)
-		}
+	lock sync.Mutex
 
-		return &res, nil
-	case ErrorType:
-		var msgerr Error
+	// held while setting up a session, see session
+	dialLock sync.Mutex
 
-		err = codec.NewDecoder(s, &msgpack).Decode(&msgerr)
-		if err != nil {
-			return nil, c.checkError(err)
-		}
+	conn   net.Conn
+	sess   *yamux.Session
+	addr   string
+	secure bool
+	server *Hello
 
-		return nil, errors.New(msgerr.Error)
-	case SuccessType:
-		return nil, nil
-	default:
-		return nil, c.checkError(EProtocolError)
-	}
-}
+	pipe       *pipeline
+	noPipeline bool
 
-func (c *Client) Declare(name string) error {
-	sess, err := c.Session()
-	if err != nil {
-		return err
-	}
+	// set for a client made by NewNodeClient
+	node       bool
+	nodeSecret string
 
-	s, err := sess.Open()
-	if err != nil {
-		return err
-	}
+	// Server side state that is restored after reconnecting
+	ephemerals map[string]struct{}
+	lwts       map[string]*Message
+	locks      map[string]struct{}
 
-	defer s.Close()
+	closed       bool
+	disconnected bool
+	reconnecting bool
+	events       chan ClientEvent
+}
 
-	_, err = s.Write([]byte{uint8(DeclareType)})
-	if err != nil {
-		return c.checkError(err)
+func NewClient(addr string) (*Client, error) {
+	cl := &Client{
+		addr:   addr,
+		secure: true,
 	}
 
-	enc := codec.NewEncoder(s, &msgpack)
+	cl.Session()
 
-	msg := Declare{
-		Name: name,
-	}
+	return cl, nil
+}
 
-	err = enc.Encode(&msg)
-	if err != nil {
-		return c.checkError(err)
+// Connect to another node of a cluster to forward messages to it, so
+// that it keeps the hops and node path of the messages pushed. secret
+// must match the server's NodeSecret.
+func NewNodeClient(addr, secret string) (*Client, error) {
+	cl := &Client{
+		addr:       addr,
+		secure:     true,
+		node:       true,
+		nodeSecret: secret,
 	}
 
-	buf := []byte{0}
+	cl.Session()
 
-	_, err = io.ReadFull(s, buf)
-	if err != nil {
-		return c.checkError(err)
-	}
+	return cl, nil
+}
 
-	switch MessageType(buf[0]) {
-	case ErrorType:
-		var msgerr Error
+func NewInsecureClient(addr string) (*Client, error) {
+	cl := &Client{addr: addr}
 
-		err = codec.NewDecoder(s, &msgpack).Decode(&msgerr)
-		if err != nil {
-			return c.checkError(err)
-		}
+	cl.Session()
 
-		return errors.New(msgerr.Error)
-	case SuccessType:
-		return nil
-	default:
-		return c.checkError(EProtocolError)
-	}
+	return cl, nil
 }
 
-func (c *Client) EphemeralDeclare(name string) error {
-	sess, err := c.Session()
-	if err != nil {
-		return err
+func (c *Client) maxFrameSize() int {
+	if c.MaxFrameSize > 0 {
+		return c.MaxFrameSize
 	}
 
-	s, err := sess.Open()
-	if err != nil {
-		return err
-	}
+	return DefaultMaxFrameSize
+}
 
-	defer s.Close()
+func (c *Client) checkError(err error) error {
+	debugf("client %s error: %s\n", c.addr, err)
+	return err
+}
 
-	_, err = s.Write([]byte{uint8(EphemeralDeclareType)})
-	if err != nil {
-		return c.checkError(err)
+const cUnixPrefix = "unix:"
+
+// Connect to addr, which is either a tcp host:port or the path
+// of a unix domain socket prefixed with "unix:".
+func dialAddr(addr string) (net.Conn, error) {
+	if strings.HasPrefix(addr, cUnixPrefix) {
+		return net.Dial("unix", addr[len(cUnixPrefix):])
 	}
 
-	enc := codec.NewEncoder(s, &msgpack)
+	return net.Dial("tcp", addr)
+}
 
-	msg := Declare{
-		Name: name,
-	}
+func (c *Client) Session() (*yamux.Session, error) {
+	return c.session()
+}
 
-	err = enc.Encode(&msg)
-	if err != nil {
-		return c.checkError(err)
+// Return the current session, setting up a new one if there is none.
+// Must be called without c.lock held. Only one session is setup at a
+// time, but c.lock isn't held while dialing and restoring so that a
+// slow server doesn't block everything else using the client.
+func (c *Client) session() (*yamux.Session, error) {
+	c.lock.Lock()
+	sess := c.current()
+	c.lock.Unlock()
+
+	if sess != nil {
+		return sess, nil
 	}
 
-	buf := []byte{0}
+	c.dialLock.Lock()
+	defer c.dialLock.Unlock()
 
-	_, err = io.ReadFull(s, buf)
-	if err != nil {
-		return c.checkError(err)
+	c.lock.Lock()
+
+	// Setup by whoever held dialLock before us
+	if sess := c.current(); sess != nil {
+		c.lock.Unlock()
+		return sess, nil
 	}
 
-	switch MessageType(buf[0]) {
-	case ErrorType:
-		var msgerr Error
+	closed := c.closed
+	state := c.state()
 
-		err = codec.NewDecoder(s, &msgpack).Decode(&msgerr)
-		if err != nil {
-			return c.checkError(err)
-		}
+	c.lock.Unlock()
 
-		return errors.New(msgerr.Error)
-	case SuccessType:
-		return nil
-	default:
-		return c.checkError(EProtocolError)
+	conn, sess, hello, err := c.dial()
+	if err != nil {
+		return nil, err
 	}
-}
 
-func (c *Client) Abandon(name string) error {
-	sess, err := c.Session()
+	lostLocks, restoreErr, err := c.restore(sess, state)
 	if err != nil {
-		return err
+		sess.Close()
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed && !closed {
+		sess.Close()
+		return nil, ESessionLost
 	}
 
-	s, err := sess.Open()
-	if err != nil {
-		return err
+	for _, name := range lostLocks {
+		delete(c.locks, name)
 	}
 
-	defer s.Close()
+	c.conn = conn
+	c.sess = sess
+	c.server = hello
+	c.closed = false
 
-	_, err = s.Write([]byte{uint8(AbandonType)})
-	if err != nil {
-		return c.checkError(err)
+	if c.disconnected {
+		c.disconnected = false
+		c.emit(ClientEvent{Type: Reconnected, Err: restoreErr})
 	}
 
-	enc := codec.NewEncoder(s, &msgpack)
+	go c.watch(sess)
 
-	msg := Abandon{
-		Name: name,
+	if interval := c.heartbeatInterval(); interval > 0 && hello.HasFeature(FeatureHeartbeat) {
+		go c.heartbeat(sess, interval)
 	}
 
-	err = enc.Encode(&msg)
-	if err != nil {
-		return c.checkError(err)
+	return sess, nil
+}
+
+// The session in use, if it's still open. Must be called with c.lock
+// held.
+func (c *Client) current() *yamux.Session {
+	if c.sess != nil && c.sess.IsClosed() {
+		c.lost(c.sess, ESessionLost)
 	}
 
-	buf := []byte{0}
+	return c.sess
+}
 
-	_, err = io.ReadFull(s, buf)
+// Connect to the server and perform the hello exchange
+func (c *Client) dial() (net.Conn, *yamux.Session, *Hello, error) {
+	s, err := dialAddr(c.addr)
 	if err != nil {
-		return c.checkError(err)
+		return nil, nil, nil, err
 	}
 
-	switch MessageType(buf[0]) {
-	case ErrorType:
-		var msgerr Error
+	var conn net.Conn
 
-		err = codec.NewDecoder(s, &msgpack).Decode(&msgerr)
+	if c.secure {
+		sec, err := seconn.NewClient(s)
 		if err != nil {
-			return c.checkError(err)
+			s.Close()
+			return nil, nil, nil, err
 		}
 
-		return errors.New(msgerr.Error)
-	case SuccessType:
-		return nil
-	default:
-		return c.checkError(EProtocolError)
-	}
-}
-
-func (c *Client) ack(id MessageId) error {
-	sess, err := c.Session()
-	if err != nil {
-		return err
+		conn = sec
+	} else {
+		conn = s
 	}
 
-	s, err := sess.Open()
+	sess, err := yamux.Client(conn, newMuxConfig(c.KeepAliveInterval, c.ConnectionWriteTimeout))
 	if err != nil {
-		return err
+		conn.Close()
+		return nil, nil, nil, err
 	}
 
-	defer s.Close()
-
-	_, err = s.Write([]byte{uint8(AckType)})
+	hello, err := c.hello(sess)
 	if err != nil {
-		return c.checkError(err)
+		sess.Close()
+		return nil, nil, nil, err
 	}
 
-	enc := codec.NewEncoder(s, &msgpack)
+	return conn, sess, hello, nil
+}
 
-	msg := AckMessage{
-		MessageId: id,
+// Perform the hello exchange on a new session. A server that predates
+// the exchange rejects it with an error and is reported as version 0
+// with no features.
+func (c *Client) hello(sess *yamux.Session) (*Hello, error) {
+	msg := Hello{
+		Version:    ProtocolVersion,
+		NodeId:     clientNodeId(),
+		Features:   clientFeatures,
+		Node:       c.node,
+		NodeSecret: c.nodeSecret,
 	}
 
-	if err := enc.Encode(&msg); err != nil {
-		return c.checkError(err)
+	if interval := c.heartbeatInterval(); interval > 0 {
+		msg.Heartbeat = interval.String()
 	}
 
-	buf := []byte{0}
-
-	_, err = io.ReadFull(s, buf)
+	resp, err := c.streamRequest(sess, HelloType, &msg, nil)
 	if err != nil {
-		return c.checkError(err)
+		return nil, err
 	}
 
-	switch MessageType(buf[0]) {
+	switch resp.Type {
 	case ErrorType:
-		var msgerr Error
-
-		err = codec.NewDecoder(s, &msgpack).Decode(&msgerr)
-		if err != nil {
-			return c.checkError(err)
-		}
+		debugf("client %s: server does not support hello: %s\n", c.addr, resp.Error.Error)
 
-		return errors.New(msgerr.Error)
-	case SuccessType:
-		return nil
+		return &Hello{}, nil
+	case HelloResultType:
+		return &resp.Hello, nil
 	default:
-		return c.checkError(EProtocolError)
+		return nil, EProtocolError
 	}
 }
 
-func (c *Client) nack(id MessageId) error {
-	sess, err := c.Session()
+// The features a Client advertises to the server
+var clientFeatures = []string{}
+
+func clientNodeId() string {
+	name, err := os.Hostname()
 	if err != nil {
-		return err
+		return "unknown"
 	}
 
-	s, err := sess.Open()
+	return name
+}
+
+// Return the hello the server sent when the session was setup,
+// connecting first if need be.
+func (c *Client) ServerHello() (*Hello, error) {
+	sess, err := c.session()
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Lost again since
+	if c.sess != sess {
+		return nil, ESessionLost
 	}
 
-	defer s.Close()
+	return c.server, nil
+}
 
-	_, err = s.Write([]byte{uint8(NackType)})
+// Indicates if the server supports the named feature. Use this
+// to fall back to older behavior when talking to older servers.
+func (c *Client) HasFeature(name string) bool {
+	hello, err := c.ServerHello()
 	if err != nil {
-		return c.checkError(err)
+		return false
 	}
 
-	enc := codec.NewEncoder(s, &msgpack)
+	return hello.HasFeature(name)
+}
+
+// Stop sending requests over a single pipelined stream and instead
+// open a new stream for each request, as is done with servers that
+// don't support pipelining.
+func (c *Client) DisablePipelining() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.noPipeline = true
 
-	msg := NackMessage{
-		MessageId: id,
+	if c.pipe != nil {
+		c.pipe.close()
+		c.pipe = nil
 	}
+}
 
-	if err := enc.Encode(&msg); err != nil {
-		return c.checkError(err)
+// Returns the session and, if the server supports it, the pipeline
+// that requests should be sent over.
+func (c *Client) connection() (*yamux.Session, *pipeline, error) {
+	sess, err := c.session()
+	if err != nil {
+		return nil, nil, err
 	}
 
-	buf := []byte{0}
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-	_, err = io.ReadFull(s, buf)
-	if err != nil {
-		return c.checkError(err)
+	// Lost again since
+	if c.sess != sess {
+		return nil, nil, ESessionLost
 	}
 
-	switch MessageType(buf[0]) {
-	case ErrorType:
-		var msgerr Error
+	if c.noPipeline || !c.server.HasFeature(FeaturePipeline) {
+		return sess, nil, nil
+	}
 
-		err = codec.NewDecoder(s, &msgpack).Decode(&msgerr)
+	if c.pipe == nil {
+		pipe, err := newPipeline(c, sess, c.server.HasFeature(FeatureCancel))
 		if err != nil {
-			return c.checkError(err)
+			return nil, nil, c.checkError(err)
 		}
 
-		return errors.New(msgerr.Error)
-	case SuccessType:
-		return nil
-	default:
-		return c.checkError(EProtocolError)
+		c.pipe = pipe
 	}
 
+	return sess, c.pipe, nil
 }
 
-func (c *Client) Poll(name string) (*Delivery, error) {
-	sess, err := c.Session()
-	if err != nil {
-		return nil, err
+// Called by a pipeline that has failed so that the next request
+// sets up a new one.
+func (c *Client) dropPipeline(p *pipeline) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.pipe == p {
+		c.pipe = nil
 	}
+}
 
-	s, err := sess.Open()
-	if err != nil {
+// Send a request and wait for the response, either over the pipeline
+// or on a new stream. If ctx is done before the response arrives, the
+// request is abandoned, ctx's error returned and any message in the
+// response is nack'd.
+func (c *Client) request(ctx context.Context, t MessageType, req interface{}) (*response, error) {
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
 
-	defer s.Close()
-
-	_, err = s.Write([]byte{uint8(PollType)})
+	sess, pipe, err := c.connection()
 	if err != nil {
-		return nil, c.checkError(err)
+		return nil, err
 	}
 
-	enc := codec.NewEncoder(s, &msgpack)
+	var resp *response
 
-	msg := Poll{
-		Name: name,
+	if pipe != nil {
+		resp, err = pipe.request(t, req, ctx.Done())
+	} else {
+		resp, err = c.streamRequest(sess, t, req, ctx.Done())
 	}
 
-	if err := enc.Encode(&msg); err != nil {
+	if err != nil {
+		if err == errCanceled {
+			return nil, ctx.Err()
+		}
+
 		return nil, c.checkError(err)
 	}
 
-	buf := []byte{0}
+	return resp, nil
+}
 
-	_, err = io.ReadFull(s, buf)
+// Send a request on a new stream and wait for the response
+func (c *Client) streamRequest(sess *yamux.Session, t MessageType, req interface{}, done <-chan struct{}) (*response, error) {
+	s, err := sess.Open()
 	if err != nil {
-		return nil, c.checkError(err)
+		return nil, err
 	}
 
-	switch MessageType(buf[0]) {
-	case ErrorType:
-		var msgerr Error
+	err = writeRequest(s, t, req)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	result := make(chan *response, 1)
 
-		err = codec.NewDecoder(s, &msgpack).Decode(&msgerr)
+	go func() {
+		resp, err := readResponse(bufio.NewReader(s), c.maxFrameSize())
 		if err != nil {
-			return nil, c.checkError(err)
+			resp = &response{err: err}
 		}
 
-		return nil, errors.New(msgerr.Error)
-	case PollResultType:
-		dec := codec.NewDecoder(s, &msgpack)
-
-		var res PollResult
+		result <- resp
+	}()
 
-		if err := dec.Decode(&res); err != nil {
-			return nil, c.checkError(err)
-		}
+	select {
+	case resp := <-result:
+		s.Close()
 
-		if res.Message == nil {
-			return nil, nil
+		if resp.err != nil {
+			return nil, resp.err
 		}
 
-		del := &Delivery{
-			Message: res.Message,
-			Ack:     func() error { return c.ack(res.Message.MessageId) },
-			Nack:    func() error { return c.nack(res.Message.MessageId) },
-		}
+		return resp, nil
+	case <-done:
+		go func() {
+			c.abandonResponse(<-result)
+			s.Close()
+		}()
 
-		return del, nil
-	default:
-		return nil, c.checkError(EProtocolError)
+		return nil, errCanceled
 	}
 }
 
-func (c *Client) LongPoll(name string, til time.Duration) (*Delivery, error) {
-	sess, err := c.Session()
-	if err != nil {
-		return nil, err
+// Nack any message delivered in a response nobody is waiting on
+func (c *Client) abandonResponse(resp *response) {
+	if resp.err == nil && resp.Type == PollResultType && resp.Poll.Message != nil {
+		debugf("client %s: nacking abandoned message %s\n", c.addr, resp.Poll.Message.MessageId)
+		c.nack(resp.Poll.Message.MessageId)
 	}
+}
 
-	s, err := sess.Open()
-	if err != nil {
-		return nil, err
-	}
+// Close the session. The server abandons the client's ephemeral
+// mailboxes and fires its LWTs, so they are not restored if the
+// Client is used again.
+func (c *Client) Close() error {
+	c.lock.Lock()
 
-	defer s.Close()
+	c.closed = true
+	c.ephemerals = nil
+	c.lwts = nil
+	c.locks = nil
 
-	_, err = s.Write([]byte{uint8(LongPollType)})
-	if err != nil {
-		return nil, c.checkError(err)
+	if c.sess == nil {
+		c.lock.Unlock()
+		return nil
 	}
 
-	enc := codec.NewEncoder(s, &msgpack)
-
-	msg := LongPoll{
-		Name:     name,
-		Duration: til.String(),
-	}
+	sess := c.sess
+	pipe := c.pipe
 
-	if err := enc.Encode(&msg); err != nil {
-		return nil, c.checkError(err)
-	}
+	c.sess = nil
+	c.conn = nil
+	c.server = nil
+	c.pipe = nil
 
-	buf := []byte{0}
+	c.lock.Unlock()
 
-	_, err = io.ReadFull(s, buf)
-	if err != nil {
-		return nil, c.checkError(err)
+	if pipe != nil {
+		pipe.close()
 	}
 
-	switch MessageType(buf[0]) {
-	case ErrorType:
-		var msgerr Error
-
-		err = codec.NewDecoder(s, &msgpack).Decode(&msgerr)
-		if err != nil {
-			return nil, c.checkError(err)
-		}
+	// The server closes the session in response so there's
+	// nothing to check.
+	c.streamRequest(sess, CloseType, nil, nil)
 
-		return nil, errors.New(msgerr.Error)
-	case PollResultType:
-		dec := codec.NewDecoder(s, &msgpack)
+	return sess.Close()
+}
 
-		var res PollResult
+func (c *Client) Stats() (*ClientStats, error) {
+	return c.StatsContext(context.Background())
+}
 
-		if err := dec.Decode(&res); err != nil {
-			return nil, c.checkError(err)
-		}
+func (c *Client) StatsContext(ctx context.Context) (*ClientStats, error) {
+	c.lock.Lock()
+	conn := c.conn
+	c.lock.Unlock()
 
-		if res.Message == nil {
-			return nil, nil
-		}
+	if conn == nil {
+		return nil, nil
+	}
 
-		del := &Delivery{
-			Message: res.Message,
-			Ack:     func() error { return c.ack(res.Message.MessageId) },
-			Nack:    func() error { return c.nack(res.Message.MessageId) },
-		}
+	resp, err := c.request(ctx, StatsType, nil)
+	if err != nil {
+		return nil, err
+	}
 
-		return del, nil
+	switch resp.Type {
+	case StatsResultType:
+		return &resp.Stats, nil
+	case SuccessType:
+		return nil, nil
 	default:
-		return nil, c.checkError(EProtocolError)
+		return nil, c.checkError(resp.error())
 	}
 }
 
-func (c *Client) LongPollCancelable(name string, til time.Duration, done chan struct{}) (*Delivery, error) {
-	sess, err := c.Session()
+// Perform a request that is answered with success or an error
+func (c *Client) simpleRequest(ctx context.Context, t MessageType, req interface{}) error {
+	resp, err := c.request(ctx, t, req)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	s, err := sess.Open()
-	if err != nil {
-		return nil, err
+	switch resp.Type {
+	case SuccessType:
+		return nil
+	default:
+		return c.checkError(resp.error())
 	}
+}
+
+func (c *Client) Declare(name string) error {
+	return c.DeclareContext(context.Background(), name)
+}
+
+func (c *Client) DeclareContext(ctx context.Context, name string) error {
+	return c.simpleRequest(ctx, DeclareType, &Declare{Name: name})
+}
 
-	defer s.Close()
+func (c *Client) EphemeralDeclare(name string) error {
+	return c.EphemeralDeclareContext(context.Background(), name)
+}
 
-	_, err = s.Write([]byte{uint8(LongPollType)})
+func (c *Client) EphemeralDeclareContext(ctx context.Context, name string) error {
+	err := c.simpleRequest(ctx, EphemeralDeclareType, &Declare{Name: name})
 	if err != nil {
-		return nil, c.checkError(err)
+		return err
 	}
 
-	enc := codec.NewEncoder(s, &msgpack)
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-	msg := LongPoll{
-		Name:     name,
-		Duration: til.String(),
+	if c.ephemerals == nil {
+		c.ephemerals = make(map[string]struct{})
 	}
 
-	if err := enc.Encode(&msg); err != nil {
-		return nil, c.checkError(err)
+	c.ephemerals[name] = struct{}{}
+
+	return nil
+}
+
+func (c *Client) Abandon(name string) error {
+	return c.AbandonContext(context.Background(), name)
+}
+
+func (c *Client) AbandonContext(ctx context.Context, name string) error {
+	err := c.simpleRequest(ctx, AbandonType, &Abandon{Name: name})
+	if err != nil {
+		return err
 	}
 
-	delivered := make(chan struct{})
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-	buf := []byte{0}
+	delete(c.ephemerals, name)
+	delete(c.lwts, name)
 
-	go func() {
-		_, err = io.ReadFull(s, buf)
-		close(delivered)
-	}()
+	return nil
+}
 
-	select {
-	case <-done:
-		return nil, nil
-	case <-delivered:
-		// do the rest
+func (c *Client) ack(id MessageId) error {
+	return c.simpleRequest(context.Background(), AckType, &AckMessage{MessageId: id})
+}
+
+func (c *Client) nack(id MessageId) error {
+	return c.simpleRequest(context.Background(), NackType, &NackMessage{MessageId: id})
+}
+
+// Ack the messages with ids in as few operations as the server can.
+// Messages from the same mailbox are acked all or nothing. Older
+// servers are sent each ack on its own.
+func (c *Client) AckMany(ids []MessageId) error {
+	if !c.HasFeature(FeatureBatchAck) {
+		return eachId(ids, c.ack)
 	}
 
-	switch MessageType(buf[0]) {
-	case ErrorType:
-		var msgerr Error
+	return c.simpleRequest(context.Background(), AckManyType, &AckManyMessage{MessageIds: ids})
+}
 
-		err = codec.NewDecoder(s, &msgpack).Decode(&msgerr)
-		if err != nil {
-			return nil, c.checkError(err)
+// Nack the messages with ids, like AckMany
+func (c *Client) NackMany(ids []MessageId) error {
+	if !c.HasFeature(FeatureBatchAck) {
+		return eachId(ids, c.nack)
+	}
+
+	return c.simpleRequest(context.Background(), NackManyType, &NackManyMessage{MessageIds: ids})
+}
+
+func eachId(ids []MessageId, fn func(MessageId) error) error {
+	for _, id := range ids {
+		if err := fn(id); err != nil {
+			return err
 		}
+	}
 
-		return nil, errors.New(msgerr.Error)
-	case PollResultType:
-		dec := codec.NewDecoder(s, &msgpack)
+	return nil
+}
 
-		var res PollResult
+// Ack the message with id and every message in flight pushed to its
+// mailbox before it, including those held by other consumers. Meant
+// for a mailbox with a single consumer. Returns the ids acked.
+func (c *Client) AckThrough(id MessageId) ([]MessageId, error) {
+	resp, err := c.request(context.Background(), AckThroughType, &AckThroughMessage{MessageId: id})
+	if err != nil {
+		return nil, err
+	}
 
-		if err := dec.Decode(&res); err != nil {
-			return nil, c.checkError(err)
-		}
+	switch resp.Type {
+	case AckedResultType:
+		return resp.Acked.MessageIds, nil
+	default:
+		return nil, c.checkError(resp.error())
+	}
+}
 
-		if res.Message == nil {
+// Turn the response to a poll into a Delivery
+func (c *Client) delivery(resp *response) (*Delivery, error) {
+	switch resp.Type {
+	case PollResultType:
+		msg := resp.Poll.Message
+
+		if msg == nil {
 			return nil, nil
 		}
 
 		del := &Delivery{
-			Message: res.Message,
-			Ack:     func() error { return c.ack(res.Message.MessageId) },
-			Nack:    func() error { return c.nack(res.Message.MessageId) },
+			Message:    msg,
+			Ack:        func() error { return c.ack(msg.MessageId) },
+			Nack:       func() error { return c.nack(msg.MessageId) },
+			AckThrough: func() ([]MessageId, error) { return c.AckThrough(msg.MessageId) },
+			batch:      c,
 		}
 
 		return del, nil
 	default:
-		return nil, c.checkError(EProtocolError)
+		return nil, c.checkError(resp.error())
 	}
 }
 
-func (c *Client) Push(name string, body *Message) error {
-	sess, err := c.Session()
-	if err != nil {
-		return err
-	}
+func (c *Client) Poll(name string) (*Delivery, error) {
+	return c.PollContext(context.Background(), name)
+}
 
-	s, err := sess.Open()
+func (c *Client) PollContext(ctx context.Context, name string) (*Delivery, error) {
+	resp, err := c.request(ctx, PollType, &Poll{Name: name})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	defer s.Close()
+	return c.delivery(resp)
+}
 
-	_, err = s.Write([]byte{uint8(PushType)})
-	if err != nil {
-		return c.checkError(err)
-	}
+func (c *Client) LongPoll(name string, til time.Duration) (*Delivery, error) {
+	return c.LongPollContext(context.Background(), name, til)
+}
 
-	enc := codec.NewEncoder(s, &msgpack)
+// Wait up to til for a message to arrive in the named mailbox. If ctx
+// is done first, the poll is aborted and ctx's error returned. til is
+// shortened to ctx's deadline if that comes sooner.
+func (c *Client) LongPollContext(ctx context.Context, name string, til time.Duration) (*Delivery, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		left := deadline.Sub(time.Now())
+		if left <= 0 {
+			return nil, context.DeadlineExceeded
+		}
 
-	msg := Push{
-		Name:    name,
-		Message: body,
+		if left < til {
+			til = left
+		}
 	}
 
-	debugf("client %s: sending push request\n", c.addr)
+	msg := LongPoll{
+		Name:     name,
+		Duration: til.String(),
+	}
 
-	if err := enc.Encode(&msg); err != nil {
-		return c.checkError(err)
+	resp, err := c.request(ctx, LongPollType, &msg)
+	if err != nil {
+		return nil, err
 	}
 
-	buf := []byte{0}
+	return c.delivery(resp)
+}
 
-	debugf("client %s: waiting for response\n", c.addr)
+func (c *Client) LongPollCancelable(name string, til time.Duration, done chan struct{}) (*Delivery, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	_, err = io.ReadFull(s, buf)
-	if err != nil {
-		return c.checkError(err)
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	del, err := c.LongPollContext(ctx, name, til)
+	if err == context.Canceled {
+		return nil, nil
 	}
 
-	switch MessageType(buf[0]) {
-	case ErrorType:
-		debugf("client %s: got error\n", c.addr)
+	return del, err
+}
 
-		var msgerr Error
+func (c *Client) Push(name string, body *Message) error {
+	return c.PushContext(context.Background(), name, body)
+}
 
-		err = codec.NewDecoder(s, &msgpack).Decode(&msgerr)
-		if err != nil {
-			return c.checkError(err)
-		}
+func (c *Client) PushContext(ctx context.Context, name string, body *Message) error {
+	msg := Push{
+		Name:    name,
+		Message: body,
+	}
 
-		return errors.New(msgerr.Error)
-	case SuccessType:
-		debugf("client %s: got success\n", c.addr)
+	debugf("client %s: sending push request\n", c.addr)
 
-		return nil
-	default:
-		debugf("client %s: got protocol error\n", c.addr)
+	err := c.simpleRequest(ctx, PushType, &msg)
+	if err != nil {
+		return err
+	}
 
-		return c.checkError(EProtocolError)
+	if name == ":lwt" && body != nil {
+		c.rememberLWT(body)
 	}
+
+	return nil
 }
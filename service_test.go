@@ -1,20 +1,30 @@
 package vega
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
 	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/yamux"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/ugorji/go/codec"
+	"github.com/vektra/errors"
 )
 
 const cPort = "127.0.0.1:34000"
 const cPort2 = "127.0.0.1:34001"
 
 func init() {
-	muxConfig.LogOutput = ioutil.Discard
+	muxLogOutput = ioutil.Discard
 }
 
 func TestServicePushAndPoll(t *testing.T) {
@@ -57,6 +67,90 @@ func TestServicePushAndPoll(t *testing.T) {
 	assert.True(t, payload.Equal(msg.Message))
 }
 
+func TestServiceOnlyTrustsNodesWithTrace(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	serv.NodeSecret = "sekret"
+
+	defer serv.Close()
+	go serv.Accept()
+
+	traced := func() *Message {
+		msg := Msg([]byte("hello")).Forwarded("n1")
+		return msg.Forwarded("n2")
+	}
+
+	tests := []struct {
+		name   string
+		client func() (*Client, error)
+		hops   int
+	}{
+		{"client", func() (*Client, error) { return NewClient(cPort) }, 0},
+		{"wrong secret", func() (*Client, error) { return NewNodeClient(cPort, "guess") }, 0},
+		{"node", func() (*Client, error) { return NewNodeClient(cPort, "sekret") }, 2},
+	}
+
+	for _, tt := range tests {
+		c, err := tt.client()
+		if err != nil {
+			panic(err)
+		}
+
+		c.Declare("a")
+
+		require.NoError(t, c.Push("a", traced()), tt.name)
+
+		var tx Transaction
+		tx.Push("a", traced())
+
+		require.NoError(t, c.Transact(&tx), tt.name)
+
+		for i := 0; i < 2; i++ {
+			del, err := c.Poll("a")
+			require.NoError(t, err, tt.name)
+			require.NotNil(t, del, tt.name)
+
+			assert.Equal(t, tt.hops, del.Message.Hops(), tt.name)
+			assert.Equal(t, tt.hops, len(del.Message.NodePath()), tt.name)
+
+			del.Ack()
+		}
+
+		c.Close()
+	}
+}
+
+func TestServiceWithoutNodeSecretTrustsNoNode(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	c, err := NewNodeClient(cPort, "")
+	if err != nil {
+		panic(err)
+	}
+
+	defer c.Close()
+
+	c.Declare("a")
+
+	require.NoError(t, c.Push("a", Msg([]byte("hello")).Forwarded("n1")))
+
+	del, err := c.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	assert.Equal(t, 0, del.Message.Hops())
+	assert.Equal(t, 0, len(del.Message.NodePath()))
+}
+
 func TestServiceAck(t *testing.T) {
 	serv, err := NewMemService(cPort)
 	if err != nil {
@@ -387,6 +481,122 @@ func TestClientReconnects(t *testing.T) {
 	assert.True(t, payload.Equal(got.Message))
 }
 
+func TestClientReconnectsAfterSessionLost(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	go serv.Accept()
+
+	c1, err := NewClient(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer c1.Close()
+
+	c1.ReconnectDelay = 10 * time.Millisecond
+
+	events := c1.Events()
+
+	err = c1.EphemeralDeclare("e")
+	require.NoError(t, err)
+
+	lwt := &Message{ReplyTo: "dead", Body: []byte("gone")}
+
+	err = c1.Push(":lwt", lwt)
+	require.NoError(t, err)
+
+	// Simulate vegad restarting, which loses all server side state
+	serv.Close()
+
+	select {
+	case ev := <-events:
+		assert.Equal(t, Disconnected, ev.Type)
+	case <-time.After(2 * time.Second):
+		t.Fatal("disconnect was not reported")
+	}
+
+	serv, err = NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	serv.Registry.Declare("dead")
+
+	select {
+	case ev := <-events:
+		assert.Equal(t, Reconnected, ev.Type)
+		assert.NoError(t, ev.Err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("reconnect was not reported")
+	}
+
+	c2, err := NewClient(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer c2.Close()
+
+	err = c2.Push("e", Msg([]byte("hello")))
+	assert.NoError(t, err, "ephemeral mailbox was not restored")
+
+	c1.Close()
+
+	got, err := c2.Poll("dead")
+	require.NoError(t, err)
+	require.NotNil(t, got, "lwt was not restored")
+
+	assert.Equal(t, []byte("gone"), got.Message.Body)
+}
+
+func TestClientSetupDoesNotHoldLock(t *testing.T) {
+	l, err := net.Listen("tcp", cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+
+	// Accepts the connection but never answers the hello
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		accepted <- conn
+	}()
+
+	c1 := &Client{addr: cPort}
+
+	go c1.Session()
+
+	conn := <-accepted
+	defer conn.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		c1.Events()
+		c1.rememberLWT(&Message{CorrelationId: "x"})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("client lock was held while setting up the session")
+	}
+}
+
 func TestServiceAbandon(t *testing.T) {
 	serv, err := NewMemService(cPort)
 	if err != nil {
@@ -558,3 +768,1205 @@ func TestServiceDeclareLWTOnEphemeral(t *testing.T) {
 
 	assert.Equal(t, "death", got.Message.Type)
 }
+
+func TestServiceDrain(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	c1, err := NewClient(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer c1.Close()
+
+	c1.Declare("a")
+	c1.Push("a", Msg([]byte("hello")))
+
+	del, err := c1.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	drained := make(chan struct{})
+
+	go func() {
+		serv.Drain(10 * time.Second)
+		close(drained)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	c1.Push("a", Msg([]byte("again")))
+
+	_, err = c1.Poll("a")
+	assert.Equal(t, EDraining.Error(), err.Error())
+
+	assert.NoError(t, del.Ack())
+
+	select {
+	case <-drained:
+	case <-time.After(1 * time.Second):
+		t.Fatal("drain didn't finish once all messages were acked")
+	}
+}
+
+func TestServiceDrainGraceExpires(t *testing.T) {
+	reg := NewMemRegistry()
+
+	serv, err := NewService(cPort, reg)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	c1, err := NewClient(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer c1.Close()
+
+	c1.Declare("a")
+	c1.Declare("dead")
+	c1.Push(":lwt", &Message{ReplyTo: "dead"})
+	c1.Push("a", Msg([]byte("hello")))
+
+	del, err := c1.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	start := time.Now()
+
+	serv.Drain(100 * time.Millisecond)
+
+	assert.True(t, time.Since(start) < time.Second)
+
+	// The message that was never acked is back in the mailbox and
+	// the LWT was fired.
+	got, err := reg.Poll("a")
+	require.NoError(t, err)
+	assert.NotNil(t, got)
+
+	lwt, err := reg.Poll("dead")
+	require.NoError(t, err)
+	assert.NotNil(t, lwt)
+}
+
+func TestServiceUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vega")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.AcceptInsecure()
+
+	path := filepath.Join(dir, "vega.sock")
+
+	err = serv.ListenUnix(path, 0600)
+	require.NoError(t, err)
+
+	go serv.AcceptUnix()
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	c1, err := NewInsecureClient("unix:" + path)
+	if err != nil {
+		panic(err)
+	}
+
+	defer c1.Close()
+
+	err = c1.Declare("a")
+	require.NoError(t, err)
+
+	payload := Msg([]byte("hello"))
+
+	err = c1.Push("a", payload)
+	require.NoError(t, err)
+
+	got, err := c1.Poll("a")
+	require.NoError(t, err)
+
+	assert.True(t, payload.Equal(got.Message))
+}
+
+func TestServiceUnixSocketInUse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vega")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "vega.sock")
+
+	// A stale socket from a process that has gone is replaced
+	stale, err := net.Listen("unix", path)
+	require.NoError(t, err)
+
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.AcceptInsecure()
+
+	err = serv.ListenUnix(path, 0600)
+	require.NoError(t, err)
+
+	go serv.AcceptUnix()
+
+	serv2, err := NewMemService(cPort2)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv2.Close()
+	go serv2.AcceptInsecure()
+
+	err = serv2.ListenUnix(path, 0600)
+	assert.True(t, errors.Equal(err, ESocketInUse), "took over a live socket: %v", err)
+
+	c1, err := NewInsecureClient("unix:" + path)
+	if err != nil {
+		panic(err)
+	}
+
+	defer c1.Close()
+
+	err = c1.Declare("a")
+	require.NoError(t, err)
+}
+
+func TestServiceHello(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	serv.NodeId = "node-a"
+
+	defer serv.Close()
+	go serv.Accept()
+
+	c1, err := NewClient(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer c1.Close()
+
+	hello, err := c1.ServerHello()
+	require.NoError(t, err)
+
+	assert.Equal(t, ProtocolVersion, hello.Version)
+	assert.Equal(t, "node-a", hello.NodeId)
+	assert.True(t, c1.HasFeature(FeatureLWT))
+	assert.False(t, c1.HasFeature("not-a-feature"))
+}
+
+func TestClientHelloAgainstOldServer(t *testing.T) {
+	l, err := net.Listen("tcp", cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer l.Close()
+
+	declared := make(chan string, 1)
+
+	// Behaves like a server that predates the hello exchange. It reads
+	// a type byte at a time and rejects the ones it doesn't know
+	// without reading their body, so the rest of the hello is read as
+	// more frames.
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		sess, err := yamux.Server(conn, newMuxConfig(0, 0))
+		if err != nil {
+			return
+		}
+
+		defer sess.Close()
+
+		for {
+			s, err := sess.AcceptStream()
+			if err != nil {
+				return
+			}
+
+			go func(s net.Conn) {
+				defer s.Close()
+
+				buf := []byte{0}
+
+				for {
+					n, err := s.Read(buf)
+					if n == 0 || err != nil {
+						return
+					}
+
+					switch MessageType(buf[0]) {
+					case DeclareType:
+						var msg Declare
+
+						err = codec.NewDecoder(s, &msgpack).Decode(&msg)
+						if err != nil {
+							return
+						}
+
+						select {
+						case declared <- msg.Name:
+						default:
+						}
+
+						_, err = s.Write([]byte{uint8(SuccessType)})
+					default:
+						s.Write([]byte{uint8(ErrorType)})
+						err = codec.NewEncoder(s, &msgpack).Encode(&Error{EProtocolError.Error()})
+					}
+
+					if err != nil {
+						return
+					}
+				}
+			}(s)
+		}
+	}()
+
+	c1, err := NewInsecureClient(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer c1.Close()
+
+	hello, err := c1.ServerHello()
+	require.NoError(t, err)
+
+	assert.Equal(t, 0, hello.Version)
+	assert.False(t, c1.HasFeature(FeatureLWT))
+
+	// The stray frames from the hello don't leak into later requests
+	for i := 0; i < 3; i++ {
+		err = c1.Declare("a")
+		require.NoError(t, err)
+
+		assert.Equal(t, "a", <-declared)
+	}
+}
+
+func rawSession(t testing.TB, addr string) *yamux.Session {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+
+	sess, err := yamux.Client(conn, newMuxConfig(0, 0))
+	require.NoError(t, err)
+
+	return sess
+}
+
+func TestServiceHeartbeatTimeout(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	serv.HeartbeatTimeout = 50 * time.Millisecond
+
+	defer serv.Close()
+	go serv.AcceptInsecure()
+
+	sess := rawSession(t, cPort)
+	defer sess.Close()
+
+	request := func(mt MessageType, v interface{}) {
+		s, err := sess.Open()
+		require.NoError(t, err)
+
+		defer s.Close()
+
+		err = writeRequest(s, mt, v)
+		require.NoError(t, err)
+
+		_, err = readResponse(bufio.NewReader(s), DefaultMaxFrameSize)
+		require.NoError(t, err)
+	}
+
+	// Promise heartbeats, then never send one
+	request(HelloType, &Hello{Version: ProtocolVersion, Heartbeat: "10ms"})
+	request(EphemeralDeclareType, &Declare{Name: "e"})
+
+	time.Sleep(300 * time.Millisecond)
+
+	assert.True(t, sess.IsClosed(), "silent session was not closed")
+
+	c1, err := NewInsecureClient(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer c1.Close()
+
+	err = c1.Push("e", Msg([]byte("hello")))
+	assert.Error(t, err, "ephemeral mailbox was not cleaned up")
+}
+
+func TestClientHeartbeatKeepsSessionAlive(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	serv.HeartbeatTimeout = 50 * time.Millisecond
+
+	defer serv.Close()
+	go serv.AcceptInsecure()
+
+	c1 := &Client{addr: cPort, HeartbeatInterval: 10 * time.Millisecond}
+	defer c1.Close()
+
+	err = c1.EphemeralDeclare("e")
+	require.NoError(t, err)
+
+	events := c1.Events()
+
+	time.Sleep(300 * time.Millisecond)
+
+	select {
+	case ev := <-events:
+		t.Fatalf("session was lost: %#v", ev)
+	default:
+	}
+
+	c2, err := NewInsecureClient(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer c2.Close()
+
+	err = c2.Push("e", Msg([]byte("hello")))
+	assert.NoError(t, err)
+}
+
+func TestServiceRejectsMalformedFrame(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.AcceptInsecure()
+
+	sess := rawSession(t, cPort)
+	defer sess.Close()
+
+	s, err := sess.Open()
+	require.NoError(t, err)
+
+	// A push frame whose body is a msgpack string rather than a map
+	_, err = s.Write([]byte{uint8(PushType), 0xa3, 'b', 'a', 'd'})
+	require.NoError(t, err)
+
+	buf := []byte{0}
+
+	_, err = io.ReadFull(s, buf)
+	require.NoError(t, err)
+
+	assert.Equal(t, ErrorType, MessageType(buf[0]))
+
+	var msgerr Error
+
+	err = codec.NewDecoder(s, &msgpack).Decode(&msgerr)
+	require.NoError(t, err)
+
+	assert.Contains(t, msgerr.Error, EMalformedFrame.Error())
+
+	time.Sleep(100 * time.Millisecond)
+
+	assert.True(t, sess.IsClosed(), "offending session was not closed")
+
+	c1, err := NewInsecureClient(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer c1.Close()
+
+	err = c1.Declare("a")
+	assert.NoError(t, err, "service stopped working")
+}
+
+func TestServiceRejectsLargeMessage(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	serv.MaxMessageSize = 10
+
+	defer serv.Close()
+	go serv.AcceptInsecure()
+
+	c1, err := NewInsecureClient(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer c1.Close()
+
+	c1.Declare("a")
+
+	err = c1.Push("a", Msg("this is too long"))
+	assert.Error(t, err)
+
+	err = c1.Push("a", Msg("short"))
+	assert.NoError(t, err)
+}
+
+func TestServiceRejectsLargeFrame(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	serv.MaxFrameSize = 100
+
+	defer serv.Close()
+	go serv.AcceptInsecure()
+
+	c1, err := NewInsecureClient(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer c1.Close()
+
+	c1.Declare("a")
+
+	err = c1.Push("a", Msg(make([]byte, 200)))
+	assert.Error(t, err)
+}
+
+func FuzzService(f *testing.F) {
+	for _, v := range []interface{}{
+		&Declare{Name: "a"},
+		&Poll{Name: "a"},
+		&LongPoll{Name: "a", Duration: "10ms"},
+		&Push{Name: "a", Message: Msg("hello")},
+		&AckMessage{MessageId: "m1"},
+		&Hello{Version: ProtocolVersion},
+	} {
+		var body []byte
+		codec.NewEncoderBytes(&body, &msgpack).Encode(v)
+
+		for _, mt := range []MessageType{DeclareType, PollType, LongPollType, PushType, AckType, HelloType} {
+			f.Add(append([]byte{uint8(mt)}, body...))
+		}
+	}
+
+	serv, err := NewMemService("127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.AcceptInsecure()
+
+	serv.Registry.Declare("a")
+
+	addr := serv.listener.Addr().String()
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		sess := rawSession(t, addr)
+		defer sess.Close()
+
+		s, err := sess.Open()
+		require.NoError(t, err)
+
+		s.Write(data)
+		s.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		ioutil.ReadAll(s)
+
+		sess.Close()
+
+		c, err := NewInsecureClient(addr)
+		require.NoError(t, err)
+
+		defer c.Close()
+
+		err = c.Declare("a")
+		require.NoError(t, err, "service stopped working")
+	})
+}
+
+type panickyStorage struct {
+	Storage
+}
+
+func (p panickyStorage) Push(name string, msg *Message) error {
+	if name == "boom" {
+		panic("boom")
+	}
+
+	return p.Storage.Push(name, msg)
+}
+
+func TestServiceRecoversFromHandlerPanic(t *testing.T) {
+	serv, err := NewService(cPort, panickyStorage{NewMemRegistry()})
+	if err != nil {
+		panic(err)
+	}
+
+	go serv.Accept()
+
+	c1, err := NewClient(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer c1.Close()
+
+	c1.Declare("a")
+
+	payload := Msg([]byte("hello"))
+
+	err = c1.Push("a", payload)
+	require.NoError(t, err)
+
+	del, err := c1.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	err = c1.Push("boom", payload)
+	assert.Error(t, err)
+
+	// The panicking client was dropped and the message it held nack'd
+	c2, err := NewClient(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer c2.Close()
+
+	var again *Delivery
+
+	for i := 0; i < 50 && again == nil; i++ {
+		again, err = c2.Poll("a")
+		require.NoError(t, err)
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	require.NotNil(t, again)
+	assert.True(t, payload.Equal(again.Message))
+
+	closed := make(chan error, 1)
+
+	go func() {
+		closed <- serv.Close()
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("service hung closing after a panic")
+	}
+}
+
+func TestClientSharedAcrossGoroutines(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	c1, err := NewClient(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer c1.Close()
+
+	assert.True(t, c1.HasFeature(FeaturePipeline))
+
+	c1.Declare("a")
+
+	const workers = 20
+	const perWorker = 50
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < perWorker; j++ {
+				err := c1.Push("a", Msg([]byte("hello")))
+				assert.NoError(t, err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	got := make(chan *Delivery, workers*perWorker)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < perWorker; j++ {
+				del, err := c1.Poll("a")
+				if assert.NoError(t, err) && assert.NotNil(t, del) {
+					assert.NoError(t, del.Ack())
+					got <- del
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	assert.Equal(t, workers*perWorker, len(got))
+
+	stats, err := c1.Stats()
+	require.NoError(t, err)
+
+	assert.Equal(t, 0, stats.InFlight)
+}
+
+func TestClientLongPollCancelNacks(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	c1, err := NewClient(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer c1.Close()
+
+	c1.DisablePipelining()
+
+	c1.Declare("a")
+
+	done := make(chan struct{})
+	close(done)
+
+	del, err := c1.LongPollCancelable("a", 200*time.Millisecond, done)
+	require.NoError(t, err)
+	assert.Nil(t, del)
+
+	// The canceled poll is still outstanding on the server and picks
+	// this up. The client must give it back since no one wants it.
+	payload := Msg([]byte("hello"))
+
+	err = c1.Push("a", payload)
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+
+	del, err = c1.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	assert.True(t, payload.Equal(del.Message))
+}
+
+func TestClientLongPollContextCanceled(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	c1, err := NewClient(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer c1.Close()
+
+	c1.Declare("a")
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+
+	del, err := c1.LongPollContext(ctx, "a", 10*time.Second)
+	assert.Equal(t, context.Canceled, err)
+	assert.Nil(t, del)
+	assert.True(t, time.Since(start) < time.Second)
+
+	// The server aborted the poll, so the message is available
+	// right away.
+	payload := Msg([]byte("hello"))
+
+	err = c1.Push("a", payload)
+	require.NoError(t, err)
+
+	del, err = c1.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	assert.True(t, payload.Equal(del.Message))
+}
+
+func TestServiceCancelGetsPastFullPipeline(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	serv.MaxPipelined = 1
+
+	defer serv.Close()
+	go serv.Accept()
+
+	c1, err := NewClient(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer c1.Close()
+
+	c1.Declare("a")
+	c1.Declare("b")
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	first := make(chan error, 1)
+
+	go func() {
+		_, err := c1.LongPollContext(ctx, "a", 10*time.Second)
+		first <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	// The first poll has used up the budget for waiting requests
+	_, err = c1.LongPoll("b", 10*time.Second)
+	assert.True(t, errors.Equal(err, ETooManyWaiting))
+
+	// but not the slots everything else needs
+	payload := Msg([]byte("hello"))
+
+	err = c1.Push("b", payload)
+	require.NoError(t, err)
+
+	del, err := c1.Poll("b")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	require.NoError(t, del.Ack())
+
+	hctx, hcancel := context.WithTimeout(context.Background(), time.Second)
+	defer hcancel()
+
+	_, err = c1.request(hctx, HeartbeatType, nil)
+	require.NoError(t, err)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-first)
+
+	time.Sleep(50 * time.Millisecond)
+
+	// The server stopped the first poll, so another may wait
+	second := make(chan *Delivery, 1)
+
+	go func() {
+		del, _ := c1.LongPoll("b", 10*time.Second)
+		second <- del
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	c2, err := NewClient(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer c2.Close()
+
+	err = c2.Push("b", payload)
+	require.NoError(t, err)
+
+	select {
+	case del := <-second:
+		require.NotNil(t, del)
+		assert.True(t, payload.Equal(del.Message))
+	case <-time.After(time.Second):
+		t.Fatal("second poll never ran")
+	}
+}
+
+func TestClientMaxFrameSize(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	c1, err := NewClient(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer c1.Close()
+
+	c1.MaxFrameSize = 1024
+
+	c1.Declare("a")
+
+	err = c1.Push("a", Msg(bytes.Repeat([]byte("x"), 2048)))
+	require.NoError(t, err)
+
+	_, err = c1.Poll("a")
+	assert.Equal(t, EFrameTooLarge, err)
+}
+
+func TestClientLongPollContextDeadline(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	c1, err := NewClient(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer c1.Close()
+
+	c1.Declare("a")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+
+	_, err = c1.LongPollContext(ctx, "a", 10*time.Second)
+	if err != nil {
+		assert.Equal(t, context.DeadlineExceeded, err)
+	}
+
+	assert.True(t, time.Since(start) < time.Second)
+
+	err = c1.PushContext(ctx, "a", Msg([]byte("hello")))
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestClientWithoutPipelining(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	c1, err := NewClient(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer c1.Close()
+
+	c1.DisablePipelining()
+
+	c1.Declare("a")
+
+	payload := Msg([]byte("hello"))
+
+	err = c1.Push("a", payload)
+	require.NoError(t, err)
+
+	del, err := c1.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	assert.True(t, payload.Equal(del.Message))
+	assert.NoError(t, del.Ack())
+}
+
+func benchmarkClientPush(b *testing.B, pipelined, parallel bool) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	c1, err := NewClient(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer c1.Close()
+
+	if !pipelined {
+		c1.DisablePipelining()
+	}
+
+	c1.Declare("a")
+
+	payload := []byte("hello")
+
+	b.ResetTimer()
+
+	if !parallel {
+		for i := 0; i < b.N; i++ {
+			c1.Push("a", Msg(payload))
+		}
+
+		return
+	}
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c1.Push("a", Msg(payload))
+		}
+	})
+}
+
+func BenchmarkClientPushStream(b *testing.B) {
+	benchmarkClientPush(b, false, false)
+}
+
+func BenchmarkClientPushPipelined(b *testing.B) {
+	benchmarkClientPush(b, true, false)
+}
+
+func BenchmarkClientPushStreamParallel(b *testing.B) {
+	benchmarkClientPush(b, false, true)
+}
+
+func BenchmarkClientPushPipelinedParallel(b *testing.B) {
+	benchmarkClientPush(b, true, true)
+}
+
+func TestClientExclusiveLock(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	c1, err := NewClient(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer c1.Close()
+
+	c2, err := NewClient(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer c2.Close()
+
+	c1.Declare("a")
+	c1.Push("a", Msg([]byte("hello")))
+
+	require.NoError(t, c1.LockMailbox("a"))
+
+	err = c2.LockMailbox("a")
+	assert.True(t, errors.Equal(err, EMailboxLocked))
+
+	_, err = c2.Poll("a")
+	assert.True(t, errors.Equal(err, EMailboxLocked))
+
+	_, err = c2.LongPoll("a", 1*time.Second)
+	assert.True(t, errors.Equal(err, EMailboxLocked))
+
+	del, err := c1.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	// c2 waits as a standby and takes over when c1 goes away, getting
+	// the message c1 never acked.
+	locked := make(chan error, 1)
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		locked <- c2.WaitLockMailbox(ctx, "a")
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	c1.Close()
+
+	select {
+	case err := <-locked:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("standby didn't take over the lock")
+	}
+
+	del, err = c2.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	assert.Equal(t, []byte("hello"), del.Message.Body)
+
+	require.NoError(t, c2.UnlockMailbox("a"))
+	assert.Equal(t, "", serv.Locks.Owner("a"))
+}
+
+func TestClientTransact(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	client, err := NewClient(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer client.Close()
+
+	client.Declare("a")
+	client.Declare("b")
+	client.Push("a", Msg([]byte("in")))
+
+	del, err := client.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	// Acks must be of messages this client holds, from the named mailbox
+	var bad Transaction
+	bad.Ack("b", del.Message.MessageId)
+	bad.Push("b", Msg([]byte("out")))
+
+	err = client.Transact(&bad)
+	assert.Error(t, err)
+
+	var tx Transaction
+	tx.Ack("a", del.Message.MessageId)
+	tx.Push("b", Msg([]byte("out")))
+
+	err = client.Transact(&tx)
+	require.NoError(t, err)
+
+	out, err := client.Poll("b")
+	require.NoError(t, err)
+	require.NotNil(t, out)
+
+	assert.Equal(t, []byte("out"), out.Message.Body)
+
+	stats := serv.Registry.(*Registry).mailboxes["a"].Stats()
+	assert.Equal(t, 0, stats.InFlight)
+}
+
+func TestClientBatchAcks(t *testing.T) {
+	serv, err := NewMemService(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer serv.Close()
+	go serv.Accept()
+
+	client, err := NewClient(cPort)
+	if err != nil {
+		panic(err)
+	}
+
+	defer client.Close()
+
+	client.Declare("a")
+
+	for _, body := range []string{"1", "2", "3", "4", "5"} {
+		client.Push("a", Msg([]byte(body)))
+	}
+
+	var dels []*Delivery
+
+	for i := 0; i < 5; i++ {
+		del, err := client.Poll("a")
+		require.NoError(t, err)
+		require.NotNil(t, del)
+
+		dels = append(dels, del)
+	}
+
+	err = AckMany(dels[:2])
+	require.NoError(t, err)
+
+	err = client.NackMany([]MessageId{dels[2].Message.MessageId})
+	require.NoError(t, err)
+
+	acked, err := dels[4].AckThrough()
+	require.NoError(t, err)
+
+	assert.Equal(t, []MessageId{dels[3].Message.MessageId, dels[4].Message.MessageId}, acked)
+
+	stats, err := client.Stats()
+	require.NoError(t, err)
+
+	assert.Equal(t, 0, stats.InFlight)
+
+	del, err := client.Poll("a")
+	require.NoError(t, err)
+	require.NotNil(t, del)
+
+	assert.Equal(t, []byte("3"), del.Message.Body)
+
+	err = client.AckMany([]MessageId{del.Message.MessageId, "bogus"})
+	assert.Error(t, err)
+}
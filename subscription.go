@@ -1,41 +1,128 @@
 package vega
 
-import "strings"
+import (
+	"fmt"
+	"strings"
 
+	"github.com/ugorji/go/codec"
+	"github.com/vektra/errors"
+)
+
+// Patterns are split into levels on /. A + matches exactly one level,
+// which may be empty, in any position. A # as the last level matches
+// zero or more levels, so foo/# matches foo, foo/bar and foo/bar/baz.
+//
+// A pattern of the form $share/<group>/<pattern> joins the mailbox to
+// a shared group. Each matching publish goes to just one of the
+// mailboxes in the group, taking turns.
 type Subscription struct {
 	Pattern string
-	Parts   []string
-	Strict  bool
+
+	// The shared group the subscription is in, if any
+	Group string
+
+	// The levels of the pattern, without any trailing #
+	Parts []string
+
+	// false if the pattern ends in #
+	Strict bool
+
 	Mailbox string
+
+	// Only messages that match this are delivered, if it's set
+	Filter *SubscriptionFilter
+}
+
+// Implemented by a Storage that can list the subscriptions made
+// through :subscribe.
+type SubscriptionLister interface {
+	Subscriptions() []*Subscription
+}
+
+var ESubscriptionPattern = errors.New("invalid subscription pattern")
+
+// Patterns starting with this join a shared group
+const SharedPrefix = "$share/"
+
+// Return the pattern to subscribe to so as to join group, receiving
+// a share of the publishes that match pattern.
+func SharedPattern(group, pattern string) string {
+	return SharedPrefix + group + "/" + pattern
+}
+
+// Split a $share/<group>/<pattern> pattern up. ok is false if pattern
+// isn't one.
+func splitShared(pattern string) (group, rest string, ok bool) {
+	if !strings.HasPrefix(pattern, SharedPrefix) {
+		return "", pattern, false
+	}
+
+	tail := pattern[len(SharedPrefix):]
+
+	slash := strings.Index(tail, "/")
+	if slash <= 0 {
+		return "", pattern, false
+	}
+
+	return tail[:slash], tail[slash+1:], true
 }
 
 func ParseSubscription(pattern string) *Subscription {
-	parts := strings.Split(pattern, "/")
+	group, rest, _ := splitShared(pattern)
+
+	parts := strings.Split(rest, "/")
 
 	var strict bool
 
 	if parts[len(parts)-1] == "#" {
-		parts[len(parts)-1] = "+"
+		parts = parts[:len(parts)-1]
 	} else {
 		strict = true
 	}
 
-	return &Subscription{pattern, parts, strict, ""}
+	return &Subscription{pattern, group, parts, strict, "", nil}
 }
 
-func (s *Subscription) Match(lit string) bool {
-	parts := strings.Split(lit, "/")
+// Check that pattern only uses + and # as whole levels, and # only as
+// the last level. ParseSubscription treats them as literals otherwise.
+// The group of a shared pattern can't contain them at all.
+func CheckPattern(pattern string) error {
+	levels := pattern
 
-	if len(parts) != len(s.Parts) {
-		if s.Strict {
-			return false
+	if strings.HasPrefix(pattern, SharedPrefix) {
+		group, rest, ok := splitShared(pattern)
+		if !ok || strings.ContainsAny(group, "+#") {
+			return errors.Subject(ESubscriptionPattern, pattern)
 		}
 
-		if len(parts) < len(s.Parts) {
-			return false
+		levels = rest
+	}
+
+	parts := strings.Split(levels, "/")
+
+	for i, part := range parts {
+		if part == "+" || (part == "#" && i == len(parts)-1) {
+			continue
 		}
 
-		parts = parts[:len(s.Parts)]
+		if strings.ContainsAny(part, "+#") {
+			return errors.Subject(ESubscriptionPattern, pattern)
+		}
+	}
+
+	return nil
+}
+
+// Returns true if the topic lit matches the pattern
+func (s *Subscription) Match(lit string) bool {
+	parts := strings.Split(lit, "/")
+
+	if s.Strict {
+		if len(parts) != len(s.Parts) {
+			return false
+		}
+	} else if len(parts) < len(s.Parts) {
+		return false
 	}
 
 	for i, against := range s.Parts {
@@ -50,3 +137,109 @@ func (s *Subscription) Match(lit string) bool {
 
 	return true
 }
+
+// Returns true if msg's topic, in CorrelationId, matches the pattern
+// and msg passes the filter.
+func (s *Subscription) MatchMessage(msg *Message) bool {
+	return s.Match(msg.CorrelationId) && s.Filter.Match(msg)
+}
+
+// Narrows a subscription to messages with certain properties. Fields
+// left empty match any message.
+type SubscriptionFilter struct {
+	Type        string `codec:"type,omitempty" json:"type,omitempty"`
+	ContentType string `codec:"content_type,omitempty" json:"content_type,omitempty"`
+
+	// Headers that must be set to these values
+	Headers map[string]string `codec:"headers,omitempty" json:"headers,omitempty"`
+
+	// Headers that must be set, to any value
+	HasHeaders []string `codec:"has_headers,omitempty" json:"has_headers,omitempty"`
+}
+
+// Returns true if msg has the properties f asks for. A nil filter
+// matches every message.
+func (f *SubscriptionFilter) Match(msg *Message) bool {
+	if f == nil {
+		return true
+	}
+
+	if f.Type != "" && msg.Type != f.Type {
+		return false
+	}
+
+	if f.ContentType != "" && msg.ContentType != f.ContentType {
+		return false
+	}
+
+	for _, name := range f.HasHeaders {
+		if _, ok := msg.Headers[name]; !ok {
+			return false
+		}
+	}
+
+	for name, val := range f.Headers {
+		if !headerIs(msg, name, val) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns true if msg has the header name set to val, comparing values
+// that aren't strings by how they print.
+func headerIs(msg *Message, name, val string) bool {
+	v, ok := msg.Headers[name]
+	if !ok {
+		return false
+	}
+
+	switch v := v.(type) {
+	case string:
+		return v == val
+	case []byte:
+		return string(v) == val
+	default:
+		return fmt.Sprint(v) == val
+	}
+}
+
+// Create the message to push to :subscribe to subscribe mailbox to
+// pattern, delivering only messages that pass filter if it's set.
+func SubscribeMessage(mailbox, pattern string, filter *SubscriptionFilter) *Message {
+	msg := &Message{ReplyTo: mailbox, CorrelationId: pattern}
+
+	if filter != nil {
+		msg.ContentType = ctMsgPack
+		codec.NewEncoderBytes(&msg.Body, &msgpack).Encode(filter)
+	}
+
+	return msg
+}
+
+// Read the subscription a message pushed to :subscribe asks for. The
+// mailbox is in ReplyTo, the pattern in CorrelationId and the body, if
+// any, is the filter encoded with msgpack.
+func ParseSubscribeMessage(msg *Message) (*Subscription, error) {
+	err := CheckPattern(msg.CorrelationId)
+	if err != nil {
+		return nil, err
+	}
+
+	sub := ParseSubscription(msg.CorrelationId)
+	sub.Mailbox = msg.ReplyTo
+
+	if len(msg.Body) > 0 {
+		var filter SubscriptionFilter
+
+		err = codec.NewDecoderBytes(msg.Body, &msgpack).Decode(&filter)
+		if err != nil {
+			return nil, errors.Subject(EMalformedFrame, "subscription filter")
+		}
+
+		sub.Filter = &filter
+	}
+
+	return sub, nil
+}
@@ -36,11 +36,100 @@ func TestSubscription(t *testing.T) {
 		assert.True(t, sub.Match("foo/bar"))
 		assert.True(t, sub.Match("foo/bar/baz"))
 		assert.True(t, sub.Match("foo/bar/baz/quz"))
-		assert.False(t, sub.Match("foo"))
+		assert.True(t, sub.Match("foo"))
+		assert.False(t, sub.Match("foobar"))
 		assert.False(t, sub.Match("bar"))
 		assert.False(t, sub.Match("bar/foo"))
 		assert.False(t, sub.Match("bar/qux"))
 	})
 
+	n.It("uses # alone to match everything", func() {
+		sub := ParseSubscription("#")
+		assert.True(t, sub.Match("foo"))
+		assert.True(t, sub.Match("foo/bar"))
+		assert.True(t, sub.Match(""))
+	})
+
+	n.It("uses + to match a segment in any position", func() {
+		sub := ParseSubscription("+/bar/+")
+		assert.True(t, sub.Match("foo/bar/baz"))
+		assert.False(t, sub.Match("foo/baz/baz"))
+		assert.False(t, sub.Match("foo/bar"))
+	})
+
+	n.It("uses + to match an empty segment", func() {
+		sub := ParseSubscription("foo/+/baz")
+		assert.True(t, sub.Match("foo//baz"))
+
+		sub = ParseSubscription("foo/+")
+		assert.True(t, sub.Match("foo/"))
+		assert.False(t, sub.Match("foo"))
+	})
+
+	n.It("only allows + and # as whole levels", func() {
+		assert.NoError(t, CheckPattern("foo/+/bar/#"))
+		assert.Error(t, CheckPattern("foo/#/bar"))
+		assert.Error(t, CheckPattern("foo/ba+"))
+		assert.Error(t, CheckPattern("foo#"))
+	})
+
+	n.It("filters on type, content type and headers", func() {
+		sub := ParseSubscription("order/#")
+		sub.Filter = &SubscriptionFilter{
+			Type:       "refund",
+			Headers:    map[string]string{"region": "eu"},
+			HasHeaders: []string{"customer"},
+		}
+
+		msg := &Message{CorrelationId: "order/1", Type: "refund"}
+		msg.AddHeader("region", []byte("eu"))
+		msg.AddHeader("customer", 42)
+
+		assert.True(t, sub.MatchMessage(msg))
+
+		msg.Type = "purchase"
+		assert.False(t, sub.MatchMessage(msg))
+
+		msg.Type = "refund"
+		msg.AddHeader("region", "us")
+		assert.False(t, sub.MatchMessage(msg))
+
+		msg.AddHeader("region", "eu")
+		delete(msg.Headers, "customer")
+		assert.False(t, sub.MatchMessage(msg))
+
+		sub.Filter = &SubscriptionFilter{ContentType: "text/plain"}
+		assert.False(t, sub.MatchMessage(msg))
+
+		msg.ContentType = "text/plain"
+		assert.True(t, sub.MatchMessage(msg))
+	})
+
+	n.It("round trips through a subscribe message", func() {
+		filter := &SubscriptionFilter{Type: "refund"}
+
+		sub, err := ParseSubscribeMessage(SubscribeMessage("a", "order/#", filter))
+		assert.NoError(t, err)
+
+		assert.Equal(t, "a", sub.Mailbox)
+		assert.Equal(t, "order/#", sub.Pattern)
+		assert.Equal(t, filter, sub.Filter)
+
+		_, err = ParseSubscribeMessage(SubscribeMessage("a", "order/#/x", nil))
+		assert.Error(t, err)
+	})
+
+	n.It("parses shared groups", func() {
+		sub := ParseSubscription(SharedPattern("workers", "order/+"))
+		assert.Equal(t, "workers", sub.Group)
+		assert.Equal(t, "$share/workers/order/+", sub.Pattern)
+		assert.True(t, sub.Match("order/1"))
+		assert.False(t, sub.Match("$share/workers/order/1"))
+
+		assert.NoError(t, CheckPattern("$share/workers/order/#"))
+		assert.Error(t, CheckPattern("$share/work+/order"))
+		assert.Error(t, CheckPattern("$share/workers"))
+	})
+
 	n.Meow()
 }
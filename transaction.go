@@ -0,0 +1,185 @@
+package vega
+
+import (
+	"context"
+	"sort"
+
+	"github.com/vektra/errors"
+)
+
+var ETransactUnsupported = errors.New("mailbox does not support transactions")
+
+// The part of a transaction that touches one mailbox
+type MailboxTx struct {
+	Name    string
+	Mailbox Mailbox
+	Acks    []MessageId
+	Pushes  []*Message
+}
+
+// Applies the parts of a transaction to their mailboxes atomically.
+// The parts are sorted by name and each mailbox appears once.
+type MailboxTransactor interface {
+	Transact([]*MailboxTx) error
+}
+
+// Split tx up by mailbox, in name order. Returns ENoMailbox if any of
+// the mailboxes aren't in r. Must be called with r locked.
+func (r *Registry) mailboxTxs(tx *Transaction) ([]*MailboxTx, error) {
+	parts := make(map[string]*MailboxTx)
+
+	part := func(name string) (*MailboxTx, error) {
+		if p, ok := parts[name]; ok {
+			return p, nil
+		}
+
+		mailbox, ok := r.mailboxes[name]
+		if !ok {
+			return nil, errors.Subject(ENoMailbox, name)
+		}
+
+		p := &MailboxTx{Name: name, Mailbox: mailbox}
+		parts[name] = p
+
+		return p, nil
+	}
+
+	for _, ack := range tx.Acks {
+		p, err := part(ack.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		p.Acks = append(p.Acks, ack.MessageId)
+	}
+
+	for _, push := range tx.Pushes {
+		if push.Message == nil {
+			return nil, errors.Subject(EMalformedFrame, "push requires a message")
+		}
+
+		p, err := part(push.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		p.Pushes = append(p.Pushes, push.Message)
+	}
+
+	var ret []*MailboxTx
+
+	for _, p := range parts {
+		ret = append(ret, p)
+	}
+
+	sort.Sort(mailboxTxByName(ret))
+
+	return ret, nil
+}
+
+type mailboxTxByName []*MailboxTx
+
+func (m mailboxTxByName) Len() int           { return len(m) }
+func (m mailboxTxByName) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m mailboxTxByName) Less(i, j int) bool { return m[i].Name < m[j].Name }
+
+// Ack and push the messages in tx atomically. All the mailboxes must be
+// in the registry. Uses Transactor if set, otherwise the mailboxes must
+// be MemMailboxes.
+func (r *Registry) Transact(tx *Transaction) error {
+	if r.Transactor != nil {
+		return r.TransactWith(tx, r.Transactor.Transact)
+	}
+
+	return r.TransactWith(tx, memTransact)
+}
+
+// Like Transact, but the parts of tx are applied by apply, such as to
+// do more in the same storage transaction.
+func (r *Registry) TransactWith(tx *Transaction, apply func([]*MailboxTx) error) error {
+	r.Lock()
+	defer r.Unlock()
+
+	parts, err := r.mailboxTxs(tx)
+	if err != nil {
+		return err
+	}
+
+	return apply(parts)
+}
+
+// Returns true if the named mailbox has been declared
+func (r *Registry) Has(name string) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	_, ok := r.mailboxes[name]
+	return ok
+}
+
+// Return the named mailbox, if it has been declared
+func (r *Registry) Mailbox(name string) (Mailbox, bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	m, ok := r.mailboxes[name]
+	return m, ok
+}
+
+// Apply a transaction to MemMailboxes by locking them all, checking
+// that every ack will succeed and only then applying it.
+func memTransact(parts []*MailboxTx) error {
+	var boxes []*MemMailbox
+
+	for _, p := range parts {
+		mm, ok := p.Mailbox.(*MemMailbox)
+		if !ok {
+			return errors.Subject(ETransactUnsupported, p.Name)
+		}
+
+		boxes = append(boxes, mm)
+	}
+
+	for _, mm := range boxes {
+		mm.Lock()
+		defer mm.Unlock()
+	}
+
+	for i, p := range parts {
+		seen := make(map[MessageId]bool)
+
+		for _, id := range p.Acks {
+			if _, ok := boxes[i].inflight[id]; !ok || seen[id] {
+				return errors.Subject(EUnknownMessage, string(id))
+			}
+
+			seen[id] = true
+		}
+	}
+
+	for i, p := range parts {
+		mm := boxes[i]
+
+		for _, id := range p.Acks {
+			mm.ack(mm.inflight[id])
+		}
+
+		if len(p.Pushes) > 0 {
+			mm.add(p.Pushes...)
+			mm.feedWatchers()
+		}
+	}
+
+	return nil
+}
+
+func (c *Client) Transact(tx *Transaction) error {
+	return c.TransactContext(context.Background(), tx)
+}
+
+// Have the server ack and push the messages in tx atomically. The acks
+// are of messages this client has polled. The server only supports
+// this when all the mailboxes involved are local to it.
+func (c *Client) TransactContext(ctx context.Context, tx *Transaction) error {
+	return c.simpleRequest(ctx, TransactType, tx)
+}
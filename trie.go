@@ -0,0 +1,153 @@
+package vega
+
+import "strings"
+
+// An index of subscriptions by pattern, so that the subscriptions
+// matching a topic can be found without checking each one. It isn't
+// safe for concurrent use.
+type TopicTrie struct {
+	root *trieNode
+}
+
+type trieNode struct {
+	children map[string]*trieNode
+
+	// the node for a + in this position
+	any *trieNode
+
+	// subscriptions whose pattern ends here exactly
+	exact []*Subscription
+
+	// subscriptions whose pattern ends here with a trailing #, which
+	// also match topics with more levels
+	prefix []*Subscription
+}
+
+func NewTopicTrie() *TopicTrie {
+	return &TopicTrie{root: &trieNode{}}
+}
+
+// Add sub to the index
+func (t *TopicTrie) Add(sub *Subscription) {
+	n := t.root
+
+	for _, part := range sub.Parts {
+		n = n.child(part)
+	}
+
+	if sub.Strict {
+		n.exact = append(n.exact, sub)
+	} else {
+		n.prefix = append(n.prefix, sub)
+	}
+}
+
+func (n *trieNode) child(part string) *trieNode {
+	if part == "+" {
+		if n.any == nil {
+			n.any = &trieNode{}
+		}
+
+		return n.any
+	}
+
+	if n.children == nil {
+		n.children = make(map[string]*trieNode)
+	}
+
+	c, ok := n.children[part]
+	if !ok {
+		c = &trieNode{}
+		n.children[part] = c
+	}
+
+	return c
+}
+
+// Remove sub from the index. Returns false if it wasn't there.
+func (t *TopicTrie) Remove(sub *Subscription) bool {
+	removed, _ := t.root.remove(sub, sub.Parts)
+	return removed
+}
+
+// Returns if sub was removed and if n is now empty
+func (n *trieNode) remove(sub *Subscription, parts []string) (bool, bool) {
+	if len(parts) == 0 {
+		var removed bool
+
+		if sub.Strict {
+			n.exact, removed = removeSub(n.exact, sub)
+		} else {
+			n.prefix, removed = removeSub(n.prefix, sub)
+		}
+
+		return removed, n.empty()
+	}
+
+	part := parts[0]
+
+	var c *trieNode
+
+	if part == "+" {
+		c = n.any
+	} else {
+		c = n.children[part]
+	}
+
+	if c == nil {
+		return false, false
+	}
+
+	removed, empty := c.remove(sub, parts[1:])
+
+	if empty {
+		if part == "+" {
+			n.any = nil
+		} else {
+			delete(n.children, part)
+		}
+	}
+
+	return removed, n.empty()
+}
+
+func (n *trieNode) empty() bool {
+	return len(n.children) == 0 && n.any == nil && len(n.exact) == 0 && len(n.prefix) == 0
+}
+
+func removeSub(subs []*Subscription, sub *Subscription) ([]*Subscription, bool) {
+	for i, s := range subs {
+		if s == sub {
+			return append(subs[:i:i], subs[i+1:]...), true
+		}
+	}
+
+	return subs, false
+}
+
+// Return the subscriptions whose pattern matches topic. Their filters
+// aren't checked.
+func (t *TopicTrie) Match(topic string) []*Subscription {
+	// a pattern of just # matches everything
+	out := append([]*Subscription(nil), t.root.prefix...)
+
+	return t.root.match(strings.Split(topic, "/"), out)
+}
+
+func (n *trieNode) match(parts []string, out []*Subscription) []*Subscription {
+	if len(parts) == 0 {
+		return append(out, n.exact...)
+	}
+
+	if c, ok := n.children[parts[0]]; ok {
+		out = append(out, c.prefix...)
+		out = c.match(parts[1:], out)
+	}
+
+	if n.any != nil {
+		out = append(out, n.any.prefix...)
+		out = n.any.match(parts[1:], out)
+	}
+
+	return out
+}
@@ -0,0 +1,122 @@
+package vega
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var triePatterns = []string{
+	"a", "a/b", "a/+", "a/#", "+", "#", "+/b", "+/+/c", "a/b/#", "a/#/c", "b/#", "",
+}
+
+var trieTopics = []string{
+	"a", "a/b", "a/c", "a/b/c", "a/b/c/d", "b", "b/b", "x/y/c", "a/#/c", "", "a/",
+}
+
+// The trie has to agree with Subscription.Match
+func TestTopicTrieMatchesLikeSubscriptions(t *testing.T) {
+	trie := NewTopicTrie()
+
+	var subs []*Subscription
+
+	for _, pattern := range triePatterns {
+		sub := ParseSubscription(pattern)
+		subs = append(subs, sub)
+		trie.Add(sub)
+	}
+
+	for _, topic := range trieTopics {
+		var expected []string
+
+		for _, sub := range subs {
+			if sub.Match(topic) {
+				expected = append(expected, sub.Pattern)
+			}
+		}
+
+		var got []string
+
+		for _, sub := range trie.Match(topic) {
+			got = append(got, sub.Pattern)
+		}
+
+		assert.ElementsMatch(t, expected, got, "topic %q", topic)
+	}
+}
+
+func TestTopicTrieRemove(t *testing.T) {
+	trie := NewTopicTrie()
+
+	a := ParseSubscription("a/+")
+	b := ParseSubscription("a/+")
+	c := ParseSubscription("a/#")
+
+	trie.Add(a)
+	trie.Add(b)
+	trie.Add(c)
+
+	assert.Equal(t, 3, len(trie.Match("a/x")))
+
+	assert.True(t, trie.Remove(a))
+	assert.False(t, trie.Remove(a))
+
+	assert.ElementsMatch(t, []*Subscription{b, c}, trie.Match("a/x"))
+
+	assert.True(t, trie.Remove(b))
+	assert.True(t, trie.Remove(c))
+
+	assert.Equal(t, 0, len(trie.Match("a/x")))
+	assert.True(t, trie.root.empty())
+}
+
+// Subscriptions to sensor/<n>/+ and a few wildcards, with a publish
+// to one sensor.
+func benchSubscriptions(n int) []*Subscription {
+	var subs []*Subscription
+
+	for i := 0; i < n; i++ {
+		subs = append(subs, ParseSubscription(fmt.Sprintf("sensor/%d/+", i)))
+	}
+
+	subs = append(subs, ParseSubscription("sensor/#"))
+	subs = append(subs, ParseSubscription("+/7/temp"))
+
+	return subs
+}
+
+func benchmarkTopicTrie(b *testing.B, n int) {
+	trie := NewTopicTrie()
+
+	for _, sub := range benchSubscriptions(n) {
+		trie.Add(sub)
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		trie.Match("sensor/7/temp")
+	}
+}
+
+func benchmarkLinearMatch(b *testing.B, n int) {
+	subs := benchSubscriptions(n)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		var out []*Subscription
+
+		for _, sub := range subs {
+			if sub.Match("sensor/7/temp") {
+				out = append(out, sub)
+			}
+		}
+	}
+}
+
+func BenchmarkTopicTrie1000(b *testing.B)    { benchmarkTopicTrie(b, 1000) }
+func BenchmarkTopicTrie10000(b *testing.B)   { benchmarkTopicTrie(b, 10000) }
+func BenchmarkLinearMatch1000(b *testing.B)  { benchmarkLinearMatch(b, 1000) }
+func BenchmarkLinearMatch10000(b *testing.B) { benchmarkLinearMatch(b, 10000) }
@@ -0,0 +1,159 @@
+package vega
+
+import (
+	"context"
+
+	"github.com/vektra/errors"
+)
+
+var EUnknownTypeRoute = errors.New("no such type route")
+
+// Redirects the messages pushed to Mailbox by their Type. A message
+// goes to the sub-mailbox for its type, see TypeMailbox, if one has
+// been declared. Otherwise it goes to Fallback, or stays in Mailbox if
+// there's no fallback.
+//
+// Type routes only apply to pushes routed by the node they're set on.
+type TypeRoute struct {
+	Mailbox  string `codec:"mailbox" json:"mailbox"`
+	Fallback string `codec:"fallback,omitempty" json:"fallback,omitempty"`
+}
+
+// Return the name of the sub-mailbox of mailbox for messages of type
+// typ, such as billing.invoice.created.
+func TypeMailbox(mailbox, typ string) string {
+	return mailbox + "." + typ
+}
+
+// Implemented by a Storage that manages type routes
+type TypeRouteManager interface {
+	SetTypeRoute(*TypeRoute) error
+	RemoveTypeRoute(mailbox string) error
+	TypeRoutes() []*TypeRoute
+}
+
+// Return the name msg pushed to name should go to. A sub-mailbox or
+// fallback with a type route of its own is routed again, until a name
+// without one is reached. Routes that lead back to a name already
+// passed through stop at that name.
+func (r *Router) typeTarget(name string, msg *Message) string {
+	visited := map[string]bool{}
+
+	for !visited[name] {
+		visited[name] = true
+
+		next := r.typeStep(name, msg)
+		if next == name {
+			break
+		}
+
+		name = next
+	}
+
+	return name
+}
+
+// Return where the type route of name, if any, sends msg
+func (r *Router) typeStep(name string, msg *Message) string {
+	r.lock.Lock()
+	route, ok := r.typeRoutes[name]
+	r.lock.Unlock()
+
+	if !ok {
+		return name
+	}
+
+	if msg.Type != "" {
+		sub := TypeMailbox(name, msg.Type)
+
+		if _, ok := r.routes.Get(sub); ok {
+			return sub
+		}
+	}
+
+	if route.Fallback != "" {
+		return route.Fallback
+	}
+
+	return name
+}
+
+// Add route to the router, replacing the route of the same mailbox
+func (r *Router) SetTypeRoute(route *TypeRoute) error {
+	if route == nil || route.Mailbox == "" || route.Mailbox[0] == ':' {
+		return errors.Subject(EMalformedFrame, "type route requires a mailbox")
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	cp := *route
+	r.typeRoutes[route.Mailbox] = &cp
+
+	return nil
+}
+
+// Stop routing the messages pushed to mailbox by type
+func (r *Router) RemoveTypeRoute(mailbox string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.typeRoutes[mailbox]; !ok {
+		return errors.Subject(EUnknownTypeRoute, mailbox)
+	}
+
+	delete(r.typeRoutes, mailbox)
+
+	return nil
+}
+
+// Return the type routes that have been set
+func (r *Router) TypeRoutes() []*TypeRoute {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var routes []*TypeRoute
+
+	for _, route := range r.typeRoutes {
+		cp := *route
+		routes = append(routes, &cp)
+	}
+
+	return routes
+}
+
+type RemoveTypeRoute struct {
+	Mailbox string
+}
+
+type TypeRoutesResult struct {
+	TypeRoutes []*TypeRoute
+}
+
+// Have the server route the messages pushed to route.Mailbox by type
+func (c *Client) SetTypeRoute(route *TypeRoute) error {
+	return c.SetTypeRouteContext(context.Background(), route)
+}
+
+func (c *Client) SetTypeRouteContext(ctx context.Context, route *TypeRoute) error {
+	return c.simpleRequest(ctx, SetTypeRouteType, route)
+}
+
+func (c *Client) RemoveTypeRoute(mailbox string) error {
+	return c.simpleRequest(context.Background(), RemoveTypeRouteType, &RemoveTypeRoute{Mailbox: mailbox})
+}
+
+// Return the type routes set on the server
+func (c *Client) TypeRoutes() ([]*TypeRoute, error) {
+	resp, err := c.request(context.Background(), TypeRoutesType, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.Type {
+	case TypeRoutesResultType:
+		return resp.TypeRoutes.TypeRoutes, nil
+	default:
+		return nil, c.checkError(resp.error())
+	}
+}
@@ -0,0 +1,80 @@
+package vega
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/errors"
+)
+
+func TestTypeRoute(t *testing.T) {
+	r, reg := exchangeRouter("billing", "billing.invoice.created", "billing.other")
+
+	err := r.SetTypeRoute(&TypeRoute{Mailbox: "billing"})
+	require.NoError(t, err)
+
+	push := func(typ string) {
+		msg := Msg("hello")
+		msg.Type = typ
+
+		require.NoError(t, r.Push("billing", msg))
+	}
+
+	push("invoice.created")
+	push("invoice.paid")
+	push("")
+
+	assert.Equal(t, 1, pending(reg, "billing.invoice.created"))
+	assert.Equal(t, 2, pending(reg, "billing"), "without a fallback, the rest stay")
+
+	require.NoError(t, r.SetTypeRoute(&TypeRoute{Mailbox: "billing", Fallback: "billing.other"}))
+
+	push("invoice.created")
+	push("invoice.paid")
+
+	assert.Equal(t, 1, pending(reg, "billing.invoice.created"))
+	assert.Equal(t, 1, pending(reg, "billing.other"))
+	assert.Equal(t, 0, pending(reg, "billing"))
+
+	assert.Equal(t, []*TypeRoute{{Mailbox: "billing", Fallback: "billing.other"}}, r.TypeRoutes())
+
+	require.NoError(t, r.RemoveTypeRoute("billing"))
+
+	push("invoice.created")
+
+	assert.Equal(t, 0, pending(reg, "billing.invoice.created"))
+	assert.Equal(t, 1, pending(reg, "billing"))
+
+	err = r.RemoveTypeRoute("billing")
+	assert.True(t, errors.Equal(EUnknownTypeRoute, err))
+}
+
+func TestTypeRouteFollowsFallback(t *testing.T) {
+	r, reg := exchangeRouter("orders", "billing", "billing.invoice", "billing.other")
+
+	require.NoError(t, r.SetTypeRoute(&TypeRoute{Mailbox: "orders", Fallback: "billing"}))
+	require.NoError(t, r.SetTypeRoute(&TypeRoute{Mailbox: "billing", Fallback: "billing.other"}))
+
+	push := func(typ string) {
+		msg := Msg("hello")
+		msg.Type = typ
+
+		require.NoError(t, r.Push("orders", msg))
+	}
+
+	push("invoice")
+	push("refund")
+
+	assert.Equal(t, 1, pending(reg, "billing.invoice"))
+	assert.Equal(t, 1, pending(reg, "billing.other"))
+	assert.Equal(t, 0, pending(reg, "billing"))
+
+	// Routes that loop stop where they come back around
+	require.NoError(t, r.SetTypeRoute(&TypeRoute{Mailbox: "billing.other", Fallback: "orders"}))
+
+	push("refund")
+
+	assert.Equal(t, 1, pending(reg, "orders"))
+	assert.Equal(t, 0, pending(reg, "billing.other"))
+}
@@ -3,12 +3,17 @@ package vega
 import (
 	"encoding/binary"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"net"
+	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
 
 	crand "crypto/rand"
+
+	"github.com/vektra/errors"
 )
 
 // Lovely borrowed from consul
@@ -200,3 +205,68 @@ func XORBytes(dst, a, b []byte) int {
 
 	return n
 }
+
+var ESocketInUse = errors.New("unix socket is being served by another process")
+
+// listenUnix creates a unix domain socket listener at path and sets
+// the permissions of the socket file to perm. A stale socket left behind
+// by a previous process is removed first, but one that is still being
+// served is left alone and ESocketInUse returned.
+//
+// The socket is made in a directory only we can get into and moved into
+// place once it has perm, so it's never reachable with looser
+// permissions.
+func listenUnix(path string, perm os.FileMode) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, errors.Subject(ESocketInUse, path)
+		}
+
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".vega")
+	if err != nil {
+		return nil, err
+	}
+
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "sock")
+
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+
+	ul := l.(*net.UnixListener)
+
+	// The name it was made under is gone once it's moved
+	ul.SetUnlinkOnClose(false)
+
+	err = os.Chmod(tmp, perm)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+
+	if err != nil {
+		ul.Close()
+		return nil, err
+	}
+
+	return &unixListener{ul, path}, nil
+}
+
+// Removes the socket file at path when closed
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixListener) Close() error {
+	os.Remove(l.path)
+	return l.UnixListener.Close()
+}